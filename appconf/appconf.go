@@ -11,10 +11,21 @@ import (
 )
 
 type Config struct {
-	CSRFProtection *CSRFProtection `yaml:"csrf-protection"`
-	Routes         []Route
-	Services       []*Service
-	Deploy         *Deploy
+	CSRFProtection     *CSRFProtection  `yaml:"csrf-protection"`
+	ErrorResponses     []*ErrorResponse `yaml:"error-responses"`
+	RequestHeaders     []string         `yaml:"request-headers"`
+	ContentNegotiation bool             `yaml:"content-negotiation"`
+	Authenticate       *Authenticate    `yaml:"authenticate"`
+	Session            *Session         `yaml:"session"`
+	DBRole             string           `yaml:"db-role"`
+	IdentifyFunc       string           `yaml:"identify-func"`
+	RateLimit          *RateLimit       `yaml:"rate-limit"`
+	TrustedProxies     []string         `yaml:"trusted-proxies"`
+	CORS               *CORS            `yaml:"cors"`
+	Schemas            map[string][]*RequestParam
+	Routes             []Route
+	Services           []*Service
+	Deploy             *Deploy
 }
 
 type CSRFProtection struct {
@@ -40,32 +51,172 @@ type Route struct {
 	DeletePath            string `yaml:"delete"`
 	Path                  string
 	Func                  string
+	Stream                string
 	ReverseProxy          string               `yaml:"reverse-proxy"`
 	DisableCSRFProtection bool                 `yaml:"disable-csrf-protection"`
 	Params                []*RequestParam      `yaml:"params"`
 	DigestPassword        *DigestPassword      `yaml:"digest-password"`
 	CheckPasswordDigest   *CheckPasswordDigest `yaml:"check-password-digest"`
+	ErrorResponses        []*ErrorResponse     `yaml:"error-responses"`
+	Transaction           *Transaction         `yaml:"transaction"`
+	RequestHeaders        []string             `yaml:"request-headers"`
+	SSE                   *SSE                 `yaml:"sse"`
+	WebSocket             *WebSocket           `yaml:"websocket"`
+	ContentNegotiation    *bool                `yaml:"content-negotiation"`
+	Authenticate          *Authenticate        `yaml:"authenticate"`
+	Auth                  string
+	DBRole                string     `yaml:"db-role"`
+	IdentifyFunc          string     `yaml:"identify-func"`
+	RateLimit             *RateLimit `yaml:"rate-limit"`
+	CORS                  *CORS      `yaml:"cors"`
+	Template              string
+	Layout                string
 }
 
 type RequestParam struct {
 	Name         string
 	Type         string
+	Ref          string          `yaml:"$ref"`
 	ArrayElement *RequestParam   `yaml:"array-element"`
 	ObjectFields []*RequestParam `yaml:"object-fields"`
 	TrimSpace    *bool           `yaml:"trim-space"`
 	Required     bool
-	NullifyEmpty bool `yaml:"nullify-empty"`
+	NullifyEmpty bool     `yaml:"nullify-empty"`
+	Layouts      []string `yaml:"layouts"`
+	TimeZone     string   `yaml:"time-zone"`
+	Values       []string `yaml:"values"`
+	Min          *float64
+	Max          *float64
+	MinLength    *int `yaml:"min-length"`
+	MaxLength    *int `yaml:"max-length"`
+	Pattern      string
+	OneOf        []string `yaml:"one-of"`
+	MinItems     *int     `yaml:"min-items"`
+	MaxItems     *int     `yaml:"max-items"`
+	EqualsParam  string   `yaml:"equals-param"`
+	Storage      string
+	MaxSize      int64    `yaml:"max-size"`
+	Accept       []string `yaml:"accept"`
+	Source       string
+	Header       string
+	Cookie       string
+}
+
+// ErrorResponse maps a PostgreSQL error raised by a route function to an HTTP response.
+type ErrorResponse struct {
+	Code     string
+	Hint     string
+	Status   int
+	Template string
+	JSON     bool `yaml:"json"`
+}
+
+// Session configures where the cookie_session is stored and the attributes of the session cookie. The cookie store
+// keeps the entire session in an encrypted cookie. The database store keeps it in the system schema and the cookie only
+// contains a random session token.
+type Session struct {
+	Store       string
+	IdleTimeout string `yaml:"idle-timeout"`
+	MaxLifetime string `yaml:"max-lifetime"`
+	UserKey     string `yaml:"user-key"`
+	CookieName  string `yaml:"cookie-name"`
+	Domain      string
+	Secure      *bool
+	SameSite    string `yaml:"same-site"`
+	MaxAge      *int   `yaml:"max-age"`
+}
+
+// Authenticate configures how the credentials of a request are resolved to a principal.
+type Authenticate struct {
+	Scheme string
+	Header string
+	Func   string
+	Realm  string
+}
+
+// RateLimit configures a token bucket for each key. A bucket holds up to Burst requests and refills at Limit requests
+// per Per. Burst defaults to Limit.
+type RateLimit struct {
+	Key        string
+	SessionKey string `yaml:"session-key"`
+	KeyFunc    string `yaml:"key-func"`
+	Limit      int
+	Per        string
+	Burst      int
+	Store      string
+}
+
+// CORS configures cross-origin resource sharing. AllowedOrigins may include wildcard subdomains such as
+// https://*.example.com or * for any origin.
+type CORS struct {
+	AllowedOrigins   []string `yaml:"allowed-origins"`
+	AllowedMethods   []string `yaml:"allowed-methods"`
+	AllowedHeaders   []string `yaml:"allowed-headers"`
+	ExposedHeaders   []string `yaml:"exposed-headers"`
+	AllowCredentials bool     `yaml:"allow-credentials"`
+	MaxAge           int      `yaml:"max-age"`
+}
+
+type Transaction struct {
+	Isolation        string
+	ReadOnly         bool   `yaml:"read-only"`
+	StatementTimeout string `yaml:"statement-timeout"`
+	LockTimeout      string `yaml:"lock-timeout"`
+	TimeZone         string `yaml:"time-zone"`
+	MaxRetries       *int   `yaml:"max-retries"`
+}
+
+// SSE configures a route that sends PostgreSQL notifications to the client as server-sent events.
+type SSE struct {
+	Channel      string
+	ChannelsFunc string `yaml:"channels-func"`
+	FilterFunc   string `yaml:"filter-func"`
+}
+
+// WebSocket configures a route that dispatches WebSocket messages to functions and sends PostgreSQL notifications to
+// the client.
+type WebSocket struct {
+	Messages       []*WebSocketMessage
+	Channels       []string
+	ChannelsFunc   string `yaml:"channels-func"`
+	RequireSession bool   `yaml:"require-session"`
+	MaxConnections int    `yaml:"max-connections"`
+	MaxMessageSize int64  `yaml:"max-message-size"`
+	PingInterval   string `yaml:"ping-interval"`
+}
+
+// WebSocketMessage maps a WebSocket message type to the function that handles it.
+type WebSocketMessage struct {
+	Type string
+	Func string
 }
 
 type DigestPassword struct {
-	PasswordParam string `yaml:"password-param"`
-	DigestParam   string `yaml:"digest-param"`
+	PasswordParam string       `yaml:"password-param"`
+	DigestParam   string       `yaml:"digest-param"`
+	PasswordHash  PasswordHash `yaml:",inline"`
 }
 
 type CheckPasswordDigest struct {
 	PasswordParam         string `yaml:"password-param"`
 	ResultParam           string `yaml:"result-param"`
 	GetPasswordDigestFunc string `yaml:"get-password-digest-func"`
+
+	// RehashParam receives a new digest when the stored digest does not use the algorithm and parameters of
+	// PasswordHash.
+	RehashParam  string       `yaml:"rehash-param"`
+	PasswordHash PasswordHash `yaml:",inline"`
+}
+
+// PasswordHash configures the algorithm and parameters used to digest passwords. Zero values use the defaults of the
+// algorithm.
+type PasswordHash struct {
+	Algorithm   string
+	Cost        int    // bcrypt cost or base 2 logarithm of the scrypt N parameter
+	BlockSize   int    `yaml:"block-size"` // scrypt r parameter
+	Memory      uint32 // argon2id memory in KiB
+	Iterations  uint32 // argon2id time parameter
+	Parallelism int    // argon2id threads or scrypt p parameter
 }
 
 type Service struct {
@@ -100,6 +251,36 @@ func (c *Config) Merge(other *Config) {
 	if other.Deploy != nil {
 		c.Deploy = other.Deploy
 	}
+	if other.Authenticate != nil {
+		c.Authenticate = other.Authenticate
+	}
+	if other.Session != nil {
+		c.Session = other.Session
+	}
+	if other.DBRole != "" {
+		c.DBRole = other.DBRole
+	}
+	if other.IdentifyFunc != "" {
+		c.IdentifyFunc = other.IdentifyFunc
+	}
+	if other.RateLimit != nil {
+		c.RateLimit = other.RateLimit
+	}
+	if other.CORS != nil {
+		c.CORS = other.CORS
+	}
+	if other.ContentNegotiation {
+		c.ContentNegotiation = true
+	}
+	if other.Schemas != nil && c.Schemas == nil {
+		c.Schemas = make(map[string][]*RequestParam, len(other.Schemas))
+	}
+	for name, params := range other.Schemas {
+		c.Schemas[name] = params
+	}
+	c.ErrorResponses = append(c.ErrorResponses, other.ErrorResponses...)
+	c.RequestHeaders = append(c.RequestHeaders, other.RequestHeaders...)
+	c.TrustedProxies = append(c.TrustedProxies, other.TrustedProxies...)
 	c.Routes = append(c.Routes, other.Routes...)
 	c.Services = append(c.Services, other.Services...)
 }
@@ -138,6 +319,23 @@ func Load(path string) (*Config, error) {
 			return nil
 		}
 
+		if info.Mode().IsRegular() && strings.HasSuffix(path, JSONSchemaFileSuffix) {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			params, err := ParseJSONSchema(data)
+			if err != nil {
+				return fmt.Errorf("failed to parse JSON Schema %s: %v", path, err)
+			}
+
+			config.Merge(&Config{Schemas: map[string][]*RequestParam{
+				strings.TrimSuffix(filepath.Base(path), JSONSchemaFileSuffix): params,
+			}})
+
+			return nil
+		}
+
 		return nil
 	}
 
@@ -94,3 +94,79 @@ func TestConfigSingleFile(t *testing.T) {
 		}
 	}
 }
+
+func TestConfigLoadSchemas(t *testing.T) {
+	config, err := appconf.Load("testdata/schemas")
+	require.NoError(t, err)
+	require.NotNil(t, config)
+
+	require.Len(t, config.Schemas, 2)
+	{
+		todo := config.Schemas["todo"]
+		require.Len(t, todo, 2)
+		assert.Equal(t, "name", todo[0].Name)
+		assert.Equal(t, 100, *todo[0].MaxLength)
+		assert.Equal(t, "address", todo[1].Name)
+		assert.Equal(t, "address", todo[1].Ref)
+	}
+
+	{
+		address := config.Schemas["address"]
+		require.Len(t, address, 6)
+
+		p := address[0]
+		assert.Equal(t, "country", p.Name)
+		assert.Equal(t, "country", p.Ref)
+
+		p = address[1]
+		assert.Equal(t, "kind", p.Name)
+		assert.Equal(t, "enum", p.Type)
+		assert.Equal(t, []string{"home", "work"}, p.Values)
+
+		p = address[2]
+		assert.Equal(t, "location", p.Name)
+		assert.Equal(t, "object", p.Type)
+		require.Len(t, p.ObjectFields, 1)
+		assert.Equal(t, "lat", p.ObjectFields[0].Name)
+		assert.Equal(t, "numeric", p.ObjectFields[0].Type)
+		assert.Equal(t, float64(-90), *p.ObjectFields[0].Min)
+		assert.Equal(t, float64(90), *p.ObjectFields[0].Max)
+
+		p = address[3]
+		assert.Equal(t, "street", p.Name)
+		assert.Equal(t, "text", p.Type)
+		assert.True(t, p.Required)
+		assert.Equal(t, 1, *p.MinLength)
+
+		p = address[4]
+		assert.Equal(t, "tags", p.Name)
+		assert.Equal(t, "array", p.Type)
+		assert.Equal(t, "text", p.ArrayElement.Type)
+		assert.Equal(t, 3, *p.MaxItems)
+
+		p = address[5]
+		assert.Equal(t, "zip", p.Name)
+		assert.Equal(t, "text", p.Type)
+		assert.False(t, p.Required)
+		assert.Equal(t, "(?s:.*)(?:^[0-9]{5}$)(?s:.*)", p.Pattern)
+	}
+
+	require.Len(t, config.Routes, 1)
+	require.Len(t, config.Routes[0].Params, 1)
+	assert.Equal(t, "todo", config.Routes[0].Params[0].Ref)
+}
+
+func TestParseJSONSchemaErrors(t *testing.T) {
+	for i, tt := range []struct {
+		schema string
+		errStr string
+	}{
+		{schema: `{"type": "string"}`, errStr: "schema must have type object: string"},
+		{schema: `{"type": "object", "properties": {"a": {"type": "string", "format": "hostname"}}}`, errStr: "a: unsupported string format: hostname"},
+		{schema: `{"type": "object", "properties": {"a": {"type": ["string", "integer"]}}}`, errStr: "a: multiple types are not supported: [string integer]"},
+		{schema: `{"type": "object", "properties": {"a": {"$ref": "#/definitions/b"}}}`, errStr: "a: $ref must be a schema file: #/definitions/b"},
+	} {
+		_, err := appconf.ParseJSONSchema([]byte(tt.schema))
+		assert.EqualErrorf(t, err, tt.errStr, "%d", i)
+	}
+}
@@ -0,0 +1,199 @@
+package appconf
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// JSONSchemaFileSuffix is the suffix of JSON Schema files in the config directory. Each file is loaded as a schema
+// named by the file name without the suffix. e.g. todo.schema.json is the schema todo.
+const JSONSchemaFileSuffix = ".schema.json"
+
+type jsonSchema struct {
+	Ref        string                 `json:"$ref"`
+	Type       interface{}            `json:"type"`
+	Format     string                 `json:"format"`
+	Enum       []interface{}          `json:"enum"`
+	Properties map[string]*jsonSchema `json:"properties"`
+	Required   []string               `json:"required"`
+	Items      *jsonSchema            `json:"items"`
+	Minimum    *float64               `json:"minimum"`
+	Maximum    *float64               `json:"maximum"`
+	MinLength  *int                   `json:"minLength"`
+	MaxLength  *int                   `json:"maxLength"`
+	Pattern    string                 `json:"pattern"`
+	MinItems   *int                   `json:"minItems"`
+	MaxItems   *int                   `json:"maxItems"`
+}
+
+// ParseJSONSchema converts a JSON Schema object to the params of a schema. Only the subset of JSON Schema that maps
+// to request params is supported. A $ref must name another schema file such as "address.schema.json".
+func ParseJSONSchema(data []byte) ([]*RequestParam, error) {
+	var s jsonSchema
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return nil, err
+	}
+
+	typeName, err := s.typeName()
+	if err != nil {
+		return nil, err
+	}
+	if typeName != "object" {
+		return nil, fmt.Errorf("schema must have type object: %s", typeName)
+	}
+
+	return s.objectFields()
+}
+
+// typeName returns the JSON Schema type of s. A type such as ["string", "null"] is treated as "string".
+func (s *jsonSchema) typeName() (string, error) {
+	switch t := s.Type.(type) {
+	case nil:
+		if s.Properties != nil {
+			return "object", nil
+		}
+		return "", nil
+	case string:
+		return t, nil
+	case []interface{}:
+		var typeName string
+		for _, e := range t {
+			if e, ok := e.(string); ok && e != "null" {
+				if typeName != "" {
+					return "", fmt.Errorf("multiple types are not supported: %v", t)
+				}
+				typeName = e
+			}
+		}
+		return typeName, nil
+	default:
+		return "", fmt.Errorf("bad type: %v", t)
+	}
+}
+
+func (s *jsonSchema) objectFields() ([]*RequestParam, error) {
+	required := make(map[string]struct{}, len(s.Required))
+	for _, name := range s.Required {
+		required[name] = struct{}{}
+	}
+
+	// JSON objects are unordered so sort fields for consistent results.
+	names := make([]string, 0, len(s.Properties))
+	for name := range s.Properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fields := make([]*RequestParam, 0, len(names))
+	for _, name := range names {
+		rp, err := s.Properties[name].requestParam(name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		_, rp.Required = required[name]
+		fields = append(fields, rp)
+	}
+
+	return fields, nil
+}
+
+func (s *jsonSchema) requestParam(name string) (*RequestParam, error) {
+	rp := &RequestParam{
+		Name:      name,
+		Min:       s.Minimum,
+		Max:       s.Maximum,
+		MinLength: s.MinLength,
+		MaxLength: s.MaxLength,
+		MinItems:  s.MinItems,
+		MaxItems:  s.MaxItems,
+	}
+
+	if s.Ref != "" {
+		ref := path.Base(s.Ref)
+		if !strings.HasSuffix(ref, JSONSchemaFileSuffix) {
+			return nil, fmt.Errorf("$ref must be a schema file: %s", s.Ref)
+		}
+		rp.Ref = strings.TrimSuffix(ref, JSONSchemaFileSuffix)
+		return rp, nil
+	}
+
+	if s.Pattern != "" {
+		// JSON Schema patterns are not anchored but request param patterns must match the entire value.
+		rp.Pattern = `(?s:.*)(?:` + s.Pattern + `)(?s:.*)`
+	}
+
+	typeName, err := s.typeName()
+	if err != nil {
+		return nil, err
+	}
+
+	switch typeName {
+	case "string":
+		switch s.Format {
+		case "":
+			rp.Type = "text"
+		case "date":
+			rp.Type = "date"
+		case "time":
+			rp.Type = "time"
+		case "date-time":
+			rp.Type = "timestamptz"
+		case "email":
+			rp.Type = "email"
+		case "uri":
+			rp.Type = "url"
+		case "uuid":
+			rp.Type = "uuid"
+		default:
+			return nil, fmt.Errorf("unsupported string format: %s", s.Format)
+		}
+	case "integer":
+		rp.Type = "bigint"
+	case "number":
+		rp.Type = "numeric"
+	case "boolean":
+		rp.Type = "boolean"
+	case "array":
+		rp.Type = "array"
+		if s.Items != nil {
+			rp.ArrayElement, err = s.Items.requestParam("")
+			if err != nil {
+				return nil, fmt.Errorf("items: %v", err)
+			}
+		}
+	case "object":
+		rp.Type = "object"
+		if s.Properties != nil {
+			rp.ObjectFields, err = s.objectFields()
+			if err != nil {
+				return nil, err
+			}
+		}
+	case "":
+		return nil, errors.New("missing type")
+	default:
+		return nil, fmt.Errorf("unsupported type: %s", typeName)
+	}
+
+	if s.Enum != nil {
+		if rp.Type == "text" {
+			rp.Type = "enum"
+			rp.Values = make([]string, len(s.Enum))
+			for i, v := range s.Enum {
+				rp.Values[i] = fmt.Sprint(v)
+			}
+		} else {
+			rp.OneOf = make([]string, len(s.Enum))
+			for i, v := range s.Enum {
+				rp.OneOf[i] = fmt.Sprint(v)
+			}
+		}
+	}
+
+	return rp, nil
+}
@@ -18,6 +18,7 @@ var serveCmd = &cobra.Command{
 		viper.BindPFlag("http_service_address", cmd.Flags().Lookup("http-service-address"))
 		viper.BindPFlag("app_path", cmd.Flags().Lookup("app-path"))
 		viper.BindPFlag("secret_key_base", cmd.Flags().Lookup("secret-key-base"))
+		viper.BindPFlag("previous_secret_key_bases", cmd.Flags().Lookup("previous-secret-key-bases"))
 
 		logger := current.Logger(context.Background())
 
@@ -36,6 +37,14 @@ var serveCmd = &cobra.Command{
 		}
 		current.SetSecretKeyBase(secretKeyBase)
 
+		previousSecretKeyBases := viper.GetStringSlice("previous_secret_key_bases")
+		for _, skb := range previousSecretKeyBases {
+			if len(skb) < 64 {
+				logger.Fatal().Msg("previous_secret_key_bases must each be at least 64 characters")
+			}
+		}
+		current.SetPreviousSecretKeyBases(previousSecretKeyBases)
+
 		err := db.ConnectAll(context.Background())
 		if err != nil {
 			logger.Fatal().Err(err).Msg("failed to connect to database")
@@ -54,4 +63,5 @@ func init() {
 	serveCmd.Flags().StringP("http-service-address", "a", "127.0.0.1:3000", "HTTP service address")
 	serveCmd.Flags().StringP("app-path", "p", ".", "Application path")
 	serveCmd.Flags().String("secret-key-base", "", "Secret key base")
+	serveCmd.Flags().StringSlice("previous-secret-key-bases", nil, "Previous secret key bases that are still accepted")
 }
@@ -8,4 +8,5 @@ type ctxKey int
 const (
 	_ ctxKey = iota
 	secretKeyBaseCtxKey
+	previousSecretKeyBasesCtxKey
 )
@@ -30,3 +30,32 @@ func SecretKeyBase(ctx context.Context) string {
 func WithSecretKeyBase(ctx context.Context, s string) context.Context {
 	return context.WithValue(ctx, secretKeyBaseCtxKey, s)
 }
+
+var previousSecretKeyBases []string
+
+// SetPreviousSecretKeyBases sets the secret key bases that were in use before the current one. Values that were
+// signed or encrypted with them are still accepted. This allows the secret key base to be rotated.
+func SetPreviousSecretKeyBases(s []string) {
+	if previousSecretKeyBases != nil {
+		panic("cannot call SetPreviousSecretKeyBases twice")
+	}
+	for _, skb := range s {
+		if skb == "" {
+			panic("s must not contain empty strings")
+		}
+	}
+	previousSecretKeyBases = append([]string{}, s...)
+}
+
+func PreviousSecretKeyBases(ctx context.Context) []string {
+	v := ctx.Value(previousSecretKeyBasesCtxKey)
+	if v != nil {
+		return v.([]string)
+	}
+
+	return previousSecretKeyBases
+}
+
+func WithPreviousSecretKeyBases(ctx context.Context, s []string) context.Context {
+	return context.WithValue(ctx, previousSecretKeyBasesCtxKey, s)
+}
@@ -50,6 +50,7 @@ func Develop(config *Config) {
 
 	host := &server.Host{
 		HTTPListenAddr: config.ListenAddress,
+		UploadPath:     filepath.Join(config.ProjectPath, "uploads"),
 	}
 
 	err = host.Load(context.Background(), config.ProjectPath)
@@ -0,0 +1,23 @@
+set search_path = {{.hannibalSchema}};
+
+create table sessions (
+  id bytea primary key,
+  user_id text,
+  data jsonb not null,
+  creation_time timestamptz not null,
+  access_time timestamptz not null,
+  expire_time timestamptz not null
+);
+
+create index on sessions (user_id);
+create index on sessions (expire_time);
+
+create function invalidate_sessions(user_id text) returns bigint
+language sql security definer as $$
+  with deleted as (
+    delete from {{.hannibalSchema}}.sessions
+    where sessions.user_id = invalidate_sessions.user_id
+    returning 1
+  )
+  select count(*) from deleted;
+$$;
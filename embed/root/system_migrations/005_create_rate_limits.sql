@@ -0,0 +1,41 @@
+set search_path = {{.hannibalSchema}};
+
+create table rate_limits (
+  key text primary key,
+  tokens float8 not null,
+  update_time timestamptz not null,
+  expire_time timestamptz not null
+);
+
+create index on rate_limits (expire_time);
+
+-- rate_limit_take refills the bucket key to the time now and takes a token from it if one is available. The bucket
+-- expires when it would be full again.
+create function rate_limit_take(
+  _key text,
+  _capacity float8,
+  _refill_rate float8,
+  _now timestamptz,
+  out allowed boolean,
+  out remaining float8
+)
+language plpgsql as $$
+begin
+  insert into {{.hannibalSchema}}.rate_limits as rl (key, tokens, update_time, expire_time)
+  values (_key, _capacity, _now, _now)
+  on conflict (key) do update
+    set tokens = least(_capacity, rl.tokens + greatest(extract(epoch from _now - rl.update_time), 0) * _refill_rate),
+      update_time = greatest(_now, rl.update_time)
+  returning rl.tokens into remaining;
+
+  allowed := remaining >= 1;
+  if allowed then
+    remaining := remaining - 1;
+  end if;
+
+  update {{.hannibalSchema}}.rate_limits
+  set tokens = remaining,
+    expire_time = update_time + make_interval(secs => (_capacity - remaining) / _refill_rate)
+  where key = _key;
+end;
+$$;
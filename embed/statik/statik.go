@@ -8,7 +8,7 @@ import (
 
 
 func init() {
-	data := "PK\x03\x04\x14\x00\x08\x00\x08\x00\xee\xbd\xebP\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x0d\x00	\x00app_setup.sqlUT\x05\x00\x01\x91O\n_\x14\xc71\x0e\x850\x08\x06\xe0\x9dS\xfc\x03\xc3{\xd1E\xd7\x9e\x86\xb4\xd84i0\x16\xb8\xbfq\xfc\xeaR	\xc5\x95Vc\xdc\x06i\xed7,v\x0c\x8b?\x96F.\xf3\x0f4\xc5zJW\xf83!\x0ef\x02\\\xa7\xd6\x00\x1f\xd8\xc0g!\xe6Bo\x00\x00\x00\xff\xffPK\x07\x08/\xebM\x9cP\x00\x00\x00S\x00\x00\x00PK\x03\x04\x14\x00\x08\x00\x08\x00\xda\xab\x08Q\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00&\x00	\x00system_migrations/001_create_users.sqlUT\x05\x00\x01\x8d\x19/_|\xcdAN\xc40\x10D\xd1\xbdOQK\x90\x10\x17\x18q\n\x0e\x10u\xe2\x82\xb4\xb0{\x82]\x96\x08\xa3\xb9;J\x16\xac\x10\xfb\xa7\xff;\x85Nk\xcb:m\xa6\x15/\xb8\xdd\x9eW\x8b\xf0\xd9\xca\xeb\xb2\xb2\xda\xfd~Iii4\x11\xb2\xb9\x10\xa3\xb3u<$\xc03<\x84\xady\xb5\xb6\xe3\x83;\xde\x19l&f\xcc;2\xdfl\x14\xc1:<3\xe4\xda\x9f\x12\xce@X%\xc4/!\xaeB\x8cR0\xc2?\x07\x0fp\xee\xfc\x1a\x93\xfcP^\xd9eu\xd3\xf7/>T\xb1\xaeil\xd9\xc4\xffaf\xe1\x1f&=^\xd2O\x00\x00\x00\xff\xffPK\x07\x08\x14\x80|\xa2\xa1\x00\x00\x00\x01\x01\x00\x00PK\x03\x04\x14\x00\x08\x00\x08\x00\xdd\xab\x08Q\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00)\x00	\x00system_migrations/002_create_api_keys.sqlUT\x05\x00\x01\x93\x19/_d\x8fQj\xc3@\x0cD\xff\xf7\x14\xf3\xd9@\xe9\x05BO\xd1\x03\x18\xd9;\x89E\xd6\x8a\xbb\xd2B\xb7!w/6\xa1)\xf4G?\xf34\xccs\x06\x9cR\xa7yX%f\xbc\xe3v{\x9b\xc5LG)\x1f\xd3\xccE\xee\xf7cJS\xa5\x04\x112\x16BV\x1d.\xec\x8e\x97\x04h\x86Z`\xad\xbaH\xed\xb8\xb0\xe3Lc\x95`\xc6\xd8\x91y\x92V\x02\xe2\xd0L\x0b\x8d\xfe\x9a\x80\xe6\xac\xc3\xe3\xd7\xae\x01k\xa5\xa0\xf2\xc4J\x9b\xe8{\xee\x1b\x98\xf5L\x0f\x8c=(O\xb2\x99~6n\xf9\xbeL\xaf6\x84.\xc4v<dY\xe3\xfb\x17\xde[X\x18\xfc\xc7\xa4\xc3\xd3M-\xf3\x0bW\xfb\xa3\xf7\x18y8\xa6\x9f\x00\x00\x00\xff\xffPK\x07\x08\n=\xe41\xba\x00\x00\x00(\x01\x00\x00PK\x03\x04\x14\x00\x08\x00\x08\x00\xe3\xab\x08Q\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00,\x00	\x00system_migrations/003_create_deploy_keys.sqlUT\x05\x00\x01\x9a\x19/_d\xcfAj\x031\x0c\x05\xd0\xbdO\xf1\x97\x0d\x94^ \xf4\x14=\xc0\xa0\x19\xfftD<\x1a\xd7\x96\xa1n\xc8\xdd\x8bCh(\xd9h\xa3'\xf4\x7f\xa5\xa3R\xca\xb2NY|\xc5;.\x97\xb7U\xcct\x96\xf4\xb1\xac\xdc\xe4z=\x86\xb0\x14\x8a\x13.s\"\"s\xda\xfbtf\xafx	\x80F\xa89r\xd1MJ\xc7\x99\x1d\x9f4\x16qF\xcc\x1d\x91'i\xc9!\x15\x1ai\xae\xde_\x03\xd0*\xcbt\xbf\xb5\xdda-%\x14\x9eXh\x0b\xebm_\x07\xccmN\xba\x8c\x7f\x98\xbbS\x1e\xba\x99~5\x0es\x0b\xa8\xbbM\xae\x1b1Fu\xd9\xb2\xff\xfc\xe1\xa1\"\x13\x9dO&\x1c\x1e\x15\xd5\"\xbf\xb1\xdb\xff\x96\xf7\xac\x87c\xf8\x0d\x00\x00\xff\xffPK\x07\x08c\xac\xc2R\xbe\x00\x00\x002\x01\x00\x00PK\x01\x02\x14\x03\x14\x00\x08\x00\x08\x00\xee\xbd\xebP/\xebM\x9cP\x00\x00\x00S\x00\x00\x00\x0d\x00	\x00\x00\x00\x00\x00\x00\x00\x00\x00\xa4\x81\x00\x00\x00\x00app_setup.sqlUT\x05\x00\x01\x91O\n_PK\x01\x02\x14\x03\x14\x00\x08\x00\x08\x00\xda\xab\x08Q\x14\x80|\xa2\xa1\x00\x00\x00\x01\x01\x00\x00&\x00	\x00\x00\x00\x00\x00\x00\x00\x00\x00\xa4\x81\x94\x00\x00\x00system_migrations/001_create_users.sqlUT\x05\x00\x01\x8d\x19/_PK\x01\x02\x14\x03\x14\x00\x08\x00\x08\x00\xdd\xab\x08Q\n=\xe41\xba\x00\x00\x00(\x01\x00\x00)\x00	\x00\x00\x00\x00\x00\x00\x00\x00\x00\xa4\x81\x92\x01\x00\x00system_migrations/002_create_api_keys.sqlUT\x05\x00\x01\x93\x19/_PK\x01\x02\x14\x03\x14\x00\x08\x00\x08\x00\xe3\xab\x08Qc\xac\xc2R\xbe\x00\x00\x002\x01\x00\x00,\x00	\x00\x00\x00\x00\x00\x00\x00\x00\x00\xa4\x81\xac\x02\x00\x00system_migrations/003_create_deploy_keys.sqlUT\x05\x00\x01\x9a\x19/_PK\x05\x06\x00\x00\x00\x00\x04\x00\x04\x00d\x01\x00\x00\xcd\x03\x00\x00\x00\x00"
+	data := "PK\x03\x04\x14\x00\x08\x00\x08\x00\xf7\x84\x84S\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x0d\x00	\x00app_setup.sqlUT\x05\x00\x01\xd3\x99\xaba\x00S\x00\xac\xffcreate function add(int, int) returns int\nlanguage sql as $$\n  select $1 + $2;\n$$;\n\x03\x00PK\x07\x08/\xebM\x9cZ\x00\x00\x00S\x00\x00\x00PK\x03\x04\x14\x00\x08\x00\x08\x00\xf7\x84\x84S\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00&\x00	\x00system_migrations/001_create_users.sqlUT\x05\x00\x01\xd3\x99\xaba|\xcdAN\xc40\x10D\xd1\xbdOQK\x90\x10\x17\x18q\n\x0e\x10u\xe2\x82\xb4\xb0{\x82]\x96\x08\xa3\xb9;J\x16\xac\x10\xfb\xa7\xff;\x85Nk\xcb:m\xa6\x15/\xb8\xdd\x9eW\x8b\xf0\xd9\xca\xeb\xb2\xb2\xda\xfd~Iii4\x11\xb2\xb9\x10\xa3\xb3u<$\xc03<\x84\xady\xb5\xb6\xe3\x83;\xde\x19l&f\xcc;2\xdfl\x14\xc1:<3\xe4\xda\x9f\x12\xce@X%\xc4/!\xaeB\x8cR0\xc2?\x07\x0fp\xee\xfc\x1a\x93\xfcP^\xd9eu\xd3\xf7/>T\xb1\xaeil\xd9\xc4\xffaf\xe1\x1f&=^\xd2\xcf\x00PK\x07\x08\x14\x80|\xa2\x9d\x00\x00\x00\x01\x01\x00\x00PK\x03\x04\x14\x00\x08\x00\x08\x00\xf7\x84\x84S\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00)\x00	\x00system_migrations/002_create_api_keys.sqlUT\x05\x00\x01\xd3\x99\xabad\xcfQj\xc3@\x0c\x04\xd0\xff=\xc5|6\x10z\x81\xd0S\xf4\x00F\xf6Nb\x91\xb5\xec\xae\xb4\xd0m\xc8\xdd\x8bCi\n\xfd\xd1\xcf<\xc1\x8c3\xe0\x94:\xcd\xc3&1\xe3\x0d\xb7\xdb\xeb,f:Jy\x9ff.r\xbf\x9fR\x9a*%\x88\x90\xb1\x10\xb2\xe9pew\xbc$@3\xd4\x02[\xd5Ej\xc7\x95\x1d\x17\x1a\xab\x043\xc6\x8e\xcc\xb3\xb4\x12\x10\x87fZh\xf4c\x02\x9a\xb3\x0e?\xbf\xb6\x06\xac\x95\x82\xca3+m\xa2?r?& \xeb\x85\x1e\x18{P\x9e\xb2\x99~4\xee\xf9\xa3\x99\xae6\x84.\xc4~<d\xd9\xe2\xeb\x17\xef*\xb30\xf8\xcf\xa4\xc3s\x9bZ\xe6'V\xfb3\xaf9\xeb\xa0\xf9pJ\xdf\x03\x00PK\x07\x08\n=\xe41\xba\x00\x00\x00(\x01\x00\x00PK\x03\x04\x14\x00\x08\x00\x08\x00\xf7\x84\x84S\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00,\x00	\x00system_migrations/003_create_deploy_keys.sqlUT\x05\x00\x01\xd3\x99\xabad\xcfAJ\x03A\x10\x85\xe1}\x9f\xe2-\x0d\x88\x17\x08\x9e\xc2\x03\x0c5\xd3/N\x91\x9e\x9a\xb1\xab\x1alC\xee.\xed\xc2 nj\xf5A\xbd\xdf\x19pJ]\xd6\xe9\x90X\xf1\x8a\xdb\xede\x153\x9d\xa5\xbc-+7\xb9\xdf\xcf)-\x95\x12D\xc8\\\x88\xcc\xa3\xec}\xba\xb2;\x9e\x12\xa0\x19j\x81\xa3\xea&\xb5\xe3\xca\x8ew\x1a\xab\x043\xe6\x8e\xcc\x8b\xb4\x12\x10\x87fZh\xf4\xe7\x044g\x9d4C-`{\xc0Z)\xa8\xbc\xb0\xd2\x16:\x9a\xb3\xfa\x80G\x9b\x8b.\xe3\x1f\xe6\x1e\x94\x87n\xa6\x1f\x8d\xc3\xfc\x0c\xd4\xdd\xa6\xd0\x8d\x18\xc7C\xb6#\xbe~\xf1P\x99\x85\xc1\x7f&\x9d\x1e\x89j\x99\x9f\xd8\xedoes\xd6I\xf3\xe9\x9c\xbe\x07\x00PK\x07\x08c\xac\xc2R\xbf\x00\x00\x002\x01\x00\x00PK\x03\x04\x14\x00\x08\x00\x08\x00\x83\x00Q]\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00)\x00	\x00system_migrations/004_create_sessions.sqlUT\x05\x00\x01w\xbb\xd2j|\x91A\x8e\xdb0\x0cE\xf7:\xc5_x1.\x8a\x00]\x1bs\x8a\x1e\xc0\xa0%\xc6f+\xd3\xaeHw\xe2\x0e\xe6\xee\x85\x9d\x18\x93\x02i6\x02D}~\xbdO\x1a;\x8c\xa9\xc4\xa1\x9d\xc9\x07\xbc\xe2\xfd\xfd4\x90\xaat\x94\xbf\xc7\x81G\xfa\xf8hB\x88\x85\xc9\x19N]f\x18\x9b\xc9\xa4\x86\x97\x00HB\xb7:\x13\xe6\"#\x95\x15?y\xfd\x1a\x80\xc5\xb8\xb4\x92\xe0|\xf1\xed\x9e\xc8	?l\xd2\x0e:9t\xc9y+\xef\xc62i\xeb22\xb6\xc3\x9c\xc6\xd9\xff\xfc\xa3\xa2\x18\xd9\xec\xb9\x86/\xb3\x14\xfe\xbf&\xd4\x9f9D\x13_0\xe9]\x94\x1bo\xdd<\xd1\xdc}qgv^4n\x11 \xfa\x9b\xb2$rn\x8f\x9e\xc3v\x1fC\x8d\xc2\xbe\x145t\xd2\x8bz\xc8\xa4\xfdB=\xc3~e\x18\xc7\xa5\x88\xafH|\x16\xe5\x022TU\x00\xde\xc4\x07$\xce\xec\x9c@\xd7\xa9\xe3V\xc0\xb9L\xe3\xa3\x9d\x9d\x0e\x82]\xfc6p\xf9\xdc\xdb\xe9\x80z}\x84|\xbc\xee\x8dW`\xd1\x1e\xdf\x02P\x07\xc08st\xc4iQ\x7f\xf9R_\x01ntM\xa8\xaa&\xfc\x1d\x00PK\x07\x08\xe0\xba\xd4\x0c\x1e\x01\x00\x00T\x02\x00\x00PK\x03\x04\x14\x00\x08\x00\x08\x00\x89\x01Q]\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00,\x00	\x00system_migrations/005_create_rate_limits.sqlUT\x05\x00\x01c\xbd\xd2j\x84SA\x92\x9b0\x10\xbc\xeb\x15}\xf0\x01\xb2\xd8In\xa9\xb8\xd8O$wj\x0c\x03\xa8,$\"\x0dk;[\xfb\xf7\x94\xc0k\xc4V*\xe1\xc0a\xd4\xd3\x9a\xee\x1e\x05\x16\x04&_\xf7\xd5H\xd2\xa3\xc4\xeb\xeb\xa1'k\xf5\x89\xcc\x8f\xba\xe7\x81\xde\xde\x8eJ\xd5\x9eI\x18B'\xc3\xf0$\\\x19=h	\xc8\x14p\xe6\x1b\x84\xaf\x82\xd1\xeb\x81\xfc\x0dg\xbe\x15\n\x10wf\x1b\xd0\x1aG\xf2\x0d\xd6	\xecdL\xa1\x80il\"\x87\xe8\x81\x11\x7fAh\x18\xe5\xf7\x06\xc3\xd7Q\xfb\x7f`T\xbe\xce\xa5m\xc3W8\xbb\x1d-a\x88\xd8\xfd>9\xae\x84\xce\x0c\xcf\xad6&@z\xc6i\xaa\xcf,\x8b\x187W\xe2d\xb0\xee\x02\xb2\x0d\">\x80\x16Qh\xbd\x1b\xa0\x05\xba\x85\xb3\x0c\x1d@/\xa4M\xb4\xe7\x80\x9f\x0f\xb6x\xe72E\xc0\xa5g\x1b[.n2\x0dN\x8cv2\x06\xd4\x91\xb6\x87w\x1d\xeddk\xd1\x1b\x1d\xf3\xa0\x99\x02\xaaw\x9b\xa39UM#\xd5Znww\xe7\xda\xa2\xa6\x8a\xbdi9*HL\x8eP7	\xc8\x18w\xe1\x06'\xe7\x0c\x93}/{\x1eH[m\xbb;\x85\xca\x95!\xdbM\xd41F3v\xe1\x97\x01\x05\xecv\xea\xc4\x9d\xb6\n\xd06\xb0\x17h+\xeeo\xdbsXM\x0f\xb1\xd3\x1bdqA\xee\xebQ\xa4\xcbP\xa4\xa9\xe7\nx!3q@\x16\xc5\x17\xab\xeabV\xb5\xfc#\xccY\xd4\xce\xb6F\xd72\x93\xe7h\xdc\x9dW\x01@\\\xf3\xe5:\x940LA\xb2\x84\xcb\x9b\xc3\xfd\xf0	\xdd\xbc\xe8A2\xbe\x8a\xa7Z2\x1e]\xdd/y\xc7;\xb1\x8f\xf0d\xe4\xbc\xc0\x97\x1c\x9f6\xee\xe7\xd1\xcc\xf8%8\x94+w$*>\xf2(\xc0\xb3L~\xf6~\x1di\xb6\xf5\x11\xcaQ)<\x92\xfb^&i=\x97\xf8z\x8ci\xb4\x8fs\xe99\xe6\x83\x04\xb5i\xd9/\x1dl\x1b\xe8vf^\xe6\xfd_\x8a\xea\x83\xa1\x0f\xfaEv\x12!\xca\x8d\x05O\x18\xe8\xcc\x95\xb6\xc2\xfe\x85L\x16\xb8\x0e(\x9f\xb1\x86\x81\xfd\xca\x96\xe3\xf3\xd6U\x85\xf8\x88<\xcfo\xb4\x9c\x1f\xc4Q\xb1m\x8ej\xb7;\xaa?\x03\x00PK\x07\x08R\xf0\\&\x1c\x02\x00\x00\xcb\x04\x00\x00PK\x01\x02\x14\x03\x14\x00\x08\x00\x08\x00\xf7\x84\x84S/\xebM\x9cZ\x00\x00\x00S\x00\x00\x00\x0d\x00	\x00\x00\x00\x00\x00\x00\x00\x00\x00\xb4\x81\x00\x00\x00\x00app_setup.sqlUT\x05\x00\x01\xd3\x99\xabaPK\x01\x02\x14\x03\x14\x00\x08\x00\x08\x00\xf7\x84\x84S\x14\x80|\xa2\x9d\x00\x00\x00\x01\x01\x00\x00&\x00	\x00\x00\x00\x00\x00\x00\x00\x00\x00\xb4\x81\x9e\x00\x00\x00system_migrations/001_create_users.sqlUT\x05\x00\x01\xd3\x99\xabaPK\x01\x02\x14\x03\x14\x00\x08\x00\x08\x00\xf7\x84\x84S\n=\xe41\xba\x00\x00\x00(\x01\x00\x00)\x00	\x00\x00\x00\x00\x00\x00\x00\x00\x00\xb4\x81\x98\x01\x00\x00system_migrations/002_create_api_keys.sqlUT\x05\x00\x01\xd3\x99\xabaPK\x01\x02\x14\x03\x14\x00\x08\x00\x08\x00\xf7\x84\x84Sc\xac\xc2R\xbf\x00\x00\x002\x01\x00\x00,\x00	\x00\x00\x00\x00\x00\x00\x00\x00\x00\xb4\x81\xb2\x02\x00\x00system_migrations/003_create_deploy_keys.sqlUT\x05\x00\x01\xd3\x99\xabaPK\x01\x02\x14\x03\x14\x00\x08\x00\x08\x00\x83\x00Q]\xe0\xba\xd4\x0c\x1e\x01\x00\x00T\x02\x00\x00)\x00	\x00\x00\x00\x00\x00\x00\x00\x00\x00\xa4\x81\xd4\x03\x00\x00system_migrations/004_create_sessions.sqlUT\x05\x00\x01w\xbb\xd2jPK\x01\x02\x14\x03\x14\x00\x08\x00\x08\x00\x89\x01Q]R\xf0\\&\x1c\x02\x00\x00\xcb\x04\x00\x00,\x00	\x00\x00\x00\x00\x00\x00\x00\x00\x00\xa4\x81R\x05\x00\x00system_migrations/005_create_rate_limits.sqlUT\x05\x00\x01c\xbd\xd2jPK\x05\x06\x00\x00\x00\x00\x06\x00\x06\x00'\x02\x00\x00\xd1\x07\x00\x00\x00\x00"
 		fs.Register(data)
 	}
 	
\ No newline at end of file
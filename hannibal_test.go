@@ -4,10 +4,13 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime/multipart"
 	"net"
 	"net/http"
 	"net/http/cookiejar"
@@ -22,6 +25,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/jackc/pgx/v4"
 	"github.com/otiai10/copy"
 	"github.com/stretchr/testify/assert"
@@ -932,6 +936,40 @@ func TestPasswordDigest(t *testing.T) {
 	require.EqualValues(t, http.StatusBadRequest, response.StatusCode)
 }
 
+func TestPasswordDigestRehash(t *testing.T) {
+	t.Parallel()
+
+	hi, cleanup := runHannibalServe(t, filepath.Join("testdata", "testproject"))
+	defer cleanup()
+
+	apiClient := newAPIClient(t, hi.httpAddr)
+
+	response := apiClient.postJSONString(t, "/api/user/register", `{"username": "jack", "password": "secret"}`)
+	require.EqualValues(t, http.StatusOK, response.StatusCode)
+
+	response = apiClient.postJSONString(t, "/api/user/login_rehash", `{"username": "jack", "password": "wrong"}`)
+	require.EqualValues(t, http.StatusBadRequest, response.StatusCode)
+
+	// The bcrypt digest from registration is replaced with an argon2id digest.
+	response = apiClient.postJSONString(t, "/api/user/login_rehash", `{"username": "jack", "password": "secret"}`)
+	require.EqualValues(t, http.StatusOK, response.StatusCode)
+	var responseData map[string]interface{}
+	err := json.Unmarshal(readResponseBody(t, response), &responseData)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"rehashed": true, "algorithm": "argon2id"}, responseData)
+
+	response = apiClient.postJSONString(t, "/api/user/login_rehash", `{"username": "jack", "password": "secret"}`)
+	require.EqualValues(t, http.StatusOK, response.StatusCode)
+	responseData = nil
+	err = json.Unmarshal(readResponseBody(t, response), &responseData)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"rehashed": false, "algorithm": nil}, responseData)
+
+	// The argon2id digest is detected by routes configured for bcrypt.
+	response = apiClient.postJSONString(t, "/api/user/login", `{"username": "jack", "password": "secret"}`)
+	require.EqualValues(t, http.StatusOK, response.StatusCode)
+}
+
 func TestHTTPResponseHeaders(t *testing.T) {
 	t.Parallel()
 
@@ -1044,6 +1082,155 @@ func TestReverseProxyCookieSession(t *testing.T) {
 	assert.Equal(t, map[string]interface{}{"foo": "bar"}, responseData)
 }
 
+func TestDatabaseSessionStore(t *testing.T) {
+	t.Parallel()
+
+	hi, cleanup := runHannibalServe(t, filepath.Join("testdata", "session_project"))
+	defer cleanup()
+	externalHTTPServer.ensureStarted(t)
+
+	getSession := func(t *testing.T, b *browser) interface{} {
+		response := b.get(t, "/cookie_session")
+		require.EqualValues(t, http.StatusOK, response.StatusCode)
+		var responseData map[string]interface{}
+		err := json.Unmarshal(readResponseBody(t, response), &responseData)
+		require.NoError(t, err)
+		return responseData["session"]
+	}
+
+	jack := newBrowser(t, hi.httpAddr)
+	response := jack.postJSONString(t, "/cookie_session", `{"user_id": 1, "name": "Jack"}`)
+	require.EqualValues(t, http.StatusOK, response.StatusCode)
+	assert.Contains(t, response.Header.Get("Set-Cookie"), "SameSite=Lax")
+	assert.Equal(t, map[string]interface{}{"user_id": float64(1), "name": "Jack"}, getSession(t, jack))
+
+	// The cookie only contains the session token.
+	serverURL, err := url.Parse(fmt.Sprintf("http://%s/", hi.httpAddr))
+	require.NoError(t, err)
+	cookies := jack.client.Jar.Cookies(serverURL)
+	require.Len(t, cookies, 1)
+	assert.Equal(t, "app-session", cookies[0].Name)
+	assert.Len(t, cookies[0].Value, 43)
+
+	// The reverse proxy reads and writes the session in the database.
+	response = jack.get(t, "/reverse_proxy/cookie_session")
+	require.EqualValues(t, http.StatusOK, response.StatusCode)
+	var responseData map[string]interface{}
+	err = json.Unmarshal(readResponseBody(t, response), &responseData)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"user_id": float64(1), "name": "Jack"}, responseData)
+
+	response = jack.postJSONString(t, "/reverse_proxy/cookie_session", `{"user_id": 1, "name": "Jack", "theme": "dark"}`)
+	require.EqualValues(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, map[string]interface{}{"user_id": float64(1), "name": "Jack", "theme": "dark"}, getSession(t, jack))
+
+	jackPhone := newBrowser(t, hi.httpAddr)
+	response = jackPhone.postJSONString(t, "/cookie_session", `{"user_id": 1}`)
+	require.EqualValues(t, http.StatusOK, response.StatusCode)
+
+	john := newBrowser(t, hi.httpAddr)
+	response = john.postJSONString(t, "/cookie_session", `{"user_id": 2}`)
+	require.EqualValues(t, http.StatusOK, response.StatusCode)
+
+	// All sessions of a user can be ended by a function.
+	response = john.postJSONString(t, "/invalidate_sessions", `{"user_id": "1"}`)
+	require.EqualValues(t, http.StatusOK, response.StatusCode)
+	responseData = nil
+	err = json.Unmarshal(readResponseBody(t, response), &responseData)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"count": float64(2)}, responseData)
+
+	assert.Nil(t, getSession(t, jack))
+	assert.Nil(t, getSession(t, jackPhone))
+	assert.Equal(t, map[string]interface{}{"user_id": float64(2)}, getSession(t, john))
+
+	// Setting the session to null deletes it.
+	req, err := http.NewRequest("DELETE", fmt.Sprintf("http://%s/cookie_session", hi.httpAddr), nil)
+	require.NoError(t, err)
+	response, err = john.client.Do(req)
+	require.NoError(t, err)
+	require.EqualValues(t, http.StatusOK, response.StatusCode)
+	assert.Nil(t, getSession(t, john))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := pgx.Connect(ctx, hi.databaseDSN)
+	require.NoError(t, err)
+	defer conn.Close(ctx)
+
+	var n int
+	err = conn.QueryRow(ctx, "select count(*) from hannibal_system.sessions").Scan(&n)
+	require.NoError(t, err)
+	assert.EqualValues(t, 0, n)
+}
+
+func TestDBIdentity(t *testing.T) {
+	t.Parallel()
+
+	hi, cleanup := runHannibalServe(t, filepath.Join("testdata", "rls_project"))
+	defer cleanup()
+
+	getJSON := func(t *testing.T, b *browser, path string) interface{} {
+		response := b.get(t, path)
+		require.EqualValues(t, http.StatusOK, response.StatusCode)
+		var responseData interface{}
+		err := json.Unmarshal(readResponseBody(t, response), &responseData)
+		require.NoError(t, err)
+		return responseData
+	}
+
+	// Requests without an identity still use db-role.
+	anonymous := newBrowser(t, hi.httpAddr)
+	assert.Equal(t, "hannibal_test_rls_user", getJSON(t, anonymous, "/whoami").(map[string]interface{})["role"])
+	assert.Equal(t, []interface{}{}, getJSON(t, anonymous, "/notes"))
+
+	jack := newBrowser(t, hi.httpAddr)
+	response := jack.postJSONString(t, "/login", `{"user_id": 1}`)
+	require.EqualValues(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, map[string]interface{}{"role": "hannibal_test_rls_user", "user_id": "1"}, getJSON(t, jack, "/whoami"))
+	assert.Equal(t, []interface{}{"Jack note"}, getJSON(t, jack, "/notes"))
+
+	response = jack.postJSONString(t, "/notes", `{"body": "Another Jack note"}`)
+	require.EqualValues(t, http.StatusCreated, response.StatusCode)
+	assert.Equal(t, []interface{}{"Jack note", "Another Jack note"}, getJSON(t, jack, "/notes"))
+
+	john := newBrowser(t, hi.httpAddr)
+	response = john.postJSONString(t, "/login", `{"user_id": 2}`)
+	require.EqualValues(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, []interface{}{"John note"}, getJSON(t, john, "/notes"))
+
+	// Route db-role takes precedence over the global db-role.
+	assert.Equal(t, []interface{}{"Jack note", "John note", "Another Jack note"}, getJSON(t, john, "/admin/notes"))
+
+	// The role and settings do not leak to the next request on the connection.
+	assert.Equal(t, []interface{}{}, getJSON(t, anonymous, "/notes"))
+
+	// Stream functions use the identity.
+	response = jack.get(t, "/notes/stream")
+	require.EqualValues(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, `{"body":"Jack note"}
+{"body":"Another Jack note"}
+`, string(readResponseBody(t, response)))
+
+	response = anonymous.get(t, "/notes/stream")
+	require.EqualValues(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "", string(readResponseBody(t, response)))
+
+	// WebSocket message functions use the identity.
+	dialer := &websocket.Dialer{Jar: john.client.Jar}
+	conn, _, err := dialer.Dial(fmt.Sprintf("ws://%s/ws", hi.httpAddr), nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	err = conn.WriteJSON(map[string]interface{}{"type": "notes"})
+	require.NoError(t, err)
+	var message map[string]interface{}
+	err = conn.ReadJSON(&message)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"type": "notes", "notes": []interface{}{"John note"}}, message)
+}
+
 func TestReverseProxyCSRFProtection(t *testing.T) {
 	t.Parallel()
 
@@ -1096,3 +1283,1089 @@ func TestDeployExecRemote(t *testing.T) {
 	_, err = os.Stat(filepath.Join(hi.appPath, "current", "exec-remote.txt"))
 	require.NoError(t, err)
 }
+
+func TestStreamNDJSON(t *testing.T) {
+	t.Parallel()
+
+	hi, cleanup := runHannibalServe(t, filepath.Join("testdata", "testproject"))
+	defer cleanup()
+
+	apiClient := newAPIClient(t, hi.httpAddr)
+	response := apiClient.get(t, "/stream/ndjson?count=3")
+	require.EqualValues(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "application/x-ndjson", response.Header.Get("Content-Type"))
+	responseBody := string(readResponseBody(t, response))
+	assert.Equal(t, `{"n":1,"label":"number 1"}
+{"n":2,"label":"number 2"}
+{"n":3,"label":"number 3"}
+`, responseBody)
+}
+
+func TestStreamJSONArray(t *testing.T) {
+	t.Parallel()
+
+	hi, cleanup := runHannibalServe(t, filepath.Join("testdata", "testproject"))
+	defer cleanup()
+
+	apiClient := newAPIClient(t, hi.httpAddr)
+	response := apiClient.get(t, "/stream/json_array?count=2")
+	require.EqualValues(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "application/json", response.Header.Get("Content-Type"))
+	var responseData []interface{}
+	err := json.Unmarshal(readResponseBody(t, response), &responseData)
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"n": float64(1), "label": "number 1"},
+		map[string]interface{}{"n": float64(2), "label": "number 2"},
+	}, responseData)
+
+	response = apiClient.get(t, "/stream/json_array?count=0")
+	require.EqualValues(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "[]", string(readResponseBody(t, response)))
+}
+
+func TestStreamCSV(t *testing.T) {
+	t.Parallel()
+
+	hi, cleanup := runHannibalServe(t, filepath.Join("testdata", "testproject"))
+	defer cleanup()
+
+	apiClient := newAPIClient(t, hi.httpAddr)
+	response := apiClient.get(t, "/stream/csv?count=2")
+	require.EqualValues(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "text/csv", response.Header.Get("Content-Type"))
+	responseBody := string(readResponseBody(t, response))
+	assert.Equal(t, "n,label\n1,number 1\n2,number 2\n", responseBody)
+}
+
+func TestStreamFailsMidStream(t *testing.T) {
+	t.Parallel()
+
+	hi, cleanup := runHannibalServe(t, filepath.Join("testdata", "testproject"))
+	defer cleanup()
+
+	apiClient := newAPIClient(t, hi.httpAddr)
+	response := apiClient.get(t, "/stream/ndjson_failing?count=1000&fail_at=500")
+	defer response.Body.Close()
+	require.EqualValues(t, http.StatusOK, response.StatusCode)
+	responseBody, err := ioutil.ReadAll(response.Body)
+	require.Error(t, err)
+	assert.True(t, strings.HasPrefix(string(responseBody), `{"n":1,"label":"number 1"}`+"\n"))
+	assert.NotContains(t, string(responseBody), `"n":500,`)
+}
+
+func TestErrorResponses(t *testing.T) {
+	t.Parallel()
+
+	hi, cleanup := runHannibalServe(t, filepath.Join("testdata", "testproject"))
+	defer cleanup()
+
+	apiClient := newAPIClient(t, hi.httpAddr)
+
+	response := apiClient.get(t, "/error_responses/unique_violation")
+	require.EqualValues(t, http.StatusConflict, response.StatusCode)
+	assert.Equal(t, "application/json", response.Header.Get("Content-Type"))
+	var responseData map[string]interface{}
+	err := json.Unmarshal(readResponseBody(t, response), &responseData)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"code":           "23505",
+		"message":        "name already taken",
+		"constraintName": "todos_name_key",
+	}, responseData)
+
+	response = apiClient.get(t, "/error_responses/not_found")
+	require.EqualValues(t, http.StatusNotFound, response.StatusCode)
+	assert.Contains(t, string(readResponseBody(t, response)), "todo not found")
+
+	response = apiClient.get(t, "/error_responses/custom_code")
+	require.EqualValues(t, http.StatusPaymentRequired, response.StatusCode)
+	assert.Contains(t, string(readResponseBody(t, response)), "payment required")
+
+	response = apiClient.get(t, "/error_responses/unmapped")
+	require.EqualValues(t, http.StatusInternalServerError, response.StatusCode)
+	assert.NotContains(t, string(readResponseBody(t, response)), "unmapped failure")
+}
+
+func TestBinaryResponse(t *testing.T) {
+	t.Parallel()
+
+	hi, cleanup := runHannibalServe(t, filepath.Join("testdata", "testproject"))
+	defer cleanup()
+
+	apiClient := newAPIClient(t, hi.httpAddr)
+	response := apiClient.get(t, "/attachment")
+	require.EqualValues(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "application/pdf", response.Header.Get("Content-Type"))
+	assert.Equal(t, `attachment; filename=report.pdf`, response.Header.Get("Content-Disposition"))
+	assert.Equal(t, "10", response.Header.Get("Content-Length"))
+	etag := response.Header.Get("ETag")
+	assert.NotEmpty(t, etag)
+	assert.Equal(t, "0123456789", string(readResponseBody(t, response)))
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s/attachment", hi.httpAddr), nil)
+	require.NoError(t, err)
+	req.Header.Set("Range", "bytes=2-4")
+	req.Header.Set("If-Range", etag)
+	response, err = apiClient.client.Do(req)
+	require.NoError(t, err)
+	require.EqualValues(t, http.StatusPartialContent, response.StatusCode)
+	assert.Equal(t, "bytes 2-4/10", response.Header.Get("Content-Range"))
+	assert.Equal(t, "234", string(readResponseBody(t, response)))
+
+	req.Header.Set("If-Range", `"stale"`)
+	response, err = apiClient.client.Do(req)
+	require.NoError(t, err)
+	require.EqualValues(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "0123456789", string(readResponseBody(t, response)))
+}
+
+func TestTextResponse(t *testing.T) {
+	t.Parallel()
+
+	hi, cleanup := runHannibalServe(t, filepath.Join("testdata", "testproject"))
+	defer cleanup()
+
+	apiClient := newAPIClient(t, hi.httpAddr)
+	response := apiClient.get(t, "/text")
+	require.EqualValues(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "text/plain; charset=utf-8", response.Header.Get("Content-Type"))
+	assert.Equal(t, "Hello, text!", string(readResponseBody(t, response)))
+}
+
+func TestTransaction(t *testing.T) {
+	t.Parallel()
+
+	hi, cleanup := runHannibalServe(t, filepath.Join("testdata", "testproject"))
+	defer cleanup()
+
+	apiClient := newAPIClient(t, hi.httpAddr)
+
+	response := apiClient.get(t, "/transaction/retry")
+	require.EqualValues(t, http.StatusOK, response.StatusCode)
+	var responseData map[string]interface{}
+	err := json.Unmarshal(readResponseBody(t, response), &responseData)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"attempt": float64(2), "isolation": "serializable"}, responseData)
+
+	response = apiClient.postJSONString(t, "/transaction/read_only", `{}`)
+	require.EqualValues(t, http.StatusInternalServerError, response.StatusCode)
+
+	response = apiClient.get(t, "/transaction/settings")
+	require.EqualValues(t, http.StatusOK, response.StatusCode)
+	responseData = nil
+	err = json.Unmarshal(readResponseBody(t, response), &responseData)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"timeZone": "America/Chicago", "statementTimeout": "2s", "lockTimeout": "500ms"}, responseData)
+}
+
+func TestRequestArg(t *testing.T) {
+	t.Parallel()
+
+	hi, cleanup := runHannibalServe(t, filepath.Join("testdata", "testproject"))
+	defer cleanup()
+
+	apiClient := newAPIClient(t, hi.httpAddr)
+	req, err := http.NewRequest("PUT", fmt.Sprintf("http://%s/request_arg", hi.httpAddr), nil)
+	require.NoError(t, err)
+	req.Header.Set("User-Agent", "hannibal-test")
+	req.Header.Set("Authorization", "secret")
+	response, err := apiClient.client.Do(req)
+	require.NoError(t, err)
+	require.EqualValues(t, http.StatusOK, response.StatusCode)
+	var responseData map[string]interface{}
+	err = json.Unmarshal(readResponseBody(t, response), &responseData)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"method":        "PUT",
+		"path":          "/request_arg",
+		"hasRequestID":  true,
+		"userAgent":     "hannibal-test",
+		"authorization": nil,
+		"remoteIP":      "127.0.0.1",
+	}, responseData)
+}
+
+// readSSEEvent reads the next event from r. Comments are skipped.
+func readSSEEvent(t *testing.T, r *bufio.Reader) string {
+	var lines []string
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		if line == "\n" {
+			if len(lines) > 0 {
+				return strings.Join(lines, "")
+			}
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+}
+
+func TestSSE(t *testing.T) {
+	t.Parallel()
+
+	hi, cleanup := runHannibalServe(t, filepath.Join("testdata", "testproject"))
+	defer cleanup()
+
+	apiClient := newAPIClient(t, hi.httpAddr)
+	response := apiClient.get(t, "/sse/static")
+	require.EqualValues(t, http.StatusOK, response.StatusCode)
+	defer response.Body.Close()
+	assert.Equal(t, "text/event-stream", response.Header.Get("Content-Type"))
+	eventReader := bufio.NewReader(response.Body)
+
+	notifyResponse := apiClient.postJSONString(t, "/sse/notify", `{"channel": "sse_static", "payload": "hello"}`)
+	require.EqualValues(t, http.StatusNoContent, notifyResponse.StatusCode)
+	readResponseBody(t, notifyResponse)
+
+	notifyResponse = apiClient.postJSONString(t, "/sse/notify", `{"channel": "sse_static", "payload": "line 1\nline 2"}`)
+	require.EqualValues(t, http.StatusNoContent, notifyResponse.StatusCode)
+	readResponseBody(t, notifyResponse)
+
+	assert.Equal(t, "event: sse_static\ndata: hello\n", readSSEEvent(t, eventReader))
+	assert.Equal(t, "event: sse_static\ndata: line 1\ndata: line 2\n", readSSEEvent(t, eventReader))
+}
+
+func TestSSEChannelsAndFilterFuncs(t *testing.T) {
+	t.Parallel()
+
+	hi, cleanup := runHannibalServe(t, filepath.Join("testdata", "testproject"))
+	defer cleanup()
+
+	apiClient := newAPIClient(t, hi.httpAddr)
+	response := apiClient.get(t, "/sse/room?room=secret")
+	require.EqualValues(t, http.StatusForbidden, response.StatusCode)
+	readResponseBody(t, response)
+
+	response = apiClient.get(t, "/sse/room?room=lobby")
+	require.EqualValues(t, http.StatusOK, response.StatusCode)
+	defer response.Body.Close()
+	eventReader := bufio.NewReader(response.Body)
+
+	for _, payload := range []string{"skip", "hello"} {
+		notifyResponse := apiClient.postJSONString(t, "/sse/notify", fmt.Sprintf(`{"channel": "sse_room_lobby", "payload": "%s"}`, payload))
+		require.EqualValues(t, http.StatusNoContent, notifyResponse.StatusCode)
+		readResponseBody(t, notifyResponse)
+	}
+
+	assert.Equal(t, "event: sse_room_lobby\ndata: HELLO\n", readSSEEvent(t, eventReader))
+}
+
+func TestWebSocket(t *testing.T) {
+	t.Parallel()
+
+	hi, cleanup := runHannibalServe(t, filepath.Join("testdata", "testproject"))
+	defer cleanup()
+
+	conn, response, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/ws", hi.httpAddr), nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.EqualValues(t, http.StatusSwitchingProtocols, response.StatusCode)
+
+	for i := 1; i <= 2; i++ {
+		err = conn.WriteJSON(map[string]interface{}{"type": "echo", "text": "hello"})
+		require.NoError(t, err)
+		var message map[string]interface{}
+		err = conn.ReadJSON(&message)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]interface{}{"type": "echo", "text": "hello", "count": float64(i)}, message)
+	}
+
+	err = conn.WriteJSON(map[string]interface{}{"type": "missing"})
+	require.NoError(t, err)
+	var message map[string]interface{}
+	err = conn.ReadJSON(&message)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"type": "error", "message": "unknown message type: missing"}, message)
+
+	err = conn.WriteJSON(map[string]interface{}{"type": "raise"})
+	require.NoError(t, err)
+	message = nil
+	err = conn.ReadJSON(&message)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"type": "error", "code": "P0001", "message": "boom"}, message)
+
+	err = conn.WriteJSON(map[string]interface{}{"type": "divide", "divisor": 0})
+	require.NoError(t, err)
+	message = nil
+	err = conn.ReadJSON(&message)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"type": "error", "message": "internal server error"}, message)
+
+	apiClient := newAPIClient(t, hi.httpAddr)
+	notifyResponse := apiClient.postJSONString(t, "/sse/notify", `{"channel": "ws_updates", "payload": "{\"id\": 1}"}`)
+	require.EqualValues(t, http.StatusNoContent, notifyResponse.StatusCode)
+	readResponseBody(t, notifyResponse)
+
+	message = nil
+	err = conn.ReadJSON(&message)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"type": "notification", "channel": "ws_updates", "payload": map[string]interface{}{"id": float64(1)}}, message)
+}
+
+func TestWebSocketRequireSession(t *testing.T) {
+	t.Parallel()
+
+	hi, cleanup := runHannibalServe(t, filepath.Join("testdata", "testproject"))
+	defer cleanup()
+
+	wsURL := fmt.Sprintf("ws://%s/ws/session", hi.httpAddr)
+
+	_, response, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	require.Error(t, err)
+	require.EqualValues(t, http.StatusUnauthorized, response.StatusCode)
+
+	browser := newBrowser(t, hi.httpAddr)
+	response = browser.get(t, "/hello")
+	require.EqualValues(t, http.StatusOK, response.StatusCode)
+	readResponseBody(t, response)
+
+	dialer := &websocket.Dialer{Jar: browser.client.Jar}
+	conn, _, err := dialer.Dial(wsURL, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	err = conn.WriteJSON(map[string]interface{}{"type": "whoami"})
+	require.NoError(t, err)
+	var message map[string]interface{}
+	err = conn.ReadJSON(&message)
+	require.NoError(t, err)
+	assert.Equal(t, "whoami", message["type"])
+	assert.NotNil(t, message["session"])
+}
+
+func TestContentNegotiation(t *testing.T) {
+	t.Parallel()
+
+	hi, cleanup := runHannibalServe(t, filepath.Join("testdata", "testproject"))
+	defer cleanup()
+
+	get := func(queryPath, accept string) *http.Response {
+		req, err := http.NewRequest("GET", fmt.Sprintf(`http://%s%s`, hi.httpAddr, queryPath), nil)
+		require.NoError(t, err)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		response, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return response
+	}
+
+	response := get("/negotiate/hello?name=Jack", "application/json")
+	require.EqualValues(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "application/json", response.Header.Get("Content-Type"))
+	assert.Equal(t, "Accept", response.Header.Get("Vary"))
+	var responseData map[string]interface{}
+	err := json.Unmarshal(readResponseBody(t, response), &responseData)
+	require.NoError(t, err)
+	assert.Equal(t, "Jack", responseData["name"])
+	assert.EqualValues(t, 1, responseData["visitCount"])
+
+	response = get("/negotiate/hello?name=Jack", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8")
+	require.EqualValues(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "text/html", response.Header.Get("Content-Type"))
+	assert.Contains(t, string(readResponseBody(t, response)), "Hello, Jack!")
+
+	response = get("/negotiate/api_hello?name=Jack", "text/html")
+	require.EqualValues(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "text/html", response.Header.Get("Content-Type"))
+	assert.Contains(t, string(readResponseBody(t, response)), "Hello, Jack!")
+
+	response = get("/negotiate/api_hello?name=Jack", "*/*")
+	require.EqualValues(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "application/json", response.Header.Get("Content-Type"))
+	assert.JSONEq(t, `{"name": "Jack"}`, string(readResponseBody(t, response)))
+}
+
+func TestLayout(t *testing.T) {
+	t.Parallel()
+
+	hi, cleanup := runHannibalServe(t, filepath.Join("testdata", "testproject"))
+	defer cleanup()
+
+	get := func(queryPath string, headers map[string]string) string {
+		req, err := http.NewRequest("GET", fmt.Sprintf(`http://%s%s`, hi.httpAddr, queryPath), nil)
+		require.NoError(t, err)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		response, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.EqualValues(t, http.StatusOK, response.StatusCode)
+		return string(readResponseBody(t, response))
+	}
+
+	responseBody := get("/layout", nil)
+	assert.Contains(t, responseBody, "<header>Items</header>")
+	assert.Contains(t, responseBody, "<h1>Items</h1>")
+	assert.Contains(t, responseBody, "<ul><li>a</li><li>b</li></ul>")
+
+	responseBody = get("/layout?layout=none", nil)
+	assert.NotContains(t, responseBody, "<header>")
+	assert.Contains(t, responseBody, "<h1>Items</h1>")
+
+	responseBody = get("/layout", map[string]string{"HX-Request": "true"})
+	assert.NotContains(t, responseBody, "<header>")
+	assert.Contains(t, responseBody, "<h1>Items</h1>")
+
+	responseBody = get("/layout", map[string]string{"HX-Request": "true", "HX-Boosted": "true"})
+	assert.Contains(t, responseBody, "<header>Items</header>")
+
+	responseBody = get("/layout?block=layout_page_items", nil)
+	assert.Equal(t, "<ul><li>a</li><li>b</li></ul>", responseBody)
+}
+
+func TestRedirectAndFlash(t *testing.T) {
+	t.Parallel()
+
+	hi, cleanup := runHannibalServe(t, filepath.Join("testdata", "testproject"))
+	defer cleanup()
+
+	browser := newBrowser(t, hi.httpAddr)
+	browser.client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	response := browser.post(t, "/flash/save", "application/x-www-form-urlencoded", []byte("redirect=/flash/show"))
+	require.EqualValues(t, http.StatusSeeOther, response.StatusCode)
+	assert.Equal(t, "/flash/show", response.Header.Get("Location"))
+	readResponseBody(t, response)
+
+	response = browser.get(t, "/flash/show")
+	require.EqualValues(t, http.StatusOK, response.StatusCode)
+	assert.Contains(t, string(readResponseBody(t, response)), `<p class="flash">Saved!</p>`)
+
+	// The flash message is only shown once.
+	response = browser.get(t, "/flash/show")
+	require.EqualValues(t, http.StatusOK, response.StatusCode)
+	responseBody := string(readResponseBody(t, response))
+	assert.Contains(t, responseBody, "Flash page")
+	assert.NotContains(t, responseBody, "Saved!")
+
+	response = browser.post(t, "/flash/save", "application/x-www-form-urlencoded", []byte("redirect=//example.com"))
+	require.EqualValues(t, http.StatusInternalServerError, response.StatusCode)
+	for _, cookie := range response.Cookies() {
+		assert.NotEqual(t, "hannibal-flash", cookie.Name)
+	}
+	readResponseBody(t, response)
+}
+
+func TestTypedParams(t *testing.T) {
+	t.Parallel()
+
+	hi, cleanup := runHannibalServe(t, filepath.Join("testdata", "testproject"))
+	defer cleanup()
+
+	apiClient := newAPIClient(t, hi.httpAddr)
+	response := apiClient.postJSONString(t, "/api/typed_params", `{"date": "2021-03-04", "time": "13:45", "at": "2021-03-04T13:45", "ratio": "0.25", "priority": "high"}`)
+	require.EqualValues(t, http.StatusOK, response.StatusCode)
+	var responseData map[string]interface{}
+	err := json.Unmarshal(readResponseBody(t, response), &responseData)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"date":     "2021-03-04",
+		"time":     "13:45:00",
+		"at":       "2021-03-04T19:45:00",
+		"ratio":    0.25,
+		"priority": "high",
+	}, responseData)
+
+	response = apiClient.postJSONString(t, "/api/typed_params", `{"date": "tomorrow", "time": "noon", "at": "now", "ratio": "half", "priority": "medium"}`)
+	require.EqualValues(t, http.StatusOK, response.StatusCode)
+	responseData = nil
+	err = json.Unmarshal(readResponseBody(t, response), &responseData)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"errors": map[string]interface{}{
+			"date":     "not a date",
+			"time":     "not a time",
+			"at":       "not a timestamp",
+			"ratio":    "not a number",
+			"priority": "not one of low, high",
+		},
+	}, responseData)
+}
+
+func TestParamConstraints(t *testing.T) {
+	t.Parallel()
+
+	hi, cleanup := runHannibalServe(t, filepath.Join("testdata", "testproject"))
+	defer cleanup()
+
+	apiClient := newAPIClient(t, hi.httpAddr)
+	response := apiClient.postJSONString(t, "/api/param_constraints", `{"username": "jack", "age": 30, "password": "secret123", "passwordConfirmation": "secret123", "tags": ["a"]}`)
+	require.EqualValues(t, http.StatusOK, response.StatusCode)
+	var responseData map[string]interface{}
+	err := json.Unmarshal(readResponseBody(t, response), &responseData)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"errors": nil, "errorCodes": nil}, responseData)
+
+	response = apiClient.postJSONString(t, "/api/param_constraints", `{"username": "Jack!", "age": 12, "password": "secret123", "passwordConfirmation": "secret", "tags": ["a", "b", "c"]}`)
+	require.EqualValues(t, http.StatusOK, response.StatusCode)
+	responseData = nil
+	err = json.Unmarshal(readResponseBody(t, response), &responseData)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"errors": map[string]interface{}{
+			"username":             "does not match pattern",
+			"age":                  "must be at least 13",
+			"passwordConfirmation": "does not match password",
+			"tags":                 "must have at most 2 elements",
+		},
+		"errorCodes": map[string]interface{}{
+			"username":             "pattern",
+			"age":                  "min",
+			"passwordConfirmation": "equals_param",
+			"tags":                 "max_items",
+		},
+	}, responseData)
+}
+
+func TestSchemas(t *testing.T) {
+	t.Parallel()
+
+	hi, cleanup := runHannibalServe(t, filepath.Join("testdata", "testproject"))
+	defer cleanup()
+
+	apiClient := newAPIClient(t, hi.httpAddr)
+	response := apiClient.postJSONString(t, "/api/schemas", `{"name": "line", "points": [{"x": "1", "y": 2}, {"x": 3}], "ignored": true}`)
+	require.EqualValues(t, http.StatusOK, response.StatusCode)
+	var responseData map[string]interface{}
+	err := json.Unmarshal(readResponseBody(t, response), &responseData)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"name": "line",
+		"__errors__": map[string]interface{}{
+			"points": "Element 1: y: missing",
+		},
+		"__error_codes__": map[string]interface{}{
+			"points": "invalid",
+		},
+	}, responseData)
+
+	response = apiClient.postJSONString(t, "/api/schemas", `{"name": "line", "points": [{"x": "1", "y": 2}]}`)
+	require.EqualValues(t, http.StatusOK, response.StatusCode)
+	responseData = nil
+	err = json.Unmarshal(readResponseBody(t, response), &responseData)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"name":   "line",
+		"points": []interface{}{map[string]interface{}{"x": float64(1), "y": float64(2)}},
+	}, responseData)
+}
+
+func TestNestedFormArgs(t *testing.T) {
+	t.Parallel()
+
+	hi, cleanup := runHannibalServe(t, filepath.Join("testdata", "testproject"))
+	defer cleanup()
+
+	apiClient := newAPIClient(t, hi.httpAddr)
+
+	form := url.Values{}
+	form.Add("tags", "a")
+	form.Add("tags", "b")
+	form.Add("address[city]", "Dallas")
+	form.Add("address[state]", "TX")
+	form.Add("items[0][name]", "foo")
+	form.Add("items[0][qty]", "2")
+	form.Add("items[1][name]", "bar")
+	form.Add("items[1][qty]", "3")
+	response := apiClient.post(t, "/api/nested_form_args", "application/x-www-form-urlencoded", []byte(form.Encode()))
+	require.EqualValues(t, http.StatusOK, response.StatusCode)
+	var responseData map[string]interface{}
+	err := json.Unmarshal(readResponseBody(t, response), &responseData)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"tags":    []interface{}{"a", "b"},
+		"address": map[string]interface{}{"city": "Dallas", "state": "TX"},
+		"items": []interface{}{
+			map[string]interface{}{"name": "foo", "qty": float64(2)},
+			map[string]interface{}{"name": "bar", "qty": float64(3)},
+		},
+	}, responseData)
+
+	form = url.Values{}
+	form.Add("tags", "a")
+	response = apiClient.post(t, "/api/nested_form_args", "application/x-www-form-urlencoded", []byte(form.Encode()))
+	require.EqualValues(t, http.StatusOK, response.StatusCode)
+	responseData = nil
+	err = json.Unmarshal(readResponseBody(t, response), &responseData)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"tags":    []interface{}{"a"},
+		"address": nil,
+		"items":   nil,
+	}, responseData)
+}
+
+func TestFileUploadStorage(t *testing.T) {
+	t.Parallel()
+
+	hi, cleanup := runHannibalServe(t, filepath.Join("testdata", "testproject"))
+	defer cleanup()
+
+	apiClient := newAPIClient(t, hi.httpAddr)
+
+	pngData := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 100)...)
+	postFiles := func(files map[string][]byte) map[string]interface{} {
+		body := &bytes.Buffer{}
+		mw := multipart.NewWriter(body)
+		for name, data := range files {
+			fw, err := mw.CreateFormFile(name, name+".dat")
+			require.NoError(t, err)
+			_, err = fw.Write(data)
+			require.NoError(t, err)
+		}
+		require.NoError(t, mw.Close())
+
+		response := apiClient.post(t, "/api/uploads", mw.FormDataContentType(), body.Bytes())
+		require.EqualValues(t, http.StatusOK, response.StatusCode)
+		var responseData map[string]interface{}
+		err := json.Unmarshal(readResponseBody(t, response), &responseData)
+		require.NoError(t, err)
+		return responseData
+	}
+
+	responseData := postFiles(map[string][]byte{
+		"document": []byte("hello world"),
+		"avatar":   pngData,
+	})
+	assert.Equal(t, "hello world", responseData["document_body"])
+	document := responseData["document"].(map[string]interface{})
+	assert.Equal(t, "document.dat", document["filename"])
+	assert.EqualValues(t, 11, document["size"])
+	assert.Equal(t, "text/plain", document["content_type"])
+
+	digest := sha256.Sum256(pngData)
+	hash := hex.EncodeToString(digest[:])
+	assert.Equal(t, map[string]interface{}{
+		"filename":     "avatar.dat",
+		"size":         float64(len(pngData)),
+		"content_type": "image/png",
+		"hash":         hash,
+	}, responseData["avatar"])
+	storedData, err := ioutil.ReadFile(filepath.Join(hi.appPath, "uploads", hash[:2], hash))
+	require.NoError(t, err)
+	assert.Equal(t, pngData, storedData)
+
+	responseData = postFiles(map[string][]byte{
+		"document": bytes.Repeat([]byte("x"), 2000),
+		"avatar":   []byte("not an image"),
+	})
+	assert.Equal(t, map[string]interface{}{
+		"errors": map[string]interface{}{
+			"document": "max_size",
+			"avatar":   "accept",
+		},
+	}, responseData)
+}
+
+func TestFileUploadLargeObjectsUnlinkedOnBadRequest(t *testing.T) {
+	t.Parallel()
+
+	hi, cleanup := runHannibalServe(t, filepath.Join("testdata", "testproject"))
+	defer cleanup()
+
+	apiClient := newAPIClient(t, hi.httpAddr)
+
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	fw, err := mw.CreateFormFile("document", "document.txt")
+	require.NoError(t, err)
+	_, err = fw.Write([]byte("hello world"))
+	require.NoError(t, err)
+	err = mw.WriteField("n", "abc")
+	require.NoError(t, err)
+	require.NoError(t, mw.Close())
+
+	response := apiClient.post(t, "/api/typed_uploads", mw.FormDataContentType(), body.Bytes())
+	require.EqualValues(t, http.StatusBadRequest, response.StatusCode)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := pgx.Connect(ctx, hi.databaseDSN)
+	require.NoError(t, err)
+	defer conn.Close(ctx)
+
+	var n int
+	err = conn.QueryRow(ctx, "select count(*) from pg_largeobject_metadata").Scan(&n)
+	require.NoError(t, err)
+	assert.EqualValues(t, 0, n)
+}
+
+func TestFileUploadWithCSRFTokenInForm(t *testing.T) {
+	t.Parallel()
+
+	hi, cleanup := runHannibalServe(t, filepath.Join("testdata", "testproject"))
+	defer cleanup()
+
+	browser := newBrowser(t, hi.httpAddr)
+	browser.getCSRFToken(t)
+
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	err := mw.WriteField("gorilla.csrf.Token", browser.csrfToken)
+	require.NoError(t, err)
+	fw, err := mw.CreateFormFile("document", "document.txt")
+	require.NoError(t, err)
+	_, err = fw.Write([]byte("hello world"))
+	require.NoError(t, err)
+	require.NoError(t, mw.Close())
+
+	response := browser.post(t, "/uploads", mw.FormDataContentType(), body.Bytes())
+	require.EqualValues(t, http.StatusOK, response.StatusCode)
+	var responseData map[string]interface{}
+	err = json.Unmarshal(readResponseBody(t, response), &responseData)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", responseData["document_body"])
+
+	// The CSRF check still applies to multipart forms.
+	body = &bytes.Buffer{}
+	mw = multipart.NewWriter(body)
+	fw, err = mw.CreateFormFile("document", "document.txt")
+	require.NoError(t, err)
+	_, err = fw.Write([]byte("hello world"))
+	require.NoError(t, err)
+	require.NoError(t, mw.Close())
+
+	response = browser.post(t, "/uploads", mw.FormDataContentType(), body.Bytes())
+	assert.EqualValues(t, http.StatusForbidden, response.StatusCode)
+}
+
+func TestRequestParamSources(t *testing.T) {
+	t.Parallel()
+
+	hi, cleanup := runHannibalServe(t, filepath.Join("testdata", "testproject"))
+	defer cleanup()
+
+	apiClient := newAPIClient(t, hi.httpAddr)
+	req, err := http.NewRequest("POST", fmt.Sprintf("http://%s/api/sourced_params/42?q=search", hi.httpAddr), strings.NewReader(`{"id": 7, "q": "body", "tenantID": "body", "theme": "body"}`))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Tenant-Id", "acme")
+	req.AddCookie(&http.Cookie{Name: "theme", Value: "dark"})
+	response, err := apiClient.client.Do(req)
+	require.NoError(t, err)
+	require.EqualValues(t, http.StatusOK, response.StatusCode)
+	var responseData map[string]interface{}
+	err = json.Unmarshal(readResponseBody(t, response), &responseData)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"id":       float64(42),
+		"q":        "search",
+		"tenantID": "acme",
+		"theme":    "dark",
+	}, responseData)
+
+	response = apiClient.postJSONString(t, "/api/sourced_params/42", `{"tenantID": "acme"}`)
+	require.EqualValues(t, http.StatusOK, response.StatusCode)
+	responseData = nil
+	err = json.Unmarshal(readResponseBody(t, response), &responseData)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"id":    float64(42),
+		"q":     nil,
+		"theme": nil,
+		"__errors__": map[string]interface{}{
+			"tenantID": "missing",
+		},
+		"__error_codes__": map[string]interface{}{
+			"tenantID": "missing",
+		},
+	}, responseData)
+}
+
+func TestTypedInArgs(t *testing.T) {
+	t.Parallel()
+
+	hi, cleanup := runHannibalServe(t, filepath.Join("testdata", "testproject"))
+	defer cleanup()
+
+	apiClient := newAPIClient(t, hi.httpAddr)
+	response := apiClient.postJSONString(t, "/api/typed_args/42", `{"title": "  Buy milk ", "due": "2021-03-04", "tags": ["a", "b"]}`)
+	require.EqualValues(t, http.StatusOK, response.StatusCode)
+	var responseData map[string]interface{}
+	err := json.Unmarshal(readResponseBody(t, response), &responseData)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"todo_id": float64(42),
+		"title":   "Buy milk",
+		"due":     "2021-03-04",
+		"tags":    []interface{}{"a", "b"},
+	}, responseData)
+
+	response = apiClient.postJSONString(t, "/api/typed_args/abc", `{"due": "tomorrow"}`)
+	require.EqualValues(t, http.StatusBadRequest, response.StatusCode)
+	responseData = nil
+	err = json.Unmarshal(readResponseBody(t, response), &responseData)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"errors": map[string]interface{}{
+			"todo_id": "not a number",
+			"title":   "missing",
+			"due":     "not a date",
+		},
+	}, responseData)
+
+	// A function with an args argument is still not called with unparsed input for a typed in argument.
+	response = apiClient.get(t, "/api/typed_args_with_args/42")
+	require.EqualValues(t, http.StatusOK, response.StatusCode)
+	responseData = nil
+	err = json.Unmarshal(readResponseBody(t, response), &responseData)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"todo_id": float64(42), "errors": nil}, responseData)
+
+	response = apiClient.get(t, "/api/typed_args_with_args/abc")
+	require.EqualValues(t, http.StatusBadRequest, response.StatusCode)
+	responseData = nil
+	err = json.Unmarshal(readResponseBody(t, response), &responseData)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"errors": map[string]interface{}{"todo_id": "not a number"}}, responseData)
+}
+
+func TestSchemaQualifiedAndOverloadedFuncs(t *testing.T) {
+	t.Parallel()
+
+	hi, cleanup := runHannibalServe(t, filepath.Join("testdata", "testproject"))
+	defer cleanup()
+
+	apiClient := newAPIClient(t, hi.httpAddr)
+	for _, tt := range []struct {
+		path     string
+		expected map[string]interface{}
+	}{
+		{path: "/api/lib_greeting?name=Jack", expected: map[string]interface{}{"greeting": "Hello, Jack!"}},
+		{path: "/api/overloaded_v1", expected: map[string]interface{}{"version": float64(1)}},
+		{path: "/api/overloaded_v2", expected: map[string]interface{}{"version": float64(2)}},
+	} {
+		response := apiClient.get(t, tt.path)
+		require.EqualValuesf(t, http.StatusOK, response.StatusCode, tt.path)
+		var responseData map[string]interface{}
+		err := json.Unmarshal(readResponseBody(t, response), &responseData)
+		require.NoErrorf(t, err, tt.path)
+		assert.Equalf(t, tt.expected, responseData, tt.path)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	t.Parallel()
+
+	hi, cleanup := runHannibalServe(t, filepath.Join("testdata", "testproject"))
+	defer cleanup()
+
+	apiClient := newAPIClient(t, hi.httpAddr)
+	for _, tt := range []struct {
+		desc            string
+		method          string
+		path            string
+		header          http.Header
+		username        string
+		password        string
+		status          int
+		wwwAuthenticate string
+		principal       interface{}
+	}{
+		{
+			desc:            "required without credentials",
+			path:            "/api/whoami",
+			status:          http.StatusUnauthorized,
+			wwwAuthenticate: `Bearer realm="testproject"`,
+		},
+		{
+			desc:            "required with invalid token",
+			path:            "/api/whoami",
+			header:          http.Header{"Authorization": {"Bearer wrong"}},
+			status:          http.StatusUnauthorized,
+			wwwAuthenticate: `Bearer realm="testproject", error="invalid_token"`,
+		},
+		{
+			desc:      "required with valid token",
+			path:      "/api/whoami",
+			header:    http.Header{"Authorization": {"Bearer secret-token"}},
+			status:    http.StatusOK,
+			principal: map[string]interface{}{"user_id": float64(1), "scheme": "bearer"},
+		},
+		{
+			desc:   "optional without credentials",
+			path:   "/api/whoami_optional",
+			status: http.StatusOK,
+		},
+		{
+			desc:            "optional with invalid token",
+			path:            "/api/whoami_optional",
+			header:          http.Header{"Authorization": {"Bearer wrong"}},
+			status:          http.StatusUnauthorized,
+			wwwAuthenticate: `Bearer error="invalid_token"`,
+		},
+		{
+			desc:      "post with valid token skips csrf protection",
+			method:    http.MethodPost,
+			path:      "/api/whoami_optional",
+			header:    http.Header{"Authorization": {"Bearer secret-token"}},
+			status:    http.StatusOK,
+			principal: map[string]interface{}{"user_id": float64(1), "scheme": "bearer"},
+		},
+		{
+			desc:   "post without credentials requires csrf token",
+			method: http.MethodPost,
+			path:   "/api/whoami_optional",
+			status: http.StatusForbidden,
+		},
+		{
+			desc:            "basic with invalid password",
+			path:            "/api/whoami_basic",
+			username:        "jack",
+			password:        "wrong",
+			status:          http.StatusUnauthorized,
+			wwwAuthenticate: `Basic realm="testproject", charset="UTF-8"`,
+		},
+		{
+			desc:      "basic with valid password",
+			path:      "/api/whoami_basic",
+			username:  "jack",
+			password:  "secret",
+			status:    http.StatusOK,
+			principal: map[string]interface{}{"user_id": float64(2), "scheme": "basic"},
+		},
+		{
+			desc:            "api key without key",
+			path:            "/api/whoami_key",
+			status:          http.StatusUnauthorized,
+			wwwAuthenticate: `APIKey header="X-Api-Key"`,
+		},
+		{
+			desc:      "api key with valid key",
+			path:      "/api/whoami_key",
+			header:    http.Header{"X-Api-Key": {"secret-token"}},
+			status:    http.StatusOK,
+			principal: map[string]interface{}{"user_id": float64(1), "scheme": "bearer"},
+		},
+	} {
+		method := tt.method
+		if method == "" {
+			method = http.MethodGet
+		}
+		req, err := http.NewRequest(method, fmt.Sprintf("http://%s%s", hi.httpAddr, tt.path), nil)
+		require.NoErrorf(t, err, tt.desc)
+		for k, v := range tt.header {
+			req.Header[k] = v
+		}
+		if tt.username != "" {
+			req.SetBasicAuth(tt.username, tt.password)
+		}
+
+		response, err := apiClient.client.Do(req)
+		require.NoErrorf(t, err, tt.desc)
+		body := readResponseBody(t, response)
+		require.EqualValuesf(t, tt.status, response.StatusCode, tt.desc)
+		assert.Equalf(t, tt.wwwAuthenticate, response.Header.Get("WWW-Authenticate"), tt.desc)
+
+		if tt.status == http.StatusOK {
+			var responseData map[string]interface{}
+			err = json.Unmarshal(body, &responseData)
+			require.NoErrorf(t, err, tt.desc)
+			assert.Equalf(t, map[string]interface{}{"principal": tt.principal}, responseData, tt.desc)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	t.Parallel()
+
+	hi, cleanup := runHannibalServe(t, filepath.Join("testdata", "testproject"))
+	defer cleanup()
+
+	for _, path := range []string{"/api/rate_limited", "/api/rate_limited_database"} {
+		b := newBrowser(t, hi.httpAddr)
+		for i, remaining := range []string{"1", "0"} {
+			response := b.get(t, path)
+			require.EqualValuesf(t, http.StatusOK, response.StatusCode, "%s %d", path, i)
+			assert.Equalf(t, "2", response.Header.Get("RateLimit-Limit"), "%s %d", path, i)
+			assert.Equalf(t, remaining, response.Header.Get("RateLimit-Remaining"), "%s %d", path, i)
+		}
+
+		response := b.get(t, path)
+		require.EqualValuesf(t, http.StatusTooManyRequests, response.StatusCode, path)
+		assert.Equalf(t, "1800", response.Header.Get("Retry-After"), path)
+		assert.Equalf(t, "0", response.Header.Get("RateLimit-Remaining"), path)
+		assert.Equalf(t, "3600", response.Header.Get("RateLimit-Reset"), path)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := pgx.Connect(ctx, hi.databaseDSN)
+	require.NoError(t, err)
+	defer conn.Close(ctx)
+
+	// Requests without a session are limited by client IP address.
+	var key string
+	err = conn.QueryRow(ctx, "select key from hannibal_system.rate_limits").Scan(&key)
+	require.NoError(t, err)
+	assert.Equal(t, "GET /api/rate_limited_database|ip:127.0.0.1", key)
+}
+
+func TestCORS(t *testing.T) {
+	t.Parallel()
+
+	hi, cleanup := runHannibalServe(t, filepath.Join("testdata", "testproject"))
+	defer cleanup()
+
+	apiClient := newAPIClient(t, hi.httpAddr)
+
+	preflight := func(t *testing.T, origin, method string) *http.Response {
+		req, err := http.NewRequest("OPTIONS", fmt.Sprintf("http://%s/api/cors_hello", hi.httpAddr), nil)
+		require.NoError(t, err)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", method)
+		req.Header.Set("Access-Control-Request-Headers", "Content-Type, X-CSRF-Token")
+		response, err := apiClient.client.Do(req)
+		require.NoError(t, err)
+		return response
+	}
+
+	for _, origin := range []string{"https://app.example.com", "https://staging.example.net"} {
+		response := preflight(t, origin, "POST")
+		require.EqualValuesf(t, http.StatusNoContent, response.StatusCode, origin)
+		assert.Equalf(t, origin, response.Header.Get("Access-Control-Allow-Origin"), origin)
+		assert.Equalf(t, "POST", response.Header.Get("Access-Control-Allow-Methods"), origin)
+		assert.Equalf(t, "Content-Type, X-CSRF-Token", response.Header.Get("Access-Control-Allow-Headers"), origin)
+		assert.Equalf(t, "true", response.Header.Get("Access-Control-Allow-Credentials"), origin)
+		assert.Equalf(t, "600", response.Header.Get("Access-Control-Max-Age"), origin)
+	}
+
+	// The preflight succeeds without allowing the request for origins and methods that are not allowed.
+	for _, tt := range []struct{ origin, method string }{
+		{origin: "https://evil.example.com", method: "POST"},
+		{origin: "https://app.example.com", method: "GET"},
+	} {
+		response := preflight(t, tt.origin, tt.method)
+		require.EqualValuesf(t, http.StatusNoContent, response.StatusCode, "%v", tt)
+		assert.Equalf(t, "", response.Header.Get("Access-Control-Allow-Origin"), "%v", tt)
+	}
+
+	// A CSRF failure can be read by the client.
+	req, err := http.NewRequest("POST", fmt.Sprintf("http://%s/api/cors_hello", hi.httpAddr), strings.NewReader(`{"name": "Jack"}`))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Origin", "https://app.example.com")
+	response, err := apiClient.client.Do(req)
+	require.NoError(t, err)
+	assert.EqualValues(t, http.StatusForbidden, response.StatusCode)
+	assert.Equal(t, "https://app.example.com", response.Header.Get("Access-Control-Allow-Origin"))
+
+	// Routes without cors do not allow other origins.
+	req, err = http.NewRequest("GET", fmt.Sprintf("http://%s/api/cors_hello?name=Jack", hi.httpAddr), nil)
+	require.NoError(t, err)
+	req.Header.Set("Origin", "https://app.example.com")
+	response, err = apiClient.client.Do(req)
+	require.NoError(t, err)
+	assert.EqualValues(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "", response.Header.Get("Access-Control-Allow-Origin"))
+}
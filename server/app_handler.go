@@ -1,27 +1,28 @@
 package server
 
 import (
-	"bytes"
 	"context"
-	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
-	"io"
+	"math"
 	"net/http"
 	"net/http/httputil"
+	"net/mail"
 	"net/url"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/gofrs/uuid"
 	"github.com/gorilla/csrf"
 	"github.com/jackc/hannibal/appconf"
-	"github.com/jackc/hannibal/current"
 	"github.com/jackc/hannibal/db"
 	"github.com/jackc/hannibal/srvman"
+	"github.com/jackc/pgx/v4"
 	"github.com/shopspring/decimal"
 )
 
@@ -56,6 +57,12 @@ func routeHasOneHandler(r appconf.Route) bool {
 	if r.ReverseProxy != "" {
 		count++
 	}
+	if r.SSE != nil {
+		count++
+	}
+	if r.WebSocket != nil {
+		count++
+	}
 	return count == 1
 }
 
@@ -78,81 +85,360 @@ func routeName(r appconf.Route) string {
 	return r.Path
 }
 
+// routePathAndMethod returns the path and method of r. method is empty if r matches every method.
+func routePathAndMethod(r appconf.Route) (path string, method string) {
+	switch {
+	case r.GetPath != "":
+		return r.GetPath, http.MethodGet
+	case r.PostPath != "":
+		return r.PostPath, http.MethodPost
+	case r.PutPath != "":
+		return r.PutPath, http.MethodPut
+	case r.PatchPath != "":
+		return r.PatchPath, http.MethodPatch
+	case r.DeletePath != "":
+		return r.DeletePath, http.MethodDelete
+	default:
+		return r.Path, ""
+	}
+}
+
 func NewAppHandler(ctx context.Context, dbconn db.DBConn, schema string, appConfig *appconf.Config, serviceGroup *srvman.Group, tmpl *template.Template, host *Host, publicPath string) (http.Handler, error) {
-	csrfFunc, err := makeCSRFFunc(ctx, dbconn, schema, appConfig.CSRFProtection, tmpl, host)
+	csrfRequestHeader := "X-CSRF-Token"
+	if appConfig.CSRFProtection != nil && appConfig.CSRFProtection.RequestHeader != "" {
+		csrfRequestHeader = appConfig.CSRFProtection.RequestHeader
+	}
+
+	// Route cors takes precedence over global cors. The policies are built before the CSRF middleware because allowed
+	// origins are trusted by it.
+	var globalCORSPolicy *CORSPolicy
+	var corsPolicies []*CORSPolicy
+	if appConfig.CORS != nil {
+		var err error
+		globalCORSPolicy, err = newCORSPolicyFromAppConfig(appConfig.CORS, csrfRequestHeader)
+		if err != nil {
+			return nil, err
+		}
+		corsPolicies = append(corsPolicies, globalCORSPolicy)
+	}
+
+	routeCORSPolicies := make([]*CORSPolicy, len(appConfig.Routes))
+	for i, r := range appConfig.Routes {
+		routeCORSPolicies[i] = globalCORSPolicy
+		if r.CORS != nil {
+			var err error
+			routeCORSPolicies[i], err = newCORSPolicyFromAppConfig(r.CORS, csrfRequestHeader)
+			if err != nil {
+				return nil, fmt.Errorf("route %s: %v", routeName(r), err)
+			}
+			corsPolicies = append(corsPolicies, routeCORSPolicies[i])
+		}
+	}
+
+	csrfFunc, err := makeCSRFFunc(ctx, dbconn, schema, appConfig.CSRFProtection, corsPolicies, tmpl, host)
 	if err != nil {
 		return nil, err
 	}
 
 	csrfWithPreserveBodyFunc := func(h http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			bodyBytes, err := io.ReadAll(r.Body)
+			// The CSRF token is read from the request header before the body. When it is present the body does not
+			// need to be preserved and uploads can be streamed.
+			if r.Header.Get(csrfRequestHeader) != "" {
+				csrfFunc(h).ServeHTTP(w, r)
+				return
+			}
+
+			body, err := newReplayableBody(r)
 			if err != nil {
 				// TODO - handle failure reading body
 				panic(err)
 			}
-			r.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+			defer body.Close()
+
+			r.Body = body.Reader()
 			csrfFunc(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				r.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+				// The CSRF check may have parsed a multipart form. Discard it so the handler can stream the body.
+				if r.MultipartForm != nil {
+					r.MultipartForm.RemoveAll()
+					r.MultipartForm = nil
+				}
+				r.Body = body.Reader()
 				h.ServeHTTP(w, r)
 			})).ServeHTTP(w, r)
 		})
 	}
 
+	// csrfWithMultipartFunc preserves multipart bodies for the handler. extractMultipartArgs streams them but the CSRF
+	// check parses the entire form when the token is in a form field instead of the request header.
+	csrfWithMultipartFunc := func(h http.Handler) http.Handler {
+		preserveBodyHandler := csrfWithPreserveBodyFunc(h)
+		csrfHandler := csrfFunc(h)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+				preserveBodyHandler.ServeHTTP(w, r)
+				return
+			}
+			csrfHandler.ServeHTTP(w, r)
+		})
+	}
+
+	globalErrorResponses, err := errorResponsesFromAppConfig(appConfig.ErrorResponses, tmpl)
+	if err != nil {
+		return nil, err
+	}
+
+	var globalAuthenticator *Authenticator
+	if appConfig.Authenticate != nil {
+		globalAuthenticator, err = newAuthenticatorFromAppConfig(ctx, dbconn, schema, appConfig.Authenticate)
+		if err != nil {
+			return nil, err
+		}
+		globalAuthenticator.Host = host
+	}
+
+	globalDBIdentity, err := newDBIdentityFromAppConfig(ctx, dbconn, schema, appConfig.DBRole, appConfig.IdentifyFunc)
+	if err != nil {
+		return nil, err
+	}
+
+	trustedProxies, err := parseTrustedProxies(appConfig.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	var globalRateLimiter *RateLimiter
+	if appConfig.RateLimit != nil {
+		globalRateLimiter, err = newRateLimiterFromAppConfig(ctx, dbconn, schema, "global", appConfig.RateLimit)
+		if err != nil {
+			return nil, err
+		}
+		globalRateLimiter.Host = host
+	}
+
+	sessions, err := newSessionStoreFromAppConfig(ctx, appConfig.Session)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := sessions.(*databaseSessionStore); ok {
+		host.startSessionSweeper()
+	}
+
 	router := chi.NewRouter()
-	for _, r := range appConfig.Routes {
+	router.Use(withClientIP(trustedProxies))
+	router.Use(withSessionStore(sessions))
+	corsPreflights := make(map[string]*corsPreflightHandler)
+	var corsPreflightPaths []string
+
+	for i, r := range appConfig.Routes {
 		if !routeHasOnePath(r) {
 			return nil, fmt.Errorf("route must have exactly one of path, get, post, put, patch, and delete")
 		}
 
 		if !routeHasOneHandler(r) {
-			return nil, fmt.Errorf("route %s: must have exactly one of func and reverse-proxy", routeName(r))
+			return nil, fmt.Errorf("route %s: must have exactly one of func, reverse-proxy, sse, and websocket", routeName(r))
+		}
+
+		if r.Stream != "" && r.Func == "" {
+			return nil, fmt.Errorf("route %s: stream requires func", routeName(r))
+		}
+
+		// These options are only implemented by the handler for functions that are not streamed.
+		if r.Stream != "" {
+			for _, o := range []struct {
+				name string
+				set  bool
+			}{
+				{"transaction", r.Transaction != nil},
+				{"digest-password", r.DigestPassword != nil},
+				{"check-password-digest", r.CheckPasswordDigest != nil},
+				{"content-negotiation", r.ContentNegotiation != nil},
+			} {
+				if o.set {
+					return nil, fmt.Errorf("route %s: %s is not supported with stream", routeName(r), o.name)
+				}
+			}
+		}
+
+		if r.Template != "" && (r.Func == "" || r.Stream != "") {
+			return nil, fmt.Errorf("route %s: template requires func", routeName(r))
+		}
+
+		if r.Layout != "" && (r.Func == "" || r.Stream != "") {
+			return nil, fmt.Errorf("route %s: layout requires func", routeName(r))
+		}
+
+		// Route db-role and identify-func take precedence over the global ones.
+		dbIdentity := globalDBIdentity
+		if r.DBRole != "" || r.IdentifyFunc != "" {
+			dbRole := appConfig.DBRole
+			if r.DBRole != "" {
+				dbRole = r.DBRole
+			}
+			identifyFunc := appConfig.IdentifyFunc
+			if r.IdentifyFunc != "" {
+				identifyFunc = r.IdentifyFunc
+			}
+			dbIdentity, err = newDBIdentityFromAppConfig(ctx, dbconn, schema, dbRole, identifyFunc)
+			if err != nil {
+				return nil, fmt.Errorf("route %s: %v", routeName(r), err)
+			}
 		}
 
 		var handler http.Handler
 		var preserveBody bool
 
-		if r.Func != "" {
-			inArgs, outArgs, err := getSQLFuncArgs(ctx, dbconn, schema, r.Func)
+		// Route error responses take precedence over global error responses.
+		errorResponses, err := errorResponsesFromAppConfig(r.ErrorResponses, tmpl)
+		if err != nil {
+			return nil, fmt.Errorf("route %s: %v", routeName(r), err)
+		}
+		errorResponses = append(errorResponses, globalErrorResponses...)
+
+		requestHeaders := append(append([]string{}, appConfig.RequestHeaders...), r.RequestHeaders...)
+
+		if r.Func != "" && r.Stream != "" {
+			callName, inArgs, _, err := getSQLFuncArgs(ctx, dbconn, schema, r.Func)
+			if err != nil {
+				return nil, fmt.Errorf("route %s: %v", routeName(r), err)
+			}
+
+			streamHandler, err := NewPGFuncStreamHandler(callName, r.Stream, inArgs)
+			if err != nil {
+				return nil, fmt.Errorf("route %s: failed to build stream handler for function %s: %v", routeName(r), r.Func, err)
+			}
+
+			streamHandler.Params, err = requestParamsFromAppConfig(r.Params, appConfig.Schemas)
+			if err != nil {
+				return nil, fmt.Errorf("route %s: %v", routeName(r), err)
+			}
+
+			streamHandler.ErrorResponses = errorResponses
+			streamHandler.RequestHeaders = requestHeaders
+			streamHandler.Host = host
+			handler = streamHandler
+		} else if r.Func != "" {
+			fn, err := introspectSQLFunc(ctx, dbconn, schema, r.Func)
 			if err != nil {
 				return nil, fmt.Errorf("route %s: %v", routeName(r), err)
 			}
 
-			pgFuncHandler, err := NewPGFuncHandler(r.Func, inArgs, outArgs)
+			inArgs, outArgs, err := fn.inOutArgs()
+			if err != nil {
+				return nil, fmt.Errorf("route %s: %v", routeName(r), err)
+			}
+
+			pgFuncHandler, err := NewPGFuncHandler(fn.CallName, inArgs, outArgs)
 			if err != nil {
 				return nil, fmt.Errorf("route %s: failed to build handler for function %s: %v", routeName(r), r.Func, err)
 			}
 
-			pgFuncHandler.Params = make([]*RequestParam, len(r.Params))
-			for i, qp := range r.Params {
-				var err error
-				pgFuncHandler.Params[i], err = requestParamFromAppConfig(qp)
-				if err != nil {
-					return nil, fmt.Errorf("route %s: failed to convert request param %s: %v", routeName(r), qp.Name, err)
-				}
+			pgFuncHandler.Params, err = requestParamsFromAppConfig(r.Params, appConfig.Schemas)
+			if err != nil {
+				return nil, fmt.Errorf("route %s: %v", routeName(r), err)
 			}
 
+			pgFuncHandler.InArgTypes = fn.inArgTypes()
+			pgFuncHandler.Params = addTypedInArgParams(pgFuncHandler.Params, pgFuncHandler.TypedInArgs, pgFuncHandler.InArgTypes)
+
 			if r.DigestPassword != nil {
+				hasher, err := newPasswordHasherFromAppConfig(r.DigestPassword.PasswordHash)
+				if err != nil {
+					return nil, fmt.Errorf("route %s: digest-password: %v", routeName(r), err)
+				}
+
 				pgFuncHandler.DigestPassword = &DigestPassword{
 					PasswordParam: r.DigestPassword.PasswordParam,
 					DigestParam:   r.DigestPassword.DigestParam,
+					Hasher:        hasher,
 				}
 			}
 
 			if r.CheckPasswordDigest != nil {
-				inArgs, _, err := getSQLFuncArgs(ctx, dbconn, schema, r.CheckPasswordDigest.GetPasswordDigestFunc)
+				callName, inArgs, _, err := getSQLFuncArgs(ctx, dbconn, schema, r.CheckPasswordDigest.GetPasswordDigestFunc)
 				if err != nil {
 					return nil, fmt.Errorf("route %s: %v", routeName(r), err)
 				}
 
-				pgFuncHandler.CheckPasswordDigest, err = newCheckPasswordDigest(r.CheckPasswordDigest.GetPasswordDigestFunc, inArgs)
+				hasher, err := newPasswordHasherFromAppConfig(r.CheckPasswordDigest.PasswordHash)
+				if err != nil {
+					return nil, fmt.Errorf("route %s: check-password-digest: %v", routeName(r), err)
+				}
+
+				pgFuncHandler.CheckPasswordDigest, err = newCheckPasswordDigest(callName, inArgs)
+				if err != nil {
+					return nil, fmt.Errorf("route %s: %v", routeName(r), err)
+				}
 				pgFuncHandler.CheckPasswordDigest.PasswordParam = r.CheckPasswordDigest.PasswordParam
 				pgFuncHandler.CheckPasswordDigest.ResultParam = r.CheckPasswordDigest.ResultParam
+				pgFuncHandler.CheckPasswordDigest.RehashParam = r.CheckPasswordDigest.RehashParam
+				pgFuncHandler.CheckPasswordDigest.Hasher = hasher
 			}
 
+			if r.Transaction != nil {
+				pgFuncHandler.Transaction, err = transactionFromAppConfig(r.Transaction)
+				if err != nil {
+					return nil, fmt.Errorf("route %s: %v", routeName(r), err)
+				}
+			}
+
+			pgFuncHandler.ContentNegotiation = appConfig.ContentNegotiation
+			if r.ContentNegotiation != nil {
+				pgFuncHandler.ContentNegotiation = *r.ContentNegotiation
+			}
+
+			if r.Template != "" {
+				if !pgFuncHandler.ContentNegotiation {
+					return nil, fmt.Errorf("route %s: template requires content-negotiation", routeName(r))
+				}
+				pgFuncHandler.Template = tmpl.Lookup(r.Template)
+				if pgFuncHandler.Template == nil {
+					return nil, fmt.Errorf("route %s: template not found: %s", routeName(r), r.Template)
+				}
+			}
+
+			if r.Layout != "" {
+				pgFuncHandler.Layout = tmpl.Lookup(r.Layout)
+				if pgFuncHandler.Layout == nil {
+					return nil, fmt.Errorf("route %s: layout not found: %s", routeName(r), r.Layout)
+				}
+			}
+
+			pgFuncHandler.ErrorResponses = errorResponses
+			pgFuncHandler.RequestHeaders = requestHeaders
 			pgFuncHandler.RootTemplate = tmpl
 			pgFuncHandler.Host = host
 			handler = pgFuncHandler
+		} else if r.SSE != nil {
+			sseHandler, err := newSSEHandlerFromAppConfig(ctx, dbconn, schema, r.SSE)
+			if err != nil {
+				return nil, fmt.Errorf("route %s: %v", routeName(r), err)
+			}
+
+			sseHandler.Params, err = requestParamsFromAppConfig(r.Params, appConfig.Schemas)
+			if err != nil {
+				return nil, fmt.Errorf("route %s: %v", routeName(r), err)
+			}
+
+			sseHandler.ErrorResponses = errorResponses
+			sseHandler.RequestHeaders = requestHeaders
+			sseHandler.Host = host
+			handler = sseHandler
+		} else if r.WebSocket != nil {
+			webSocketHandler, err := newWebSocketHandlerFromAppConfig(ctx, dbconn, schema, r.WebSocket)
+			if err != nil {
+				return nil, fmt.Errorf("route %s: %v", routeName(r), err)
+			}
+
+			webSocketHandler.Params, err = requestParamsFromAppConfig(r.Params, appConfig.Schemas)
+			if err != nil {
+				return nil, fmt.Errorf("route %s: %v", routeName(r), err)
+			}
+
+			webSocketHandler.ErrorResponses = errorResponses
+			webSocketHandler.RequestHeaders = requestHeaders
+			webSocketHandler.Host = host
+			handler = webSocketHandler
 		} else if r.ReverseProxy != "" {
 			var httpAddress string
 			if service := serviceGroup.GetService(r.ReverseProxy); service != nil {
@@ -166,36 +452,21 @@ func NewAppHandler(ctx context.Context, dbconn db.DBConn, schema string, appConf
 				return nil, fmt.Errorf("route %s: %v", routeName(r), err)
 			}
 			rp := &reverseProxy{
-				rp: httputil.NewSingleHostReverseProxy(dstURL),
-			}
-			originalDirector := rp.rp.Director
-			rp.rp.Director = func(r *http.Request) {
-				if cookie, err := r.Cookie("hannibal-session"); err == nil {
-					var requestCookieSession []byte
-					host.secureCookie.Decode("hannibal-session", cookie.Value, &requestCookieSession)
-					r.Header.Add("X-Hannibal-Cookie-Session", string(requestCookieSession))
-				}
-				originalDirector(r)
+				rp:   httputil.NewSingleHostReverseProxy(dstURL),
+				host: host,
 			}
 
 			rp.rp.ModifyResponse = func(resp *http.Response) error {
 				responseCookieSession := resp.Header.Get("X-Hannibal-Cookie-Session")
 				if responseCookieSession != "" {
 					resp.Header.Del("X-Hannibal-Cookie-Session")
-					cookie := &http.Cookie{
-						Name:     "hannibal-session",
-						Path:     "/",
-						Secure:   false, // TODO - false in dev mode -- configurable in production
-						HttpOnly: true,
-					}
-
-					encoded, err := host.secureCookie.Encode("hannibal-session", []byte(responseCookieSession))
+					cookie, err := host.requestSessionStore(resp.Request).save(resp.Request.Context(), resp.Request, []byte(responseCookieSession))
 					if err != nil {
-						panic(err)
+						return err
+					}
+					if cookie != nil {
+						resp.Header.Add("Set-Cookie", cookie.String())
 					}
-					cookie.Value = encoded
-
-					resp.Header.Add("Set-Cookie", cookie.String())
 				}
 
 				return nil
@@ -207,14 +478,108 @@ func NewAppHandler(ctx context.Context, dbconn db.DBConn, schema string, appConf
 			panic("no handler config") // This should be unreachable due to routeHasOneHandler check above.
 		}
 
+		// Route authenticate takes precedence over global authenticate.
+		authenticator := globalAuthenticator
+		if r.Authenticate != nil {
+			authenticator, err = newAuthenticatorFromAppConfig(ctx, dbconn, schema, r.Authenticate)
+			if err != nil {
+				return nil, fmt.Errorf("route %s: %v", routeName(r), err)
+			}
+			authenticator.Host = host
+		}
+
+		switch r.Auth {
+		case "", AuthOptional, AuthRequired:
+			if r.Auth == AuthRequired && authenticator == nil {
+				return nil, fmt.Errorf("route %s: auth required requires authenticate", routeName(r))
+			}
+		case AuthNone:
+			authenticator = nil
+		default:
+			return nil, fmt.Errorf("route %s: bad auth value: %s", routeName(r), r.Auth)
+		}
+
+		// The global rate limit and the route rate limit both apply.
+		var rateLimiters []*RateLimiter
+		if globalRateLimiter != nil {
+			rateLimiters = append(rateLimiters, globalRateLimiter)
+		}
+		if r.RateLimit != nil {
+			rateLimiter, err := newRateLimiterFromAppConfig(ctx, dbconn, schema, routeName(r), r.RateLimit)
+			if err != nil {
+				return nil, fmt.Errorf("route %s: %v", routeName(r), err)
+			}
+			rateLimiter.Host = host
+			rateLimiters = append(rateLimiters, rateLimiter)
+		}
+
+		wrapRateLimits := func(handler http.Handler, principalKey bool) http.Handler {
+			for i := len(rateLimiters) - 1; i >= 0; i-- {
+				if (rateLimiters[i].Key == RateLimitKeyPrincipal) == principalKey {
+					handler = &rateLimitHandler{
+						RateLimiter:    rateLimiters[i],
+						ErrorResponses: errorResponses,
+						Handler:        handler,
+					}
+				}
+			}
+			return handler
+		}
+
 		if csrfFunc != nil && !r.DisableCSRFProtection {
+			var csrfHandler http.Handler
 			if preserveBody {
-				handler = csrfWithPreserveBodyFunc(handler)
+				csrfHandler = csrfWithPreserveBodyFunc(handler)
 			} else {
-				handler = csrfFunc(handler)
+				csrfHandler = csrfWithMultipartFunc(handler)
+			}
+
+			// Requests authenticated with bearer or api-key credentials skip the CSRF check.
+			if authenticator != nil && authenticator.headerCredentials() {
+				csrfHandler = &skipCSRFHandler{CSRFHandler: csrfHandler, Handler: handler}
+			}
+
+			handler = csrfHandler
+		}
+
+		// Rate limits keyed by principal are checked after authentication. The others are checked first so failed
+		// authentication attempts are limited too.
+		handler = wrapRateLimits(handler, true)
+
+		if authenticator != nil {
+			handler = &authenticateHandler{
+				Authenticator:  authenticator,
+				Required:       r.Auth == AuthRequired,
+				ErrorResponses: errorResponses,
+				Handler:        handler,
 			}
 		}
 
+		handler = wrapRateLimits(handler, false)
+
+		// Every function called for the request including the authenticate and rate limit key functions uses the
+		// database identity.
+		if dbIdentity != nil {
+			handler = withDBIdentity(dbIdentity)(handler)
+		}
+
+		corsPolicy := routeCORSPolicies[i]
+		if corsPolicy != nil {
+			handler = &corsHandler{Policy: corsPolicy, Handler: handler}
+		}
+
+		path, method := routePathAndMethod(r)
+		preflight, ok := corsPreflights[path]
+		if !ok {
+			preflight = &corsPreflightHandler{Policies: make(map[string]*CORSPolicy)}
+			corsPreflights[path] = preflight
+			corsPreflightPaths = append(corsPreflightPaths, path)
+		}
+		preflight.Policies[method] = corsPolicy
+		if method == "" {
+			preflight.Handler = handler
+		}
+
 		if r.GetPath != "" {
 			router.Method(http.MethodGet, r.GetPath, handler)
 		} else if r.PostPath != "" {
@@ -230,12 +595,25 @@ func NewAppHandler(ctx context.Context, dbconn db.DBConn, schema string, appConf
 		}
 	}
 
+	// Preflight requests are answered for every path with a route that allows cross-origin requests.
+	for _, path := range corsPreflightPaths {
+		preflight := corsPreflights[path]
+		for _, policy := range preflight.Policies {
+			if policy != nil {
+				router.Method(http.MethodOptions, path, preflight)
+				break
+			}
+		}
+	}
+
 	router.NotFound(NewPublicFileHandler(publicPath).ServeHTTP)
 
 	return router, nil
 }
 
-func makeCSRFFunc(ctx context.Context, dbconn db.DBConn, schema string, csrfProtectionConfig *appconf.CSRFProtection, tmpl *template.Template, host *Host) (func(http.Handler) http.Handler, error) {
+// makeCSRFFunc returns the CSRF middleware. The allowed origins of corsPolicies are trusted in addition to the
+// configured trusted origins.
+func makeCSRFFunc(ctx context.Context, dbconn db.DBConn, schema string, csrfProtectionConfig *appconf.CSRFProtection, corsPolicies []*CORSPolicy, tmpl *template.Template, host *Host) (func(http.Handler) http.Handler, error) {
 	if csrfProtectionConfig == nil {
 		csrfProtectionConfig = &appconf.CSRFProtection{}
 	}
@@ -253,12 +631,12 @@ func makeCSRFFunc(ctx context.Context, dbconn db.DBConn, schema string, csrfProt
 	}
 	if csrfProtectionConfig.ErrorFunc != "" {
 		errorFunc := csrfProtectionConfig.ErrorFunc
-		inArgs, outArgs, err := getSQLFuncArgs(ctx, dbconn, schema, errorFunc)
+		callName, inArgs, outArgs, err := getSQLFuncArgs(ctx, dbconn, schema, errorFunc)
 		if err != nil {
 			return nil, err
 		}
 
-		h, err := NewPGFuncHandler(errorFunc, inArgs, outArgs)
+		h, err := NewPGFuncHandler(callName, inArgs, outArgs)
 		if err != nil {
 			return nil, fmt.Errorf("failed to build handler for function %s: %v", errorFunc, err)
 		}
@@ -304,12 +682,34 @@ func makeCSRFFunc(ctx context.Context, dbconn db.DBConn, schema string, csrfProt
 	if csrfProtectionConfig.Secure != nil {
 		options = append(options, csrf.Secure(*csrfProtectionConfig.Secure))
 	}
-	if len(csrfProtectionConfig.TrustedOrigins) > 0 {
-		options = append(options, csrf.TrustedOrigins(csrfProtectionConfig.TrustedOrigins))
+	trustedOrigins := append([]string{}, csrfProtectionConfig.TrustedOrigins...)
+	for _, p := range corsPolicies {
+		trustedOrigins = append(trustedOrigins, p.trustedOrigins()...)
 	}
+	if len(trustedOrigins) > 0 {
+		options = append(options, csrf.TrustedOrigins(trustedOrigins))
+	}
+
+	csrfKeys := csrfKeys(ctx)
+	protect := csrfWithWildcardOrigins(corsPolicies, csrf.Protect(csrfKeys[0], options...))
+
+	if len(csrfKeys) == 1 {
+		return protect, nil
+	}
+
+	cookieName := defaultCSRFCookieName
+	if csrfProtectionConfig.CookieName != "" {
+		cookieName = csrfProtectionConfig.CookieName
+	}
+	maxAge := defaultCSRFMaxAge
+	if csrfProtectionConfig.MaxAge != nil {
+		maxAge = *csrfProtectionConfig.MaxAge
+	}
+	rotate := newCSRFKeyRotation(cookieName, maxAge, csrfKeys)
 
-	csrfKey := sha256.Sum256([]byte(current.SecretKeyBase(ctx) + "CSRF key"))
-	csrfFunc := csrf.Protect(csrfKey[:], options...)
+	csrfFunc := func(h http.Handler) http.Handler {
+		return rotate(protect(h))
+	}
 
 	return csrfFunc, nil
 }
@@ -324,6 +724,40 @@ const (
 	RequestParamTypeArray
 	RequestParamTypeObject
 	RequestParamTypeFile
+	RequestParamTypeDate
+	RequestParamTypeTime
+	RequestParamTypeTimestamp
+	RequestParamTypeTimestamptz
+	RequestParamTypeFloat8
+	RequestParamTypeEnum
+	RequestParamTypeEmail
+	RequestParamTypeURL
+)
+
+// Request param sources. RequestParamSourceAny uses the body, path, or query value.
+const (
+	RequestParamSourceAny = iota
+	RequestParamSourceQuery
+	RequestParamSourcePath
+	RequestParamSourceBody
+	RequestParamSourceHeader
+	RequestParamSourceCookie
+)
+
+// Default layouts for parsing date and time params. They accept the values produced by HTML date, time, and
+// datetime-local inputs.
+var (
+	defaultDateLayouts      = []string{"2006-01-02"}
+	defaultTimeLayouts      = []string{"15:04", "15:04:05", "15:04:05.999999999"}
+	defaultTimestampLayouts = []string{
+		"2006-01-02T15:04",
+		"2006-01-02T15:04:05",
+		"2006-01-02T15:04:05.999999999",
+		"2006-01-02 15:04",
+		"2006-01-02 15:04:05",
+		"2006-01-02 15:04:05.999999999",
+	}
+	defaultTimestamptzLayouts = append([]string{time.RFC3339Nano}, defaultTimestampLayouts...)
 )
 
 type RequestParam struct {
@@ -334,16 +768,70 @@ type RequestParam struct {
 	TrimSpace    bool
 	Required     bool
 	NullifyEmpty bool
+
+	// Layouts are the time.Parse layouts tried in order for date, time, timestamp, and timestamptz params. If empty
+	// the default layouts for the type are used.
+	Layouts []string
+
+	// Location is the time zone of timestamptz values that do not include an offset. If nil UTC is used.
+	Location *time.Location
+
+	// Values are the allowed values of an enum param.
+	Values []string
+
+	// Constraints are checked after a value has been converted to the param type. Nil values are not checked.
+	//
+	// Min and Max apply to int, bigint, numeric, and float8 params. MinLength, MaxLength, and Pattern apply to text,
+	// email, url, and enum params. Length is measured in characters. Pattern must match the entire value. OneOf
+	// applies to text and number params. MinItems and MaxItems apply to array params.
+	Min       *decimal.Decimal
+	Max       *decimal.Decimal
+	MinLength *int
+	MaxLength *int
+	Pattern   *regexp.Regexp
+	OneOf     []string
+	MinItems  *int
+	MaxItems  *int
+
+	// EqualsParam is the name of a param that must have the same value. e.g. a password confirmation. It is checked
+	// after all params are parsed.
+	EqualsParam string
+
+	// Storage is where the uploads of a file param are stored. MaxSize is the maximum size of an upload in bytes. 0
+	// is unlimited. Accept is the allowed MIME types of an upload. e.g. image/png or image/*. The MIME type is
+	// detected from the contents of the upload rather than trusting the client.
+	Storage int8
+	MaxSize int64
+	Accept  []string
+
+	// Source restricts where the value of a top-level param comes from. e.g. a path param cannot be overridden by a
+	// body field. SourceName is the name of the header or cookie for RequestParamSourceHeader and
+	// RequestParamSourceCookie.
+	Source     int8
+	SourceName string
 }
 
-func requestParamFromAppConfig(acrp *appconf.RequestParam) (*RequestParam, error) {
+// requestParamBuilder converts request params from the app config. It resolves references to schemas.
+type requestParamBuilder struct {
+	schemas map[string][]*appconf.RequestParam
+
+	// resolving is the stack of schemas being resolved. It is used to detect reference cycles.
+	resolving []string
+}
+
+func (b *requestParamBuilder) requestParamFromAppConfig(acrp *appconf.RequestParam) (*RequestParam, error) {
 	rp := &RequestParam{
 		Name:         acrp.Name,
 		Required:     acrp.Required,
 		NullifyEmpty: acrp.NullifyEmpty,
 	}
 
-	switch acrp.Type {
+	typeName := acrp.Type
+	if acrp.Ref != "" && typeName == "" {
+		typeName = "object"
+	}
+
+	switch typeName {
 	case "text", "varchar", "":
 		rp.Type = RequestParamTypeText
 	case "int", "int4", "integer":
@@ -362,8 +850,46 @@ func requestParamFromAppConfig(acrp *appconf.RequestParam) (*RequestParam, error
 		rp.Type = RequestParamTypeObject
 	case "file":
 		rp.Type = RequestParamTypeFile
+	case "date":
+		rp.Type = RequestParamTypeDate
+	case "time":
+		rp.Type = RequestParamTypeTime
+	case "timestamp":
+		rp.Type = RequestParamTypeTimestamp
+	case "timestamptz":
+		rp.Type = RequestParamTypeTimestamptz
+	case "float8", "double precision", "float":
+		rp.Type = RequestParamTypeFloat8
+	case "enum":
+		rp.Type = RequestParamTypeEnum
+	case "email":
+		rp.Type = RequestParamTypeEmail
+	case "url":
+		rp.Type = RequestParamTypeURL
 	default:
-		return nil, fmt.Errorf("param %s has unknown type: %s", acrp.Name, acrp.Type)
+		return nil, fmt.Errorf("param %s has unknown type: %s", acrp.Name, typeName)
+	}
+
+	rp.Layouts = acrp.Layouts
+
+	if acrp.TimeZone != "" {
+		if rp.Type != RequestParamTypeTimestamptz {
+			return nil, fmt.Errorf("param %s: time-zone requires type timestamptz", acrp.Name)
+		}
+		var err error
+		rp.Location, err = time.LoadLocation(acrp.TimeZone)
+		if err != nil {
+			return nil, fmt.Errorf("param %s: %v", acrp.Name, err)
+		}
+	}
+
+	if rp.Type == RequestParamTypeEnum {
+		if len(acrp.Values) == 0 {
+			return nil, fmt.Errorf("param %s: enum requires values", acrp.Name)
+		}
+		rp.Values = acrp.Values
+	} else if acrp.Values != nil {
+		return nil, fmt.Errorf("param %s: values requires type enum", acrp.Name)
 	}
 
 	if acrp.TrimSpace == nil {
@@ -372,17 +898,201 @@ func requestParamFromAppConfig(acrp *appconf.RequestParam) (*RequestParam, error
 		rp.TrimSpace = *acrp.TrimSpace
 	}
 
+	err := requestParamConstraintsFromAppConfig(rp, acrp)
+	if err != nil {
+		return nil, fmt.Errorf("param %s: %v", acrp.Name, err)
+	}
+
+	err = requestParamFileStorageFromAppConfig(rp, acrp)
+	if err != nil {
+		return nil, fmt.Errorf("param %s: %v", acrp.Name, err)
+	}
+
+	err = requestParamSourceFromAppConfig(rp, acrp)
+	if err != nil {
+		return nil, fmt.Errorf("param %s: %v", acrp.Name, err)
+	}
+
 	if acrp.ArrayElement != nil {
 		var err error
-		rp.ArrayElement, err = requestParamFromAppConfig(acrp.ArrayElement)
+		rp.ArrayElement, err = b.requestParamFromAppConfig(acrp.ArrayElement)
 		if err != nil {
 			return nil, err
 		}
+		if rp.ArrayElement.EqualsParam != "" {
+			return nil, fmt.Errorf("param %s: equals-param cannot be used on an array element", acrp.Name)
+		}
+	}
+
+	if acrp.Ref != "" || acrp.ObjectFields != nil {
+		if rp.Type != RequestParamTypeObject {
+			return nil, fmt.Errorf("param %s: $ref and object-fields require type object", acrp.Name)
+		}
+		if acrp.Ref != "" && acrp.ObjectFields != nil {
+			return nil, fmt.Errorf("param %s: cannot have both $ref and object-fields", acrp.Name)
+		}
+
+		var err error
+		if acrp.Ref != "" {
+			rp.ObjectFields, err = b.schema(acrp.Ref)
+		} else {
+			rp.ObjectFields, err = b.requestParamsFromAppConfig(acrp.ObjectFields)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("param %s: %v", acrp.Name, err)
+		}
 	}
 
 	return rp, nil
 }
 
+// requestParamsFromAppConfig converts acrps. A param with a $ref and without a name is replaced by the params of the
+// referenced schema.
+func (b *requestParamBuilder) requestParamsFromAppConfig(acrps []*appconf.RequestParam) ([]*RequestParam, error) {
+	rps := make([]*RequestParam, 0, len(acrps))
+	for _, acrp := range acrps {
+		if acrp.Ref != "" && acrp.Name == "" {
+			schemaParams, err := b.schema(acrp.Ref)
+			if err != nil {
+				return nil, err
+			}
+			rps = append(rps, schemaParams...)
+			continue
+		}
+
+		rp, err := b.requestParamFromAppConfig(acrp)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert request param %s: %v", acrp.Name, err)
+		}
+		rps = append(rps, rp)
+	}
+
+	names := make(map[string]struct{}, len(rps))
+	for _, rp := range rps {
+		if _, ok := names[rp.Name]; ok {
+			return nil, fmt.Errorf("duplicate request param: %s", rp.Name)
+		}
+		names[rp.Name] = struct{}{}
+	}
+
+	// equals-param compares params in the same list so a missing param would make every request fail.
+	for _, rp := range rps {
+		if rp.EqualsParam == "" {
+			continue
+		}
+		if _, ok := names[rp.EqualsParam]; !ok || rp.EqualsParam == rp.Name {
+			return nil, fmt.Errorf("param %s: equals-param %s is not another param in the same object", rp.Name, rp.EqualsParam)
+		}
+	}
+
+	return rps, nil
+}
+
+// schema converts the params of the schema name.
+func (b *requestParamBuilder) schema(name string) ([]*RequestParam, error) {
+	for i, n := range b.resolving {
+		if n == name {
+			return nil, fmt.Errorf("schema reference cycle: %s", strings.Join(append(b.resolving[i:], name), " -> "))
+		}
+	}
+
+	acrps, ok := b.schemas[name]
+	if !ok {
+		return nil, fmt.Errorf("schema not found: %s", name)
+	}
+
+	b.resolving = append(b.resolving, name)
+	defer func() { b.resolving = b.resolving[:len(b.resolving)-1] }()
+
+	rps, err := b.requestParamsFromAppConfig(acrps)
+	if err != nil {
+		return nil, fmt.Errorf("schema %s: %v", name, err)
+	}
+
+	return rps, nil
+}
+
+func requestParamSourceFromAppConfig(rp *RequestParam, acrp *appconf.RequestParam) error {
+	if acrp.Header != "" && acrp.Cookie != "" {
+		return errors.New("cannot have both header and cookie")
+	}
+
+	source := acrp.Source
+	if source == "" {
+		if acrp.Header != "" {
+			source = "header"
+		} else if acrp.Cookie != "" {
+			source = "cookie"
+		}
+	}
+
+	switch source {
+	case "":
+		rp.Source = RequestParamSourceAny
+	case "query":
+		rp.Source = RequestParamSourceQuery
+	case "path":
+		rp.Source = RequestParamSourcePath
+	case "body":
+		rp.Source = RequestParamSourceBody
+	case "header":
+		rp.Source = RequestParamSourceHeader
+		rp.SourceName = acrp.Header
+	case "cookie":
+		rp.Source = RequestParamSourceCookie
+		rp.SourceName = acrp.Cookie
+	default:
+		return fmt.Errorf("unknown source: %s", source)
+	}
+
+	if (acrp.Header != "" && rp.Source != RequestParamSourceHeader) || (acrp.Cookie != "" && rp.Source != RequestParamSourceCookie) {
+		return fmt.Errorf("header and cookie conflict with source %s", source)
+	}
+
+	if rp.SourceName == "" && (rp.Source == RequestParamSourceHeader || rp.Source == RequestParamSourceCookie) {
+		rp.SourceName = acrp.Name
+	}
+
+	return nil
+}
+
+// checkNestedRequestParamSources returns an error if a field of an array or object param has a source. Only top-level
+// params are read from a request.
+func checkNestedRequestParamSources(rps []*RequestParam, nested bool) error {
+	for _, rp := range rps {
+		if nested && rp.Source != RequestParamSourceAny {
+			return fmt.Errorf("param %s: source requires a top-level param", rp.Name)
+		}
+		if rp.ArrayElement != nil {
+			err := checkNestedRequestParamSources([]*RequestParam{rp.ArrayElement}, true)
+			if err != nil {
+				return err
+			}
+		}
+		err := checkNestedRequestParamSources(rp.ObjectFields, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func requestParamsFromAppConfig(acrps []*appconf.RequestParam, schemas map[string][]*appconf.RequestParam) ([]*RequestParam, error) {
+	b := &requestParamBuilder{schemas: schemas}
+	rps, err := b.requestParamsFromAppConfig(acrps)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkNestedRequestParamSources(rps, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return rps, nil
+}
+
 type arrayElementError struct {
 	Index int
 	Err   error
@@ -414,7 +1124,22 @@ func (e objectErrors) Error() string {
 	return sb.String()
 }
 
+// Parse converts value to the type of rp and checks its constraints.
 func (rp *RequestParam) Parse(value interface{}) (interface{}, error) {
+	parsed, err := rp.parse(value)
+	if err != nil {
+		return nil, err
+	}
+
+	err = rp.checkConstraints(parsed)
+	if err != nil {
+		return nil, err
+	}
+
+	return parsed, nil
+}
+
+func (rp *RequestParam) parse(value interface{}) (interface{}, error) {
 	if rp.TrimSpace {
 		if s, ok := value.(string); ok {
 			value = strings.TrimSpace(s)
@@ -429,7 +1154,7 @@ func (rp *RequestParam) Parse(value interface{}) (interface{}, error) {
 
 	if value == nil {
 		if rp.Required {
-			return nil, errors.New("missing")
+			return nil, &ParamError{Code: ParamErrorMissing, Message: "missing"}
 		}
 		return nil, nil
 	}
@@ -553,6 +1278,11 @@ func (rp *RequestParam) Parse(value interface{}) (interface{}, error) {
 		return nil, errors.New("not a uuid")
 
 	case RequestParamTypeArray:
+		// A form with a single value for an array param such as one checked checkbox is a single string.
+		if s, ok := value.(string); ok {
+			value = []interface{}{s}
+		}
+
 		switch value := value.(type) {
 		case []interface{}:
 			if rp.ArrayElement != nil {
@@ -592,6 +1322,16 @@ func (rp *RequestParam) Parse(value interface{}) (interface{}, error) {
 						errors[f.Name] = err
 					}
 				}
+				equalsErrors := checkEqualsParams(rp.ObjectFields, parsedObject, func(name string) bool {
+					_, failed := errors[name]
+					return failed
+				})
+				for k, v := range equalsErrors {
+					if errors == nil {
+						errors = make(objectErrors)
+					}
+					errors[k] = v
+				}
 				if errors != nil {
 					return nil, errors
 				}
@@ -604,11 +1344,97 @@ func (rp *RequestParam) Parse(value interface{}) (interface{}, error) {
 		}
 
 	case RequestParamTypeFile:
-		if _, ok := value.(*uploadedFile); ok {
+		switch value := value.(type) {
+		case *uploadedFile, *storedFile:
 			return value, nil
+		case *rejectedFile:
+			return nil, value.err
 		}
 		return nil, fmt.Errorf("%s: %v is not a file", rp.Name, value)
 
+	case RequestParamTypeDate:
+		t, err := rp.parseTime(value, defaultDateLayouts)
+		if err != nil {
+			return nil, errors.New("not a date")
+		}
+		return t.Format("2006-01-02"), nil
+
+	case RequestParamTypeTime:
+		t, err := rp.parseTime(value, defaultTimeLayouts)
+		if err != nil {
+			return nil, errors.New("not a time")
+		}
+		return t.Format("15:04:05.999999999"), nil
+
+	case RequestParamTypeTimestamp:
+		t, err := rp.parseTime(value, defaultTimestampLayouts)
+		if err != nil {
+			return nil, errors.New("not a timestamp")
+		}
+		return t.Format("2006-01-02T15:04:05.999999999"), nil
+
+	case RequestParamTypeTimestamptz:
+		t, err := rp.parseTime(value, defaultTimestamptzLayouts)
+		if err != nil {
+			return nil, errors.New("not a timestamp")
+		}
+		return t, nil
+
+	case RequestParamTypeFloat8:
+		var f float64
+		switch value := value.(type) {
+		case float64:
+			f = value
+		case json.Number, string:
+			var err error
+			f, err = strconv.ParseFloat(fmt.Sprint(value), 64)
+			if err != nil {
+				if errors.Is(err, strconv.ErrRange) {
+					return nil, errors.New("out of range")
+				}
+				return nil, errors.New("not a number")
+			}
+		default:
+			return nil, errors.New("not a number")
+		}
+		// NaN and infinity cannot be represented in JSON.
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, errors.New("not a number")
+		}
+		return f, nil
+
+	case RequestParamTypeEnum:
+		s := fmt.Sprint(value)
+		for _, v := range rp.Values {
+			if s == v {
+				return s, nil
+			}
+		}
+		return nil, fmt.Errorf("not one of %s", strings.Join(rp.Values, ", "))
+
+	case RequestParamTypeEmail:
+		s, ok := value.(string)
+		if !ok {
+			return nil, errors.New("not an email")
+		}
+		// Only a bare address is allowed. e.g. "Jack <jack@example.com>" is rejected.
+		addr, err := mail.ParseAddress(s)
+		if err != nil || addr.Name != "" || addr.Address != s {
+			return nil, errors.New("not an email")
+		}
+		return s, nil
+
+	case RequestParamTypeURL:
+		s, ok := value.(string)
+		if !ok {
+			return nil, errors.New("not a url")
+		}
+		u, err := url.Parse(s)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, errors.New("not a url")
+		}
+		return s, nil
+
 	default:
 		return nil, fmt.Errorf("unknown param type %v", rp.Type)
 	}
@@ -617,34 +1443,49 @@ func (rp *RequestParam) Parse(value interface{}) (interface{}, error) {
 type DigestPassword struct {
 	PasswordParam string
 	DigestParam   string
+	Hasher        *PasswordHasher
 }
 
+// CheckPasswordDigest checks a password against the digest returned by a function. If RehashParam is set and the
+// password matches a digest that Hasher would not have computed, a new digest from Hasher is set in RehashParam.
 type CheckPasswordDigest struct {
 	PasswordParam string
 	ResultParam   string
+	RehashParam   string
+	Hasher        *PasswordHasher
 	SQL           string
 	FuncInArgs    []string
 }
 
 func newCheckPasswordDigest(name string, inArgMap map[string]struct{}) (*CheckPasswordDigest, error) {
-	if name == "" {
-		return nil, errors.New("name cannot be empty")
+	call, err := newSQLFuncCall(name, inArgMap)
+	if err != nil {
+		return nil, err
 	}
 
-	inArgs := make([]string, 0, len(inArgMap))
-	// Allowed input arguments in order.
-	for _, a := range allowedInArgs {
-		if _, ok := inArgMap[a]; ok {
-			inArgs = append(inArgs, a)
-			delete(inArgMap, a)
-		}
+	cpd := &CheckPasswordDigest{
+		SQL:        call.SQL,
+		FuncInArgs: call.FuncInArgs,
 	}
 
-	// inArgMap should be empty
-	if len(inArgMap) > 0 {
-		for k, _ := range inArgMap {
-			return nil, fmt.Errorf("unknown arg: %s", k)
-		}
+	return cpd, nil
+}
+
+// sqlFuncCall is a call to a function that returns a single value.
+type sqlFuncCall struct {
+	SQL        string
+	FuncInArgs []string
+}
+
+// newSQLFuncCall builds a call to the function name. extraInArgs are allowed in addition to allowedInArgs.
+func newSQLFuncCall(name string, inArgMap map[string]struct{}, extraInArgs ...string) (*sqlFuncCall, error) {
+	if name == "" {
+		return nil, errors.New("name cannot be empty")
+	}
+
+	inArgs, err := orderInArgs(inArgMap, extraInArgs...)
+	if err != nil {
+		return nil, err
 	}
 
 	sb := &strings.Builder{}
@@ -654,55 +1495,97 @@ func newCheckPasswordDigest(name string, inArgMap map[string]struct{}) (*CheckPa
 		if i > 0 {
 			sb.WriteString(", ")
 		}
-		fmt.Fprintf(sb, "%s => $%d", arg, i+1)
+		fmt.Fprintf(sb, "%s => $%d", pgx.Identifier{arg}.Sanitize(), i+1)
 	}
 	sb.WriteString(")")
 
-	cpd := &CheckPasswordDigest{
+	call := &sqlFuncCall{
 		SQL:        sb.String(),
 		FuncInArgs: inArgs,
 	}
 
-	return cpd, nil
+	return call, nil
 }
 
-func getSQLFuncArgs(ctx context.Context, dbconn db.DBConn, schema string, name string) (inArgs map[string]struct{}, outArgs map[string]struct{}, err error) {
-	var proargmodes []string
-	var proargnames []string
+// requestParamFromSQLType derives a request param for a typed in argument of typeName. It returns nil for json and
+// jsonb which receive the raw value.
+func requestParamFromSQLType(name string, typeName string) *RequestParam {
+	rp := &RequestParam{Name: name, TrimSpace: true}
 
-	err = dbconn.QueryRow(
-		ctx,
-		"select proargmodes::text[], proargnames from pg_proc where proname = $1 and pronamespace = ($2::text)::regnamespace",
-		name,
-		schema,
-	).Scan(&proargmodes, &proargnames)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to introspect function %s: %v", name, err)
+	switch {
+	case strings.HasSuffix(typeName, "[]"):
+		rp.Type = RequestParamTypeArray
+		rp.ArrayElement = requestParamFromSQLType("", strings.TrimSuffix(typeName, "[]"))
+	case typeName == "smallint", typeName == "integer":
+		rp.Type = RequestParamTypeInt
+	case typeName == "bigint":
+		rp.Type = RequestParamTypeBigint
+	case typeName == "numeric", strings.HasPrefix(typeName, "numeric("):
+		rp.Type = RequestParamTypeDecimal
+	case typeName == "real", typeName == "double precision":
+		rp.Type = RequestParamTypeFloat8
+	case typeName == "boolean":
+		rp.Type = RequestParamTypeBoolean
+	case typeName == "uuid":
+		rp.Type = RequestParamTypeUUID
+	case typeName == "date":
+		rp.Type = RequestParamTypeDate
+	case strings.HasPrefix(typeName, "timestamp") && strings.HasSuffix(typeName, "without time zone"):
+		rp.Type = RequestParamTypeTimestamp
+	case strings.HasPrefix(typeName, "timestamp") && strings.HasSuffix(typeName, "with time zone"):
+		rp.Type = RequestParamTypeTimestamptz
+	case strings.HasPrefix(typeName, "time") && strings.HasSuffix(typeName, "without time zone"):
+		rp.Type = RequestParamTypeTime
+	case typeName == "json", typeName == "jsonb":
+		return nil
+	default:
+		// PostgreSQL converts the text to the argument type.
+		rp.Type = RequestParamTypeText
 	}
 
-	inArgs = make(map[string]struct{})
-	outArgs = make(map[string]struct{})
+	return rp
+}
 
-	for i, n := range proargnames {
-		var mode string
-		if len(proargmodes) <= i {
-			mode = "i"
-		} else {
-			mode = proargmodes[i]
+// addTypedInArgParams returns params with a param derived from the type of each typed in argument that does not have
+// a param.
+func addTypedInArgParams(params []*RequestParam, typedInArgs []string, inArgTypes map[string]string) []*RequestParam {
+	for _, name := range typedInArgs {
+		if findRequestParam(params, name) != nil {
+			continue
+		}
+		if rp := requestParamFromSQLType(name, inArgTypes[name]); rp != nil {
+			params = append(params, rp)
 		}
+	}
+	return params
+}
 
-		switch mode {
-		case "i":
-			inArgs[n] = struct{}{}
-		case "o":
-			outArgs[n] = struct{}{}
-		case "b":
-			inArgs[n] = struct{}{}
-			outArgs[n] = struct{}{}
-		default:
-			return nil, nil, fmt.Errorf("unknown proargmode: %s", n)
+// parseTime parses value with rp.Layouts or defaultLayouts if rp.Layouts is empty. The first layout that succeeds is
+// used.
+func (rp *RequestParam) parseTime(value interface{}, defaultLayouts []string) (time.Time, error) {
+	s, ok := value.(string)
+	if !ok {
+		return time.Time{}, fmt.Errorf("cannot convert %v to time", value)
+	}
+
+	layouts := rp.Layouts
+	if len(layouts) == 0 {
+		layouts = defaultLayouts
+	}
+
+	location := rp.Location
+	if location == nil {
+		location = time.UTC
+	}
+
+	var err error
+	for _, layout := range layouts {
+		var t time.Time
+		t, err = time.ParseInLocation(layout, s, location)
+		if err == nil {
+			return t, nil
 		}
 	}
 
-	return inArgs, outArgs, nil
+	return time.Time{}, err
 }
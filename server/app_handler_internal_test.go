@@ -0,0 +1,176 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/jackc/hannibal/appconf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestParamsFromAppConfigSchemas(t *testing.T) {
+	schemas := map[string][]*appconf.RequestParam{
+		"todo": {
+			{Name: "name", Required: true},
+			{Name: "address", Ref: "address"},
+		},
+		"address": {
+			{Name: "street"},
+			{Name: "zip", Type: "int"},
+		},
+		"a": {{Name: "b", Ref: "b"}},
+		"b": {{Name: "a", Ref: "a"}},
+	}
+
+	rps, err := requestParamsFromAppConfig([]*appconf.RequestParam{
+		{Name: "id", Type: "int"},
+		{Ref: "todo"},
+		{Name: "addresses", Type: "array", ArrayElement: &appconf.RequestParam{Ref: "address"}},
+		{Name: "inline", Type: "object", ObjectFields: []*appconf.RequestParam{{Name: "x", Type: "int"}}},
+	}, schemas)
+	require.NoError(t, err)
+	require.Len(t, rps, 5)
+
+	assert.Equal(t, "id", rps[0].Name)
+	assert.Equal(t, "name", rps[1].Name)
+	assert.True(t, rps[1].Required)
+
+	assert.Equal(t, "address", rps[2].Name)
+	assert.EqualValues(t, RequestParamTypeObject, rps[2].Type)
+	require.Len(t, rps[2].ObjectFields, 2)
+	assert.Equal(t, "zip", rps[2].ObjectFields[1].Name)
+	assert.EqualValues(t, RequestParamTypeInt, rps[2].ObjectFields[1].Type)
+
+	assert.EqualValues(t, RequestParamTypeObject, rps[3].ArrayElement.Type)
+	require.Len(t, rps[3].ArrayElement.ObjectFields, 2)
+
+	require.Len(t, rps[4].ObjectFields, 1)
+	assert.EqualValues(t, RequestParamTypeInt, rps[4].ObjectFields[0].Type)
+
+	_, err = requestParamsFromAppConfig([]*appconf.RequestParam{{Ref: "missing"}}, schemas)
+	assert.EqualError(t, err, "schema not found: missing")
+
+	_, err = requestParamsFromAppConfig([]*appconf.RequestParam{{Ref: "a"}}, schemas)
+	assert.EqualError(t, err, "schema a: failed to convert request param b: param b: schema b: failed to convert request param a: param a: schema reference cycle: a -> b -> a")
+
+	_, err = requestParamsFromAppConfig([]*appconf.RequestParam{{Name: "street"}, {Ref: "address"}}, schemas)
+	assert.EqualError(t, err, "duplicate request param: street")
+
+	_, err = requestParamsFromAppConfig([]*appconf.RequestParam{{Name: "x", Type: "int", Ref: "address"}}, schemas)
+	assert.EqualError(t, err, "failed to convert request param x: param x: $ref and object-fields require type object")
+}
+
+func TestRequestParamsFromAppConfigSources(t *testing.T) {
+	rps, err := requestParamsFromAppConfig([]*appconf.RequestParam{
+		{Name: "id", Source: "path"},
+		{Name: "tenantID", Header: "X-Tenant-Id"},
+		{Name: "theme", Source: "cookie"},
+		{Name: "q"},
+	}, nil)
+	require.NoError(t, err)
+	require.Len(t, rps, 4)
+
+	assert.EqualValues(t, RequestParamSourcePath, rps[0].Source)
+	assert.EqualValues(t, RequestParamSourceHeader, rps[1].Source)
+	assert.Equal(t, "X-Tenant-Id", rps[1].SourceName)
+	assert.EqualValues(t, RequestParamSourceCookie, rps[2].Source)
+	assert.Equal(t, "theme", rps[2].SourceName)
+	assert.EqualValues(t, RequestParamSourceAny, rps[3].Source)
+
+	_, err = requestParamsFromAppConfig([]*appconf.RequestParam{{Name: "id", Source: "body", Header: "X-Id"}}, nil)
+	assert.EqualError(t, err, "failed to convert request param id: param id: header and cookie conflict with source body")
+
+	_, err = requestParamsFromAppConfig([]*appconf.RequestParam{{Name: "id", Source: "session"}}, nil)
+	assert.EqualError(t, err, "failed to convert request param id: param id: unknown source: session")
+
+	_, err = requestParamsFromAppConfig([]*appconf.RequestParam{
+		{Name: "user", Type: "object", ObjectFields: []*appconf.RequestParam{{Name: "id", Source: "path"}}},
+	}, nil)
+	assert.EqualError(t, err, "param id: source requires a top-level param")
+}
+
+func TestRequestParamsFromAppConfigEqualsParam(t *testing.T) {
+	rps, err := requestParamsFromAppConfig([]*appconf.RequestParam{
+		{Name: "password"},
+		{Name: "passwordConfirmation", EqualsParam: "password"},
+		{Name: "user", Type: "object", ObjectFields: []*appconf.RequestParam{
+			{Name: "email"},
+			{Name: "emailConfirmation", EqualsParam: "email"},
+		}},
+	}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "password", rps[1].EqualsParam)
+
+	_, err = requestParamsFromAppConfig([]*appconf.RequestParam{
+		{Name: "password"},
+		{Name: "passwordConfirmation", EqualsParam: "pasword"},
+	}, nil)
+	assert.EqualError(t, err, "param passwordConfirmation: equals-param pasword is not another param in the same object")
+
+	_, err = requestParamsFromAppConfig([]*appconf.RequestParam{
+		{Name: "password"},
+		{Name: "user", Type: "object", ObjectFields: []*appconf.RequestParam{{Name: "passwordConfirmation", EqualsParam: "password"}}},
+	}, nil)
+	assert.EqualError(t, err, "failed to convert request param user: param user: param passwordConfirmation: equals-param password is not another param in the same object")
+
+	_, err = requestParamsFromAppConfig([]*appconf.RequestParam{{Name: "password", EqualsParam: "password"}}, nil)
+	assert.EqualError(t, err, "param password: equals-param password is not another param in the same object")
+
+	_, err = requestParamsFromAppConfig([]*appconf.RequestParam{
+		{Name: "password"},
+		{Name: "codes", Type: "array", ArrayElement: &appconf.RequestParam{EqualsParam: "password"}},
+	}, nil)
+	assert.EqualError(t, err, "failed to convert request param codes: param codes: equals-param cannot be used on an array element")
+}
+
+func TestRequestParamFromSQLType(t *testing.T) {
+	for i, tt := range []struct {
+		typeName string
+		expected int8
+	}{
+		{typeName: "integer", expected: RequestParamTypeInt},
+		{typeName: "smallint", expected: RequestParamTypeInt},
+		{typeName: "bigint", expected: RequestParamTypeBigint},
+		{typeName: "numeric", expected: RequestParamTypeDecimal},
+		{typeName: "numeric(10,2)", expected: RequestParamTypeDecimal},
+		{typeName: "double precision", expected: RequestParamTypeFloat8},
+		{typeName: "boolean", expected: RequestParamTypeBoolean},
+		{typeName: "uuid", expected: RequestParamTypeUUID},
+		{typeName: "date", expected: RequestParamTypeDate},
+		{typeName: "time without time zone", expected: RequestParamTypeTime},
+		{typeName: "timestamp without time zone", expected: RequestParamTypeTimestamp},
+		{typeName: "timestamp with time zone", expected: RequestParamTypeTimestamptz},
+		{typeName: "timestamp(3) with time zone", expected: RequestParamTypeTimestamptz},
+		{typeName: "text", expected: RequestParamTypeText},
+		{typeName: "character varying(20)", expected: RequestParamTypeText},
+		{typeName: "inet", expected: RequestParamTypeText},
+		{typeName: "integer[]", expected: RequestParamTypeArray},
+	} {
+		rp := requestParamFromSQLType("x", tt.typeName)
+		require.NotNilf(t, rp, "%d: %s", i, tt.typeName)
+		assert.Equalf(t, tt.expected, rp.Type, "%d: %s", i, tt.typeName)
+		assert.Equalf(t, "x", rp.Name, "%d: %s", i, tt.typeName)
+	}
+
+	rp := requestParamFromSQLType("ids", "bigint[]")
+	require.NotNil(t, rp.ArrayElement)
+	assert.EqualValues(t, RequestParamTypeBigint, rp.ArrayElement.Type)
+
+	assert.Nil(t, requestParamFromSQLType("data", "jsonb"))
+	assert.Nil(t, requestParamFromSQLType("data", "json"))
+}
+
+func TestAddTypedInArgParams(t *testing.T) {
+	declared := &RequestParam{Name: "title", Type: RequestParamTypeText, Required: true}
+	params := addTypedInArgParams(
+		[]*RequestParam{declared},
+		[]string{"data", "due", "title", "todo_id"},
+		map[string]string{"data": "jsonb", "due": "date", "title": "text", "todo_id": "integer"},
+	)
+	require.Len(t, params, 3)
+	assert.Same(t, declared, params[0])
+	assert.Equal(t, "due", params[1].Name)
+	assert.EqualValues(t, RequestParamTypeDate, params[1].Type)
+	assert.Equal(t, "todo_id", params[2].Name)
+	assert.EqualValues(t, RequestParamTypeInt, params[2].Type)
+}
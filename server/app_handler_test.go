@@ -1,7 +1,11 @@
 package server_test
 
 import (
+	"encoding/json"
+	"errors"
+	"regexp"
 	"testing"
+	"time"
 
 	"github.com/gofrs/uuid"
 	"github.com/jackc/hannibal/server"
@@ -10,6 +14,9 @@ import (
 )
 
 func TestRequestParamParse(t *testing.T) {
+	chicago, err := time.LoadLocation("America/Chicago")
+	require.NoError(t, err)
+
 	// Success cases
 	for _, tt := range []struct {
 		desc   string
@@ -168,6 +175,17 @@ func TestRequestParamParse(t *testing.T) {
 			value:  []interface{}{"42"},
 			result: []interface{}{int32(42)},
 		},
+		{
+			desc: "array from single string",
+			rp: &server.RequestParam{
+				Type: server.RequestParamTypeArray,
+				ArrayElement: &server.RequestParam{
+					Type: server.RequestParamTypeInt,
+				},
+			},
+			value:  "42",
+			result: []interface{}{int32(42)},
+		},
 		{
 			desc: "object unconstrained",
 			rp: &server.RequestParam{
@@ -194,6 +212,143 @@ func TestRequestParamParse(t *testing.T) {
 			value:  map[string]interface{}{"foo": "bar", "baz": "42", "ignored": "ignored"},
 			result: map[string]interface{}{"foo": "bar", "baz": int32(42)},
 		},
+		{
+			desc: "date from string",
+			rp: &server.RequestParam{
+				Type: server.RequestParamTypeDate,
+			},
+			value:  "2021-03-04",
+			result: "2021-03-04",
+		},
+		{
+			desc: "date with layouts",
+			rp: &server.RequestParam{
+				Type:    server.RequestParamTypeDate,
+				Layouts: []string{"2006-01-02", "01/02/2006"},
+			},
+			value:  "03/04/2021",
+			result: "2021-03-04",
+		},
+		{
+			desc: "time from string without seconds",
+			rp: &server.RequestParam{
+				Type: server.RequestParamTypeTime,
+			},
+			value:  "13:45",
+			result: "13:45:00",
+		},
+		{
+			desc: "time from string with fractional seconds",
+			rp: &server.RequestParam{
+				Type: server.RequestParamTypeTime,
+			},
+			value:  "13:45:01.25",
+			result: "13:45:01.25",
+		},
+		{
+			desc: "timestamp from datetime-local string",
+			rp: &server.RequestParam{
+				Type: server.RequestParamTypeTimestamp,
+			},
+			value:  "2021-03-04T13:45",
+			result: "2021-03-04T13:45:00",
+		},
+		{
+			desc: "timestamptz from RFC 3339 string",
+			rp: &server.RequestParam{
+				Type: server.RequestParamTypeTimestamptz,
+			},
+			value:  "2021-03-04T13:45:01Z",
+			result: time.Date(2021, 3, 4, 13, 45, 1, 0, time.UTC),
+		},
+		{
+			desc: "timestamptz without offset uses location",
+			rp: &server.RequestParam{
+				Type:     server.RequestParamTypeTimestamptz,
+				Location: chicago,
+			},
+			value:  "2021-03-04T13:45",
+			result: time.Date(2021, 3, 4, 13, 45, 0, 0, chicago),
+		},
+		{
+			desc: "float8 from string",
+			rp: &server.RequestParam{
+				Type: server.RequestParamTypeFloat8,
+			},
+			value:  "1.5",
+			result: float64(1.5),
+		},
+		{
+			desc: "float8 from float64",
+			rp: &server.RequestParam{
+				Type: server.RequestParamTypeFloat8,
+			},
+			value:  float64(1.5),
+			result: float64(1.5),
+		},
+		{
+			desc: "float8 from json.Number",
+			rp: &server.RequestParam{
+				Type: server.RequestParamTypeFloat8,
+			},
+			value:  json.Number("1e3"),
+			result: float64(1000),
+		},
+		{
+			desc: "enum from allowed value",
+			rp: &server.RequestParam{
+				Type:   server.RequestParamTypeEnum,
+				Values: []string{"low", "high"},
+			},
+			value:  "high",
+			result: "high",
+		},
+		{
+			desc: "email from string",
+			rp: &server.RequestParam{
+				Type: server.RequestParamTypeEmail,
+			},
+			value:  "jack@example.com",
+			result: "jack@example.com",
+		},
+		{
+			desc: "url from string",
+			rp: &server.RequestParam{
+				Type: server.RequestParamTypeURL,
+			},
+			value:  "https://example.com/foo?bar=baz",
+			result: "https://example.com/foo?bar=baz",
+		},
+		{
+			desc: "int within min and max",
+			rp: &server.RequestParam{
+				Type: server.RequestParamTypeInt,
+				Min:  decimalPtr(1),
+				Max:  decimalPtr(10),
+			},
+			value:  "10",
+			result: int32(10),
+		},
+		{
+			desc: "text within length and pattern",
+			rp: &server.RequestParam{
+				Type:      server.RequestParamTypeText,
+				MinLength: intPtr(2),
+				MaxLength: intPtr(3),
+				Pattern:   regexp.MustCompile(`^(?:\pL+)$`),
+			},
+			value:  "äbc",
+			result: "äbc",
+		},
+		{
+			desc: "nil skips constraints",
+			rp: &server.RequestParam{
+				Type:      server.RequestParamTypeText,
+				MinLength: intPtr(2),
+			},
+			value:  nil,
+			result: nil,
+		},
 	} {
 		t.Run(tt.desc, func(t *testing.T) {
 			result, err := tt.rp.Parse(tt.value)
@@ -284,6 +439,187 @@ func TestRequestParamParse(t *testing.T) {
 			value:  "abcde",
 			errStr: "not a uuid",
 		},
+		{
+			desc: "date from non-date string",
+			rp: &server.RequestParam{
+				Type: server.RequestParamTypeDate,
+			},
+			value:  "2021-02-30",
+			errStr: "not a date",
+		},
+		{
+			desc: "time from non-time string",
+			rp: &server.RequestParam{
+				Type: server.RequestParamTypeTime,
+			},
+			value:  "25:00",
+			errStr: "not a time",
+		},
+		{
+			desc: "timestamp from non-timestamp string",
+			rp: &server.RequestParam{
+				Type: server.RequestParamTypeTimestamp,
+			},
+			value:  "yesterday",
+			errStr: "not a timestamp",
+		},
+		{
+			desc: "timestamptz from non-timestamp string",
+			rp: &server.RequestParam{
+				Type: server.RequestParamTypeTimestamptz,
+			},
+			value:  "2021-03-04",
+			errStr: "not a timestamp",
+		},
+		{
+			desc: "float8 from non-numeric string",
+			rp: &server.RequestParam{
+				Type: server.RequestParamTypeFloat8,
+			},
+			value:  "abc",
+			errStr: "not a number",
+		},
+		{
+			desc: "float8 from NaN",
+			rp: &server.RequestParam{
+				Type: server.RequestParamTypeFloat8,
+			},
+			value:  "NaN",
+			errStr: "not a number",
+		},
+		{
+			desc: "float8 from too big numeric string",
+			rp: &server.RequestParam{
+				Type: server.RequestParamTypeFloat8,
+			},
+			value:  "1e400",
+			errStr: "out of range",
+		},
+		{
+			desc: "enum from disallowed value",
+			rp: &server.RequestParam{
+				Type:   server.RequestParamTypeEnum,
+				Values: []string{"low", "high"},
+			},
+			value:  "medium",
+			errStr: "not one of low, high",
+		},
+		{
+			desc: "email from non-email string",
+			rp: &server.RequestParam{
+				Type: server.RequestParamTypeEmail,
+			},
+			value:  "jack",
+			errStr: "not an email",
+		},
+		{
+			desc: "email with display name",
+			rp: &server.RequestParam{
+				Type: server.RequestParamTypeEmail,
+			},
+			value:  "Jack <jack@example.com>",
+			errStr: "not an email",
+		},
+		{
+			desc: "url without scheme",
+			rp: &server.RequestParam{
+				Type: server.RequestParamTypeURL,
+			},
+			value:  "example.com/foo",
+			errStr: "not a url",
+		},
+		{
+			desc: "url with disallowed scheme",
+			rp: &server.RequestParam{
+				Type: server.RequestParamTypeURL,
+			},
+			value:  "javascript:alert(1)",
+			errStr: "not a url",
+		},
+		{
+			desc: "int less than min",
+			rp: &server.RequestParam{
+				Type: server.RequestParamTypeInt,
+				Min:  decimalPtr(1),
+			},
+			value:  "0",
+			errStr: "must be at least 1",
+		},
+		{
+			desc: "float8 greater than max",
+			rp: &server.RequestParam{
+				Type: server.RequestParamTypeFloat8,
+				Max:  decimalPtr(1.5),
+			},
+			value:  "1.75",
+			errStr: "must be at most 1.5",
+		},
+		{
+			desc: "text shorter than min length",
+			rp: &server.RequestParam{
+				Type:      server.RequestParamTypeText,
+				MinLength: intPtr(2),
+			},
+			value:  "a",
+			errStr: "must be at least 2 characters",
+		},
+		{
+			desc: "text longer than max length",
+			rp: &server.RequestParam{
+				Type:      server.RequestParamTypeText,
+				MaxLength: intPtr(2),
+			},
+			value:  "abc",
+			errStr: "must be at most 2 characters",
+		},
+		{
+			desc: "text not matching pattern",
+			rp: &server.RequestParam{
+				Type:    server.RequestParamTypeText,
+				Pattern: regexp.MustCompile(`^(?:[a-z]+)$`),
+			},
+			value:  "abc1",
+			errStr: "does not match pattern",
+		},
+		{
+			desc: "int not one of",
+			rp: &server.RequestParam{
+				Type:  server.RequestParamTypeInt,
+				OneOf: []string{"1", "2"},
+			},
+			value:  "3",
+			errStr: "not one of 1, 2",
+		},
+		{
+			desc: "array with too few items",
+			rp: &server.RequestParam{
+				Type:     server.RequestParamTypeArray,
+				MinItems: intPtr(1),
+			},
+			value:  []interface{}{},
+			errStr: "must have at least 1 elements",
+		},
+		{
+			desc: "array with too many items",
+			rp: &server.RequestParam{
+				Type:     server.RequestParamTypeArray,
+				MaxItems: intPtr(1),
+			},
+			value:  []interface{}{"a", "b"},
+			errStr: "must have at most 1 elements",
+		},
+		{
+			desc: "object field not equal to other field",
+			rp: &server.RequestParam{
+				Type: server.RequestParamTypeObject,
+				ObjectFields: []*server.RequestParam{
+					{Name: "password", Type: server.RequestParamTypeText},
+					{Name: "passwordConfirmation", Type: server.RequestParamTypeText, EqualsParam: "password"},
+				},
+			},
+			value:  map[string]interface{}{"password": "secret", "passwordConfirmation": "secrte"},
+			errStr: "passwordConfirmation: does not match password",
+		},
 	} {
 		t.Run(tt.desc, func(t *testing.T) {
 			result, err := tt.rp.Parse(tt.value)
@@ -292,3 +628,31 @@ func TestRequestParamParse(t *testing.T) {
 		})
 	}
 }
+
+func TestRequestParamParseErrorCode(t *testing.T) {
+	rp := &server.RequestParam{
+		Type:     server.RequestParamTypeText,
+		Required: true,
+	}
+	_, err := rp.Parse(nil)
+	var paramErr *server.ParamError
+	require.True(t, errors.As(err, &paramErr))
+	require.Equal(t, server.ParamErrorMissing, paramErr.Code)
+
+	rp = &server.RequestParam{
+		Type:      server.RequestParamTypeText,
+		MaxLength: intPtr(1),
+	}
+	_, err = rp.Parse("ab")
+	require.True(t, errors.As(err, &paramErr))
+	require.Equal(t, server.ParamErrorMaxLength, paramErr.Code)
+}
+
+func decimalPtr(f float64) *decimal.Decimal {
+	d := decimal.NewFromFloat(f)
+	return &d
+}
+
+func intPtr(n int) *int {
+	return &n
+}
@@ -0,0 +1,258 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/jackc/hannibal/appconf"
+	"github.com/jackc/hannibal/db"
+)
+
+const (
+	AuthSchemeBearer = "bearer"
+	AuthSchemeBasic  = "basic"
+	AuthSchemeAPIKey = "api-key"
+)
+
+const (
+	AuthOptional = "optional"
+	AuthRequired = "required"
+	AuthNone     = "none"
+)
+
+// defaultAPIKeyHeader is the header the api-key scheme reads the key from when no header is configured.
+const defaultAPIKeyHeader = "X-API-Key"
+
+// Authenticator resolves the credentials of a request to a principal with Func. The bearer and api-key schemes pass
+// the credentials to Func as the in argument token. The basic scheme passes them as username and password. Func returns
+// the principal as json or jsonb or null to reject the credentials.
+type Authenticator struct {
+	Scheme string
+	Header string
+	Realm  string
+	Func   *sqlFuncCall
+	Host   *Host
+}
+
+func newAuthenticatorFromAppConfig(ctx context.Context, dbconn db.DBConn, schema string, aca *appconf.Authenticate) (*Authenticator, error) {
+	a := &Authenticator{
+		Scheme: strings.ToLower(aca.Scheme),
+		Header: aca.Header,
+		Realm:  aca.Realm,
+	}
+
+	var credentialInArgs []string
+	switch a.Scheme {
+	case AuthSchemeBearer:
+		credentialInArgs = []string{"token"}
+	case AuthSchemeBasic:
+		credentialInArgs = []string{"username", "password"}
+	case AuthSchemeAPIKey:
+		credentialInArgs = []string{"token"}
+		if a.Header == "" {
+			a.Header = defaultAPIKeyHeader
+		}
+	default:
+		return nil, fmt.Errorf("bad authenticate scheme: %s", aca.Scheme)
+	}
+
+	if a.Header != "" && a.Scheme != AuthSchemeAPIKey {
+		return nil, errors.New("authenticate header requires api-key scheme")
+	}
+
+	if aca.Func == "" {
+		return nil, errors.New("authenticate requires func")
+	}
+
+	callName, inArgs, _, err := getSQLFuncArgs(ctx, dbconn, schema, aca.Func)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range credentialInArgs {
+		if _, ok := inArgs[name]; !ok {
+			return nil, fmt.Errorf("authenticate func %s must have %s in argument", aca.Func, name)
+		}
+	}
+
+	// Request params have not been parsed and no principal exists when the function is called.
+	for _, name := range []string{"args", "raw_args", "principal"} {
+		if _, ok := inArgs[name]; ok {
+			return nil, fmt.Errorf("authenticate func %s cannot have %s in argument", aca.Func, name)
+		}
+	}
+
+	a.Func, err = newSQLFuncCall(callName, inArgs, credentialInArgs...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build call for function %s: %v", aca.Func, err)
+	}
+
+	return a, nil
+}
+
+// credentials returns the credentials of r as the in argument values of Func. ok is false if r does not have
+// credentials for the scheme.
+func (a *Authenticator) credentials(r *http.Request) (credentials map[string]interface{}, ok bool) {
+	switch a.Scheme {
+	case AuthSchemeBearer:
+		authorization := r.Header.Get("Authorization")
+		if len(authorization) < 7 || !strings.EqualFold(authorization[:7], "Bearer ") {
+			return nil, false
+		}
+		token := strings.TrimSpace(authorization[7:])
+		if token == "" {
+			return nil, false
+		}
+		return map[string]interface{}{"token": token}, true
+	case AuthSchemeBasic:
+		username, password, ok := r.BasicAuth()
+		if !ok {
+			return nil, false
+		}
+		return map[string]interface{}{"username": username, "password": password}, true
+	case AuthSchemeAPIKey:
+		token := strings.TrimSpace(r.Header.Get(a.Header))
+		if token == "" {
+			return nil, false
+		}
+		return map[string]interface{}{"token": token}, true
+	}
+
+	return nil, false
+}
+
+// authenticate calls Func with credentials. It returns nil if the credentials are rejected.
+func (a *Authenticator) authenticate(ctx context.Context, r *http.Request, credentials map[string]interface{}) ([]byte, error) {
+	cookieSession, err := a.Host.readCookieSession(r)
+	if err != nil {
+		return nil, err
+	}
+
+	sqlArgs := &httpSQLArgs{
+		cookieSession: cookieSession,
+		request:       r,
+		extra:         credentials,
+	}
+
+	var principal []byte
+	err = contextDBIdentity(ctx).run(ctx, sqlArgs, func(conn db.DBConn) error {
+		return conn.QueryRow(ctx, a.Func.SQL, buildHTTPSQLArgs(a.Func.FuncInArgs, sqlArgs)...).Scan(&principal)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if string(principal) == "null" {
+		return nil, nil
+	}
+
+	return principal, nil
+}
+
+// challenge responds with 401 Unauthorized and a WWW-Authenticate header for the scheme. invalid reports whether
+// credentials were present but rejected.
+func (a *Authenticator) challenge(w http.ResponseWriter, invalid bool) {
+	var authScheme string
+	var params []string
+
+	if a.Realm != "" {
+		params = append(params, fmt.Sprintf("realm=%s", quoteAuthParam(a.Realm)))
+	}
+
+	switch a.Scheme {
+	case AuthSchemeBearer:
+		authScheme = "Bearer"
+		if invalid {
+			params = append(params, `error="invalid_token"`)
+		}
+	case AuthSchemeBasic:
+		authScheme = "Basic"
+		params = append(params, `charset="UTF-8"`)
+	case AuthSchemeAPIKey:
+		authScheme = "APIKey"
+		params = append(params, fmt.Sprintf("header=%s", quoteAuthParam(a.Header)))
+	}
+
+	if len(params) > 0 {
+		authScheme = authScheme + " " + strings.Join(params, ", ")
+	}
+
+	w.Header().Set("WWW-Authenticate", authScheme)
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
+
+// quoteAuthParam returns s as a quoted-string for a WWW-Authenticate parameter.
+func quoteAuthParam(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + s + `"`
+}
+
+// authenticateHandler authenticates a request before passing it to Handler. The principal is available to Handler
+// through the principal in argument. Credentials that are present are always checked. If Required is true a request
+// without credentials is rejected.
+type authenticateHandler struct {
+	Authenticator  *Authenticator
+	Required       bool
+	ErrorResponses []*ErrorResponse
+	Handler        http.Handler
+}
+
+func (h *authenticateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	credentials, ok := h.Authenticator.credentials(r)
+	if !ok {
+		if h.Required {
+			h.Authenticator.challenge(w, false)
+			return
+		}
+		h.Handler.ServeHTTP(w, r)
+		return
+	}
+
+	principal, err := h.Authenticator.authenticate(r.Context(), r, credentials)
+	if err != nil {
+		handleQueryError(w, r, h.ErrorResponses, err)
+		return
+	}
+	if principal == nil {
+		h.Authenticator.challenge(w, true)
+		return
+	}
+
+	r = r.WithContext(context.WithValue(r.Context(), principalCtxKey, principal))
+	h.Handler.ServeHTTP(w, r)
+}
+
+// headerCredentials returns true if the scheme reads credentials from a header that browsers never send on their own.
+// A request authenticated with such credentials cannot be forged by another site so it does not need CSRF protection.
+// Basic credentials are remembered and sent by browsers so they do not qualify.
+func (a *Authenticator) headerCredentials() bool {
+	return a.Scheme == AuthSchemeBearer || a.Scheme == AuthSchemeAPIKey
+}
+
+// skipCSRFHandler passes requests that have a principal directly to Handler. Other requests go through CSRFHandler.
+// It must be wrapped by an authenticateHandler whose Authenticator uses header credentials.
+type skipCSRFHandler struct {
+	CSRFHandler http.Handler
+	Handler     http.Handler
+}
+
+func (h *skipCSRFHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if requestPrincipal(r) != nil {
+		h.Handler.ServeHTTP(w, r)
+		return
+	}
+	h.CSRFHandler.ServeHTTP(w, r)
+}
+
+// requestPrincipal returns the principal of an authenticated request or nil.
+func requestPrincipal(r *http.Request) []byte {
+	if r == nil {
+		return nil
+	}
+	principal, _ := r.Context().Value(principalCtxKey).([]byte)
+	return principal
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthenticatorCredentials(t *testing.T) {
+	for i, tt := range []struct {
+		authenticator *Authenticator
+		header        http.Header
+		credentials   map[string]interface{}
+		ok            bool
+	}{
+		{
+			authenticator: &Authenticator{Scheme: AuthSchemeBearer},
+			header:        http.Header{"Authorization": {"Bearer abc"}},
+			credentials:   map[string]interface{}{"token": "abc"},
+			ok:            true,
+		},
+		{
+			authenticator: &Authenticator{Scheme: AuthSchemeBearer},
+			header:        http.Header{"Authorization": {"bearer  abc "}},
+			credentials:   map[string]interface{}{"token": "abc"},
+			ok:            true,
+		},
+		{
+			authenticator: &Authenticator{Scheme: AuthSchemeBearer},
+			header:        http.Header{"Authorization": {"Basic amFjazpzZWNyZXQ="}},
+		},
+		{
+			authenticator: &Authenticator{Scheme: AuthSchemeBearer},
+			header:        http.Header{"Authorization": {"Bearer "}},
+		},
+		{
+			authenticator: &Authenticator{Scheme: AuthSchemeBasic},
+			header:        http.Header{"Authorization": {"Basic amFjazpzZWNyZXQ="}},
+			credentials:   map[string]interface{}{"username": "jack", "password": "secret"},
+			ok:            true,
+		},
+		{
+			authenticator: &Authenticator{Scheme: AuthSchemeBasic},
+			header:        http.Header{"Authorization": {"Bearer abc"}},
+		},
+		{
+			authenticator: &Authenticator{Scheme: AuthSchemeAPIKey, Header: "X-Api-Key"},
+			header:        http.Header{"X-Api-Key": {"abc"}},
+			credentials:   map[string]interface{}{"token": "abc"},
+			ok:            true,
+		},
+		{
+			authenticator: &Authenticator{Scheme: AuthSchemeAPIKey, Header: "X-Api-Key"},
+			header:        http.Header{"Authorization": {"Bearer abc"}},
+		},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header = tt.header
+
+		credentials, ok := tt.authenticator.credentials(r)
+		assert.Equalf(t, tt.ok, ok, "%d", i)
+		assert.Equalf(t, tt.credentials, credentials, "%d", i)
+	}
+}
+
+func TestAuthenticatorChallenge(t *testing.T) {
+	for i, tt := range []struct {
+		authenticator   *Authenticator
+		invalid         bool
+		wwwAuthenticate string
+	}{
+		{
+			authenticator:   &Authenticator{Scheme: AuthSchemeBearer},
+			wwwAuthenticate: `Bearer`,
+		},
+		{
+			authenticator:   &Authenticator{Scheme: AuthSchemeBearer, Realm: `my "app"`},
+			invalid:         true,
+			wwwAuthenticate: `Bearer realm="my \"app\"", error="invalid_token"`,
+		},
+		{
+			authenticator:   &Authenticator{Scheme: AuthSchemeBasic, Realm: "app"},
+			wwwAuthenticate: `Basic realm="app", charset="UTF-8"`,
+		},
+		{
+			authenticator:   &Authenticator{Scheme: AuthSchemeAPIKey, Header: "X-Api-Key"},
+			invalid:         true,
+			wwwAuthenticate: `APIKey header="X-Api-Key"`,
+		},
+	} {
+		w := httptest.NewRecorder()
+		tt.authenticator.challenge(w, tt.invalid)
+		assert.Equalf(t, http.StatusUnauthorized, w.Code, "%d", i)
+		assert.Equalf(t, tt.wwwAuthenticate, w.Header().Get("WWW-Authenticate"), "%d", i)
+	}
+}
+
+func TestSkipCSRFHandler(t *testing.T) {
+	assert.True(t, (&Authenticator{Scheme: AuthSchemeBearer}).headerCredentials())
+	assert.True(t, (&Authenticator{Scheme: AuthSchemeAPIKey}).headerCredentials())
+	assert.False(t, (&Authenticator{Scheme: AuthSchemeBasic}).headerCredentials())
+
+	h := &skipCSRFHandler{
+		CSRFHandler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+		}),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}),
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/", nil))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	r := httptest.NewRequest("POST", "/", nil)
+	r = r.WithContext(context.WithValue(r.Context(), principalCtxKey, []byte(`{"user_id": 1}`)))
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
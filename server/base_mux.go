@@ -2,6 +2,7 @@ package server
 
 import (
 	"net/http"
+	"runtime/debug"
 	"time"
 
 	"github.com/go-chi/chi"
@@ -14,13 +15,11 @@ func BaseMux(log zerolog.Logger) *chi.Mux {
 	r := chi.NewRouter()
 
 	r.Use(middleware.RequestID)
-	r.Use(middleware.RealIP)
 
 	r.Use(hlog.NewHandler(log))
 	r.Use(hlog.RequestIDHandler("request_id", "x-request-id"))
 	r.Use(hlog.MethodHandler("method"))
 	r.Use(hlog.URLHandler("url"))
-	r.Use(hlog.RemoteAddrHandler("remote_ip"))
 	r.Use(hlog.AccessHandler(func(r *http.Request, status, size int, duration time.Duration) {
 		hlog.FromRequest(r).Info().
 			Int("status", status).
@@ -29,7 +28,32 @@ func BaseMux(log zerolog.Logger) *chi.Mux {
 			Msg("HTTP request")
 	}))
 
-	r.Use(middleware.Recoverer)
+	r.Use(recoverer)
 
 	return r
 }
+
+// recoverer logs panics and responds with 500 Internal Server Error. Unlike middleware.Recoverer it does not swallow
+// http.ErrAbortHandler. A handler that has already sent part of a response panics with http.ErrAbortHandler so net/http
+// closes the connection without completing the response. middleware.Recoverer would let the response end normally and
+// the client could not tell it is incomplete.
+func recoverer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if rvr := recover(); rvr != nil {
+				if rvr == http.ErrAbortHandler {
+					panic(rvr)
+				}
+
+				hlog.FromRequest(r).Error().
+					Interface("panic", rvr).
+					Bytes("stack", debug.Stack()).
+					Msg("HTTP handler panic")
+
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
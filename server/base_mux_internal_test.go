@@ -0,0 +1,40 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBaseMuxAbortedResponseIsIncomplete(t *testing.T) {
+	mux := BaseMux(zerolog.Nop())
+	mux.Get("/abort", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	})
+	mux.Get("/panic", func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	response, err := http.Get(server.URL + "/abort")
+	require.NoError(t, err)
+	defer response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	body, err := ioutil.ReadAll(response.Body)
+	assert.Error(t, err)
+	assert.Equal(t, "partial", string(body))
+
+	response, err = http.Get(server.URL + "/panic")
+	require.NoError(t, err)
+	defer response.Body.Close()
+	assert.Equal(t, http.StatusInternalServerError, response.StatusCode)
+}
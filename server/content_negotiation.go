@@ -0,0 +1,93 @@
+package server
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	mediaTypeJSON = "application/json"
+	mediaTypeHTML = "text/html"
+)
+
+// preferredMediaType returns mediaTypeJSON or mediaTypeHTML if the Accept header of r prefers one over the other. It
+// returns an empty string if neither is preferred. e.g. Accept is missing or */*.
+//
+// When both have the same quality the one named more specifically is preferred. This makes the common
+// "application/json, text/plain, */*" prefer JSON.
+func preferredMediaType(r *http.Request) string {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return ""
+	}
+
+	jsonQuality, jsonSpecificity := acceptQuality(accept, mediaTypeJSON)
+	htmlQuality, htmlSpecificity := acceptQuality(accept, mediaTypeHTML)
+
+	switch {
+	case jsonQuality > htmlQuality:
+		return mediaTypeJSON
+	case htmlQuality > jsonQuality:
+		return mediaTypeHTML
+	case jsonQuality == 0:
+		return ""
+	case jsonSpecificity > htmlSpecificity:
+		return mediaTypeJSON
+	case htmlSpecificity > jsonSpecificity:
+		return mediaTypeHTML
+	default:
+		return ""
+	}
+}
+
+// acceptQuality returns the quality value the Accept header value accept assigns to mediaType and the specificity of
+// the media range it came from. The most specific matching media range applies. 0 is */*, 1 is type/*, and 2 is an
+// exact match. It returns a quality of 0 and a specificity of -1 if no media range matches.
+func acceptQuality(accept string, mediaType string) (quality float64, specificity int) {
+	mediaTypeParts := strings.SplitN(mediaType, "/", 2)
+
+	specificity = -1
+
+	for _, mediaRange := range strings.Split(accept, ",") {
+		rangeType, params, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+		if err != nil {
+			continue
+		}
+
+		rangeParts := strings.SplitN(rangeType, "/", 2)
+		if len(rangeParts) != 2 {
+			continue
+		}
+
+		var rangeSpecificity int
+		switch {
+		case rangeParts[0] == "*" && rangeParts[1] == "*":
+			rangeSpecificity = 0
+		case rangeParts[0] == mediaTypeParts[0] && rangeParts[1] == "*":
+			rangeSpecificity = 1
+		case rangeType == mediaType:
+			rangeSpecificity = 2
+		default:
+			continue
+		}
+
+		if rangeSpecificity <= specificity {
+			continue
+		}
+
+		rangeQuality := 1.0
+		if q, ok := params["q"]; ok {
+			rangeQuality, err = strconv.ParseFloat(q, 64)
+			if err != nil {
+				continue
+			}
+		}
+
+		quality = rangeQuality
+		specificity = rangeSpecificity
+	}
+
+	return quality, specificity
+}
@@ -0,0 +1,33 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPreferredMediaType(t *testing.T) {
+	for i, tt := range []struct {
+		accept   string
+		expected string
+	}{
+		{accept: "", expected: ""},
+		{accept: "*/*", expected: ""},
+		{accept: "application/json", expected: mediaTypeJSON},
+		{accept: "text/html", expected: mediaTypeHTML},
+		{accept: "application/json, text/plain, */*", expected: mediaTypeJSON},
+		{accept: "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", expected: mediaTypeHTML},
+		{accept: "text/html;q=0.5, application/json", expected: mediaTypeJSON},
+		{accept: "application/json;q=0.5, text/html", expected: mediaTypeHTML},
+		{accept: "application/*, text/html;q=0.9", expected: mediaTypeJSON},
+		{accept: "application/json;q=0, */*", expected: mediaTypeHTML},
+		{accept: "application/json, text/html", expected: ""},
+		{accept: "image/png", expected: ""},
+		{accept: "not a media type", expected: ""},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept", tt.accept)
+		assert.Equalf(t, tt.expected, preferredMediaType(r), "%d: %s", i, tt.accept)
+	}
+}
@@ -0,0 +1,333 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/hannibal/appconf"
+)
+
+// defaultCORSMethods are the methods allowed for routes that match every method when no methods are configured.
+var defaultCORSMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+
+// CORSPolicy allows cross-origin requests from AllowedOrigins. AllowedMethods only applies to routes that match every
+// method. Routes for a single method only allow that method.
+type CORSPolicy struct {
+	// AllowedOrigins are the exact origins that are allowed. WildcardOrigins are the allowed origins with a wildcard
+	// subdomain split at the wildcard. AllowAllOrigins allows any origin.
+	AllowedOrigins  []string
+	WildcardOrigins [][2]string
+	AllowAllOrigins bool
+
+	AllowedMethods []string
+
+	// AllowedHeaders are canonical header names. AllowAllHeaders allows any header.
+	AllowedHeaders  []string
+	AllowAllHeaders bool
+
+	ExposedHeaders   []string
+	AllowCredentials bool
+
+	// MaxAge is the number of seconds a preflight response can be cached. 0 uses the default of the browser.
+	MaxAge int
+}
+
+// newCORSPolicyFromAppConfig builds a CORS policy. csrfRequestHeader is allowed by default so cross-origin requests
+// can send the CSRF token.
+func newCORSPolicyFromAppConfig(acc *appconf.CORS, csrfRequestHeader string) (*CORSPolicy, error) {
+	p := &CORSPolicy{
+		AllowCredentials: acc.AllowCredentials,
+		MaxAge:           acc.MaxAge,
+	}
+
+	if len(acc.AllowedOrigins) == 0 {
+		return nil, errors.New("cors requires allowed-origins")
+	}
+	for _, origin := range acc.AllowedOrigins {
+		origin = strings.ToLower(origin)
+		if origin == "*" {
+			p.AllowAllOrigins = true
+			continue
+		}
+
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+			return nil, fmt.Errorf("bad cors.allowed-origins value: %s", origin)
+		}
+		origin = strings.TrimSuffix(origin, "/")
+
+		if i := strings.Index(origin, "://*."); i != -1 {
+			p.WildcardOrigins = append(p.WildcardOrigins, [2]string{origin[:i+3], origin[i+4:]})
+		} else if strings.Contains(origin, "*") {
+			return nil, fmt.Errorf("bad cors.allowed-origins value: %s", origin)
+		} else {
+			p.AllowedOrigins = append(p.AllowedOrigins, origin)
+		}
+	}
+
+	if p.AllowAllOrigins && p.AllowCredentials {
+		return nil, errors.New("cors.allowed-origins * cannot be used with allow-credentials")
+	}
+
+	p.AllowedMethods = defaultCORSMethods
+	if len(acc.AllowedMethods) > 0 {
+		p.AllowedMethods = make([]string, len(acc.AllowedMethods))
+		for i, m := range acc.AllowedMethods {
+			p.AllowedMethods[i] = strings.ToUpper(m)
+		}
+	}
+
+	allowedHeaders := acc.AllowedHeaders
+	if len(allowedHeaders) == 0 {
+		allowedHeaders = []string{"Content-Type", csrfRequestHeader}
+	}
+	for _, h := range allowedHeaders {
+		if h == "*" {
+			p.AllowAllHeaders = true
+			continue
+		}
+		p.AllowedHeaders = append(p.AllowedHeaders, http.CanonicalHeaderKey(h))
+	}
+
+	if p.AllowAllHeaders && p.AllowCredentials {
+		return nil, errors.New("cors.allowed-headers * cannot be used with allow-credentials")
+	}
+
+	for _, h := range acc.ExposedHeaders {
+		p.ExposedHeaders = append(p.ExposedHeaders, http.CanonicalHeaderKey(h))
+	}
+
+	if p.MaxAge < 0 {
+		return nil, fmt.Errorf("cors.max-age must not be negative: %d", p.MaxAge)
+	}
+
+	return p, nil
+}
+
+func (p *CORSPolicy) allowOrigin(origin string) bool {
+	if p.AllowAllOrigins {
+		return true
+	}
+
+	origin = strings.ToLower(origin)
+	for _, o := range p.AllowedOrigins {
+		if origin == o {
+			return true
+		}
+	}
+
+	return p.allowWildcardOrigin(origin)
+}
+
+// allowWildcardOrigin returns true if origin matches one of p.WildcardOrigins. origin must be lower case.
+func (p *CORSPolicy) allowWildcardOrigin(origin string) bool {
+	for _, w := range p.WildcardOrigins {
+		prefix, suffix := w[0], w[1]
+		if len(origin) > len(prefix)+len(suffix) && strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) {
+			// The wildcard matches one or more whole subdomains.
+			subdomain := origin[len(prefix) : len(origin)-len(suffix)]
+			if !strings.ContainsAny(subdomain, "/:@?#") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (p *CORSPolicy) allowMethod(method string) bool {
+	for _, m := range p.AllowedMethods {
+		if method == m {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *CORSPolicy) allowHeaders(headers []string) bool {
+	if p.AllowAllHeaders {
+		return true
+	}
+
+	for _, h := range headers {
+		allowed := false
+		for _, ah := range p.AllowedHeaders {
+			if http.CanonicalHeaderKey(h) == ah {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+
+	return true
+}
+
+// setOriginHeaders sets the headers that allow origin to read the response.
+func (p *CORSPolicy) setOriginHeaders(w http.ResponseWriter, origin string) {
+	if p.AllowAllOrigins {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	} else {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+	if p.AllowCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// trustedOrigins returns the hosts of the exact allowed origins. The CSRF middleware trusts a Referer from these hosts.
+// Wildcard origins are trusted with csrfWithWildcardOrigins.
+func (p *CORSPolicy) trustedOrigins() []string {
+	var hosts []string
+	for _, origin := range p.AllowedOrigins {
+		if u, err := url.Parse(origin); err == nil {
+			hosts = append(hosts, u.Host)
+		}
+	}
+	return hosts
+}
+
+// csrfWithWildcardOrigins makes the CSRF check of csrfFunc trust a Referer from a wildcard origin of policies.
+// gorilla/csrf only trusts a Referer with the same origin as the request or with the exact host of a trusted origin.
+// For the check the Referer of a request from a wildcard origin is replaced with the origin of the request. The
+// handler sees the original Referer.
+func csrfWithWildcardOrigins(policies []*CORSPolicy, csrfFunc func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	var wildcardPolicies []*CORSPolicy
+	for _, p := range policies {
+		if len(p.WildcardOrigins) > 0 {
+			wildcardPolicies = append(wildcardPolicies, p)
+		}
+	}
+	if len(wildcardPolicies) == 0 {
+		return csrfFunc
+	}
+
+	trustsReferer := func(referer string) bool {
+		u, err := url.Parse(referer)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return false
+		}
+		origin := strings.ToLower(u.Scheme + "://" + u.Host)
+		for _, p := range wildcardPolicies {
+			if p.allowWildcardOrigin(origin) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return func(h http.Handler) http.Handler {
+		csrfHandler := csrfFunc(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if referer, ok := r.Context().Value(csrfRefererCtxKey).(string); ok {
+				r.Header.Set("Referer", referer)
+			}
+			h.ServeHTTP(w, r)
+		}))
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// gorilla/csrf only checks the Referer of HTTPS requests.
+			if r.URL.Scheme == "https" && trustsReferer(r.Referer()) {
+				referer := r.Referer()
+				r = r.WithContext(context.WithValue(r.Context(), csrfRefererCtxKey, referer))
+				r.Header = r.Header.Clone()
+				r.Header.Set("Referer", (&url.URL{Scheme: r.URL.Scheme, Host: r.URL.Host}).String())
+			}
+
+			csrfHandler.ServeHTTP(w, r)
+		})
+	}
+}
+
+// corsHandler adds the CORS headers to the responses of Handler. It must wrap every other middleware so error responses
+// such as a failed CSRF check can be read by the client.
+type corsHandler struct {
+	Policy  *CORSPolicy
+	Handler http.Handler
+}
+
+func (h *corsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		w.Header().Add("Vary", "Origin")
+		if h.Policy.allowOrigin(origin) {
+			h.Policy.setOriginHeaders(w, origin)
+			if len(h.Policy.ExposedHeaders) > 0 {
+				w.Header().Set("Access-Control-Expose-Headers", strings.Join(h.Policy.ExposedHeaders, ", "))
+			}
+		}
+	}
+
+	h.Handler.ServeHTTP(w, r)
+}
+
+// corsPreflightHandler answers the OPTIONS requests for a path. Policies are the CORS policies of the routes of the
+// path by method. A route that matches every method is stored with the empty method. A nil policy means the route does
+// not allow cross-origin requests. OPTIONS requests that are not preflight requests are passed to the route that
+// matches every method.
+type corsPreflightHandler struct {
+	Policies map[string]*CORSPolicy
+	Handler  http.Handler
+}
+
+func (h *corsPreflightHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	method := r.Header.Get("Access-Control-Request-Method")
+	if origin == "" || method == "" {
+		if h.Handler != nil {
+			h.Handler.ServeHTTP(w, r)
+			return
+		}
+
+		methods := []string{http.MethodOptions}
+		for m := range h.Policies {
+			methods = append(methods, m)
+		}
+		sort.Strings(methods)
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Add("Vary", "Origin")
+	w.Header().Add("Vary", "Access-Control-Request-Method")
+	w.Header().Add("Vary", "Access-Control-Request-Headers")
+
+	policy, ok := h.Policies[method]
+	if !ok {
+		policy = h.Policies[""]
+		if policy != nil && !policy.allowMethod(method) {
+			policy = nil
+		}
+	}
+
+	var requestHeaders []string
+	for _, s := range strings.Split(r.Header.Get("Access-Control-Request-Headers"), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			requestHeaders = append(requestHeaders, s)
+		}
+	}
+
+	// A preflight request that is not allowed gets a response without CORS headers. The browser will not send the
+	// actual request.
+	if policy == nil || !policy.allowOrigin(origin) || !policy.allowHeaders(requestHeaders) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	policy.setOriginHeaders(w, origin)
+	w.Header().Set("Access-Control-Allow-Methods", method)
+	if len(requestHeaders) > 0 {
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(requestHeaders, ", "))
+	}
+	if policy.MaxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(policy.MaxAge))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
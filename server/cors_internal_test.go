@@ -0,0 +1,254 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/csrf"
+	"github.com/jackc/hannibal/appconf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewCORSPolicyFromAppConfig(t *testing.T) {
+	p, err := newCORSPolicyFromAppConfig(&appconf.CORS{AllowedOrigins: []string{"https://app.example.com", "https://*.example.net"}}, "X-CSRF-Token")
+	require.NoError(t, err)
+	assert.Equal(t, &CORSPolicy{
+		AllowedOrigins:  []string{"https://app.example.com"},
+		WildcardOrigins: [][2]string{{"https://", ".example.net"}},
+		AllowedMethods:  defaultCORSMethods,
+		AllowedHeaders:  []string{"Content-Type", "X-Csrf-Token"},
+	}, p)
+	assert.Equal(t, []string{"app.example.com"}, p.trustedOrigins())
+
+	p, err = newCORSPolicyFromAppConfig(&appconf.CORS{
+		AllowedOrigins:   []string{"http://localhost:8080/"},
+		AllowedMethods:   []string{"get", "put"},
+		AllowedHeaders:   []string{"authorization"},
+		ExposedHeaders:   []string{"x-request-id"},
+		AllowCredentials: true,
+		MaxAge:           600,
+	}, "X-CSRF-Token")
+	require.NoError(t, err)
+	assert.Equal(t, &CORSPolicy{
+		AllowedOrigins:   []string{"http://localhost:8080"},
+		AllowedMethods:   []string{"GET", "PUT"},
+		AllowedHeaders:   []string{"Authorization"},
+		ExposedHeaders:   []string{"X-Request-Id"},
+		AllowCredentials: true,
+		MaxAge:           600,
+	}, p)
+
+	for _, tt := range []struct {
+		config    *appconf.CORS
+		errString string
+	}{
+		{config: &appconf.CORS{}, errString: "cors requires allowed-origins"},
+		{config: &appconf.CORS{AllowedOrigins: []string{"example.com"}}, errString: "bad cors.allowed-origins value: example.com"},
+		{config: &appconf.CORS{AllowedOrigins: []string{"https://example.com/app"}}, errString: "bad cors.allowed-origins value: https://example.com/app"},
+		{config: &appconf.CORS{AllowedOrigins: []string{"https://app.*.com"}}, errString: "bad cors.allowed-origins value: https://app.*.com"},
+		{config: &appconf.CORS{AllowedOrigins: []string{"*"}, AllowCredentials: true}, errString: "cors.allowed-origins * cannot be used with allow-credentials"},
+		{config: &appconf.CORS{AllowedOrigins: []string{"https://example.com"}, AllowedHeaders: []string{"*"}, AllowCredentials: true}, errString: "cors.allowed-headers * cannot be used with allow-credentials"},
+		{config: &appconf.CORS{AllowedOrigins: []string{"https://example.com"}, MaxAge: -1}, errString: "cors.max-age must not be negative: -1"},
+	} {
+		_, err := newCORSPolicyFromAppConfig(tt.config, "X-CSRF-Token")
+		assert.EqualError(t, err, tt.errString)
+	}
+}
+
+func TestCORSPolicyAllowOrigin(t *testing.T) {
+	p, err := newCORSPolicyFromAppConfig(&appconf.CORS{AllowedOrigins: []string{"https://app.example.com", "https://*.example.net"}}, "X-CSRF-Token")
+	require.NoError(t, err)
+
+	for _, tt := range []struct {
+		origin  string
+		allowed bool
+	}{
+		{origin: "https://app.example.com", allowed: true},
+		{origin: "HTTPS://APP.EXAMPLE.COM", allowed: true},
+		{origin: "http://app.example.com", allowed: false},
+		{origin: "https://other.example.com", allowed: false},
+		{origin: "https://app.example.net", allowed: true},
+		{origin: "https://a.b.example.net", allowed: true},
+		{origin: "https://example.net", allowed: false},
+		{origin: "https://.example.net", allowed: false},
+		{origin: "https://evilexample.net", allowed: false},
+		{origin: "https://evil.com/.example.net", allowed: false},
+		{origin: "null", allowed: false},
+	} {
+		assert.Equalf(t, tt.allowed, p.allowOrigin(tt.origin), "%s", tt.origin)
+	}
+
+	p, err = newCORSPolicyFromAppConfig(&appconf.CORS{AllowedOrigins: []string{"*"}}, "X-CSRF-Token")
+	require.NoError(t, err)
+	assert.True(t, p.allowOrigin("https://anywhere.example.org"))
+}
+
+func TestCORSHandler(t *testing.T) {
+	p, err := newCORSPolicyFromAppConfig(&appconf.CORS{
+		AllowedOrigins:   []string{"https://app.example.com"},
+		ExposedHeaders:   []string{"X-Request-Id"},
+		AllowCredentials: true,
+	}, "X-CSRF-Token")
+	require.NoError(t, err)
+
+	handler := &corsHandler{
+		Policy: p,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+		}),
+	}
+
+	// Error responses from inner middleware can be read by allowed origins.
+	r := httptest.NewRequest("POST", "/", nil)
+	r.Header.Set("Origin", "https://app.example.com")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", w.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Equal(t, "X-Request-Id", w.Header().Get("Access-Control-Expose-Headers"))
+	assert.Equal(t, "Origin", w.Header().Get("Vary"))
+
+	r = httptest.NewRequest("POST", "/", nil)
+	r.Header.Set("Origin", "https://evil.example.com")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, "", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "Origin", w.Header().Get("Vary"))
+}
+
+func TestCORSPreflightHandler(t *testing.T) {
+	p, err := newCORSPolicyFromAppConfig(&appconf.CORS{AllowedOrigins: []string{"https://app.example.com"}, MaxAge: 600}, "X-CSRF-Token")
+	require.NoError(t, err)
+
+	handler := &corsPreflightHandler{
+		Policies: map[string]*CORSPolicy{
+			http.MethodPost:   p,
+			http.MethodDelete: nil,
+		},
+	}
+
+	for _, tt := range []struct {
+		desc           string
+		origin         string
+		method         string
+		requestHeaders string
+		status         int
+		allowOrigin    string
+		allowHeaders   string
+		allow          string
+	}{
+		{
+			desc:           "allowed",
+			origin:         "https://app.example.com",
+			method:         "POST",
+			requestHeaders: "content-type, x-csrf-token",
+			status:         http.StatusNoContent,
+			allowOrigin:    "https://app.example.com",
+			allowHeaders:   "content-type, x-csrf-token",
+		},
+		{
+			desc:   "origin not allowed",
+			origin: "https://evil.example.com",
+			method: "POST",
+			status: http.StatusNoContent,
+		},
+		{
+			desc:           "header not allowed",
+			origin:         "https://app.example.com",
+			method:         "POST",
+			requestHeaders: "X-Other",
+			status:         http.StatusNoContent,
+		},
+		{
+			desc:   "route without cors",
+			origin: "https://app.example.com",
+			method: "DELETE",
+			status: http.StatusNoContent,
+		},
+		{
+			desc:   "method without route",
+			origin: "https://app.example.com",
+			method: "PUT",
+			status: http.StatusNoContent,
+		},
+		{
+			desc:   "not a preflight request",
+			status: http.StatusMethodNotAllowed,
+			allow:  "DELETE, OPTIONS, POST",
+		},
+	} {
+		r := httptest.NewRequest("OPTIONS", "/", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if tt.method != "" {
+			r.Header.Set("Access-Control-Request-Method", tt.method)
+		}
+		if tt.requestHeaders != "" {
+			r.Header.Set("Access-Control-Request-Headers", tt.requestHeaders)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		assert.Equalf(t, tt.status, w.Code, tt.desc)
+		assert.Equalf(t, tt.allowOrigin, w.Header().Get("Access-Control-Allow-Origin"), tt.desc)
+		assert.Equalf(t, tt.allowHeaders, w.Header().Get("Access-Control-Allow-Headers"), tt.desc)
+		assert.Equalf(t, tt.allow, w.Header().Get("Allow"), tt.desc)
+		if tt.allowOrigin != "" {
+			assert.Equalf(t, tt.method, w.Header().Get("Access-Control-Allow-Methods"), tt.desc)
+			assert.Equalf(t, "600", w.Header().Get("Access-Control-Max-Age"), tt.desc)
+		}
+	}
+
+	// A route that matches every method allows the configured methods.
+	handler = &corsPreflightHandler{Policies: map[string]*CORSPolicy{"": p}}
+	for method, allowOrigin := range map[string]string{"GET": "https://app.example.com", "PATCH": ""} {
+		r := httptest.NewRequest("OPTIONS", "/", nil)
+		r.Header.Set("Origin", "https://app.example.com")
+		r.Header.Set("Access-Control-Request-Method", method)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		assert.Equalf(t, allowOrigin, w.Header().Get("Access-Control-Allow-Origin"), method)
+	}
+}
+
+func TestCSRFWithWildcardOrigins(t *testing.T) {
+	p, err := newCORSPolicyFromAppConfig(&appconf.CORS{AllowedOrigins: []string{"https://*.example.com"}}, "X-CSRF-Token")
+	require.NoError(t, err)
+
+	var referer string
+	handler := csrfWithWildcardOrigins([]*CORSPolicy{p}, csrf.Protect(bytes.Repeat([]byte("k"), 32)))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		referer = r.Referer()
+		w.Write([]byte(csrf.Token(r)))
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "https://api.example.org/", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	token := w.Body.String()
+	cookies := w.Result().Cookies()
+
+	post := func(referer string) int {
+		r := httptest.NewRequest("POST", "https://api.example.org/todos", nil)
+		r.Header.Set("Origin", "https://spa.example.com")
+		r.Header.Set("Referer", referer)
+		r.Header.Set("X-CSRF-Token", token)
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, post("https://spa.example.com/page"))
+	assert.Equal(t, "https://spa.example.com/page", referer)
+
+	assert.Equal(t, http.StatusForbidden, post("https://evil.example.net/page"))
+	assert.Equal(t, http.StatusForbidden, post("http://spa.example.com/page"))
+	assert.Equal(t, http.StatusForbidden, post("https://example.com/page"))
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/jackc/hannibal/db"
+	"github.com/jackc/pgx/v4"
+)
+
+// DBIdentity sets the database role and settings the functions of a route are called with. This allows PostgreSQL
+// row-level security policies to restrict the data a request can access. It applies to every function called for the
+// request including stream, event stream, and WebSocket functions, the CSRF error function, the authenticate
+// function, and rate limit key functions.
+//
+// Func is called before the route function as the database user of the app. It returns json or jsonb such as
+// {"role": "app_user", "settings": {"app.user_id": "42"}}. A role returned by Func takes precedence over Role. The
+// settings are set with set_config and can be read by policies with current_setting. A null result uses Role and no
+// settings. The role and settings are local to the transaction the function is called in.
+type DBIdentity struct {
+	Role string
+	Func *sqlFuncCall
+}
+
+func newDBIdentityFromAppConfig(ctx context.Context, dbconn db.DBConn, schema string, role string, identifyFunc string) (*DBIdentity, error) {
+	if role == "" && identifyFunc == "" {
+		return nil, nil
+	}
+
+	i := &DBIdentity{Role: role}
+
+	if role != "" {
+		var exists bool
+		err := dbconn.QueryRow(ctx, "select exists(select 1 from pg_roles where rolname = $1)", role).Scan(&exists)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, fmt.Errorf("db-role %s does not exist", role)
+		}
+	}
+
+	if identifyFunc != "" {
+		callName, inArgs, _, err := getSQLFuncArgs(ctx, dbconn, schema, identifyFunc)
+		if err != nil {
+			return nil, err
+		}
+
+		// Request params have not been parsed when the function is called.
+		for _, name := range []string{"args", "raw_args"} {
+			if _, ok := inArgs[name]; ok {
+				return nil, fmt.Errorf("identify-func %s cannot have %s in argument", identifyFunc, name)
+			}
+		}
+
+		i.Func, err = newSQLFuncCall(callName, inArgs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build call for function %s: %v", identifyFunc, err)
+		}
+	}
+
+	return i, nil
+}
+
+// apply sets the role and settings for the request of sqlArgs. conn must be in a transaction.
+func (i *DBIdentity) apply(ctx context.Context, conn db.DBConn, sqlArgs *httpSQLArgs) error {
+	role := i.Role
+	var settings json.RawMessage
+
+	if i.Func != nil {
+		var identity []byte
+		err := conn.QueryRow(ctx, i.Func.SQL, buildHTTPSQLArgs(i.Func.FuncInArgs, sqlArgs)...).Scan(&identity)
+		if err != nil {
+			return err
+		}
+
+		if identity != nil && string(identity) != "null" {
+			var v struct {
+				Role     *string         `json:"role"`
+				Settings json.RawMessage `json:"settings"`
+			}
+			err = json.Unmarshal(identity, &v)
+			if err != nil {
+				return fmt.Errorf("bad identify-func result: %v", err)
+			}
+
+			if v.Role != nil {
+				role = *v.Role
+			}
+			settings = v.Settings
+		}
+	}
+
+	if role != "" {
+		_, err := conn.Exec(ctx, "set local role "+pgx.Identifier{role}.Sanitize())
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(settings) > 0 && string(settings) != "null" {
+		_, err := conn.Exec(ctx, "select set_config(key, value, true) from jsonb_each_text($1::jsonb)", string(settings))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// run calls f with a connection that has the role and settings of i for the request of sqlArgs. The role and settings
+// are local to a transaction so f is called in a transaction that is committed if f succeeds. A nil i calls f with the
+// app connection.
+func (i *DBIdentity) run(ctx context.Context, sqlArgs *httpSQLArgs, f func(conn db.DBConn) error) error {
+	if i == nil {
+		return f(db.App(ctx))
+	}
+
+	tx, err := db.App(ctx).Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	err = i.apply(ctx, tx, sqlArgs)
+	if err != nil {
+		return err
+	}
+
+	err = f(tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// withDBIdentity returns middleware that makes i the database identity of requests.
+func withDBIdentity(i *DBIdentity) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), dbIdentityCtxKey, i)))
+		})
+	}
+}
+
+// contextDBIdentity returns the database identity of the request of ctx or nil if it does not have one.
+func contextDBIdentity(ctx context.Context) *DBIdentity {
+	i, _ := ctx.Value(dbIdentityCtxKey).(*DBIdentity)
+	return i
+}
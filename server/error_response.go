@@ -0,0 +1,155 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/csrf"
+	"github.com/jackc/hannibal/appconf"
+	"github.com/jackc/pgconn"
+)
+
+// ErrorResponse maps PostgreSQL errors to an HTTP response.
+//
+// Code is a SQLSTATE pattern. An 'x' matches any character so 23xxx matches every integrity constraint violation.
+// An empty Code matches any error. If Hint is not empty the error's hint must equal it.
+type ErrorResponse struct {
+	Code     string
+	Hint     string
+	Status   int
+	Template *template.Template
+	JSON     bool
+}
+
+func errorResponseFromAppConfig(acer *appconf.ErrorResponse, tmpl *template.Template) (*ErrorResponse, error) {
+	er := &ErrorResponse{
+		Code:   acer.Code,
+		Hint:   acer.Hint,
+		Status: acer.Status,
+		JSON:   acer.JSON,
+	}
+
+	// A two character code is a SQLSTATE class.
+	if len(er.Code) == 2 {
+		er.Code += "xxx"
+	}
+	if er.Code != "" && len(er.Code) != 5 {
+		return nil, fmt.Errorf("code must be a 5 character SQLSTATE or a 2 character class: %s", acer.Code)
+	}
+
+	if er.Status < 100 || er.Status > 599 {
+		return nil, fmt.Errorf("status must be between 100 and 599: %d", er.Status)
+	}
+
+	if acer.Template != "" {
+		if acer.JSON {
+			return nil, errors.New("cannot have both template and json")
+		}
+		er.Template = tmpl.Lookup(acer.Template)
+		if er.Template == nil {
+			return nil, fmt.Errorf("template not found: %s", acer.Template)
+		}
+	}
+
+	return er, nil
+}
+
+func errorResponsesFromAppConfig(acers []*appconf.ErrorResponse, tmpl *template.Template) ([]*ErrorResponse, error) {
+	ers := make([]*ErrorResponse, len(acers))
+	for i, acer := range acers {
+		var err error
+		ers[i], err = errorResponseFromAppConfig(acer, tmpl)
+		if err != nil {
+			return nil, fmt.Errorf("error response %d: %v", i, err)
+		}
+	}
+
+	return ers, nil
+}
+
+// Match returns true if er applies to pgErr.
+func (er *ErrorResponse) Match(pgErr *pgconn.PgError) bool {
+	if len(er.Code) != 0 {
+		if len(pgErr.Code) != len(er.Code) {
+			return false
+		}
+		for i := 0; i < len(er.Code); i++ {
+			if er.Code[i] != 'x' && er.Code[i] != pgErr.Code[i] {
+				return false
+			}
+		}
+	}
+
+	if er.Hint != "" && er.Hint != pgErr.Hint {
+		return false
+	}
+
+	return true
+}
+
+// findErrorResponse returns the first of ers that matches err. It returns nil if err is not a *pgconn.PgError or no
+// error response matches.
+func findErrorResponse(ers []*ErrorResponse, err error) (*ErrorResponse, *pgconn.PgError) {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return nil, nil
+	}
+
+	for _, er := range ers {
+		if er.Match(pgErr) {
+			return er, pgErr
+		}
+	}
+
+	return nil, nil
+}
+
+func (er *ErrorResponse) ServeError(w http.ResponseWriter, r *http.Request, pgErr *pgconn.PgError) {
+	data := map[string]interface{}{
+		"code":    pgErr.Code,
+		"message": pgErr.Message,
+	}
+	for k, v := range map[string]string{
+		"detail":         pgErr.Detail,
+		"hint":           pgErr.Hint,
+		"schemaName":     pgErr.SchemaName,
+		"tableName":      pgErr.TableName,
+		"columnName":     pgErr.ColumnName,
+		"constraintName": pgErr.ConstraintName,
+	} {
+		if v != "" {
+			data[k] = v
+		}
+	}
+
+	switch {
+	case er.Template != nil:
+		data["csrfField"] = csrf.TemplateField(r)
+
+		buf := &bytes.Buffer{}
+		err := er.Template.Execute(buf, data)
+		if err != nil {
+			panic(err)
+		}
+
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(er.Status)
+		w.Write(buf.Bytes())
+	case er.JSON:
+		buf, err := json.Marshal(data)
+		if err != nil {
+			panic(err)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(er.Status)
+		w.Write(buf)
+	default:
+		http.Error(w, strings.TrimSpace(pgErr.Message), er.Status)
+	}
+}
@@ -0,0 +1,65 @@
+package server_test
+
+import (
+	"testing"
+
+	"github.com/jackc/hannibal/server"
+	"github.com/jackc/pgconn"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorResponseMatch(t *testing.T) {
+	for _, tt := range []struct {
+		desc  string
+		er    *server.ErrorResponse
+		pgErr *pgconn.PgError
+		match bool
+	}{
+		{
+			desc:  "exact code",
+			er:    &server.ErrorResponse{Code: "23505", Status: 409},
+			pgErr: &pgconn.PgError{Code: "23505"},
+			match: true,
+		},
+		{
+			desc:  "different code",
+			er:    &server.ErrorResponse{Code: "23505", Status: 409},
+			pgErr: &pgconn.PgError{Code: "23503"},
+			match: false,
+		},
+		{
+			desc:  "class",
+			er:    &server.ErrorResponse{Code: "23xxx", Status: 422},
+			pgErr: &pgconn.PgError{Code: "23503"},
+			match: true,
+		},
+		{
+			desc:  "custom code pattern",
+			er:    &server.ErrorResponse{Code: "HN4xx", Status: 400},
+			pgErr: &pgconn.PgError{Code: "HN404"},
+			match: true,
+		},
+		{
+			desc:  "code and hint",
+			er:    &server.ErrorResponse{Code: "P0001", Hint: "http:404", Status: 404},
+			pgErr: &pgconn.PgError{Code: "P0001", Hint: "http:404"},
+			match: true,
+		},
+		{
+			desc:  "code and different hint",
+			er:    &server.ErrorResponse{Code: "P0001", Hint: "http:404", Status: 404},
+			pgErr: &pgconn.PgError{Code: "P0001"},
+			match: false,
+		},
+		{
+			desc:  "any code",
+			er:    &server.ErrorResponse{Status: 500},
+			pgErr: &pgconn.PgError{Code: "XX000"},
+			match: true,
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			assert.Equal(t, tt.match, tt.er.Match(tt.pgErr))
+		})
+	}
+}
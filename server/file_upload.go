@@ -0,0 +1,404 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jackc/hannibal/appconf"
+	"github.com/jackc/hannibal/current"
+	"github.com/jackc/hannibal/db"
+	"github.com/jackc/pgx/v4"
+)
+
+const (
+	// FileStorageInline encodes the body of an upload in base64 in the args.
+	FileStorageInline = iota
+
+	// FileStorageLargeObject streams an upload into a PostgreSQL large object and passes its OID.
+	FileStorageLargeObject
+
+	// FileStorageDisk streams an upload into a content-addressed directory and passes its SHA-256 hash. The file is
+	// stored at <upload path>/<first two characters of hash>/<hash>.
+	FileStorageDisk
+)
+
+// maxMultipartValueBytes is the maximum total size of the non-file values of a multipart form.
+const maxMultipartValueBytes = 10 << 20
+
+// uploadedFile is an upload with FileStorageInline.
+type uploadedFile struct {
+	Filename    string `json:"filename"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type"`
+	Body        string `json:"body"`
+}
+
+// storedFile is an upload with FileStorageLargeObject or FileStorageDisk.
+type storedFile struct {
+	Filename    string `json:"filename"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type"`
+	OID         uint32 `json:"oid,omitempty"`
+	Hash        string `json:"hash,omitempty"`
+}
+
+// rejectedFile is an upload that was not stored because it violated the max size or accept restrictions of its
+// param.
+type rejectedFile struct {
+	Filename string `json:"filename"`
+	err      *ParamError
+}
+
+func requestParamFileStorageFromAppConfig(rp *RequestParam, acrp *appconf.RequestParam) error {
+	if acrp.Storage == "" && acrp.MaxSize == 0 && acrp.Accept == nil {
+		return nil
+	}
+
+	if rp.Type != RequestParamTypeFile {
+		return errors.New("storage, max-size, and accept require type file")
+	}
+
+	switch acrp.Storage {
+	case "", "inline":
+		rp.Storage = FileStorageInline
+	case "large-object":
+		rp.Storage = FileStorageLargeObject
+	case "disk":
+		rp.Storage = FileStorageDisk
+	default:
+		return fmt.Errorf("unknown storage: %s", acrp.Storage)
+	}
+
+	if acrp.MaxSize < 0 {
+		return errors.New("max-size must not be negative")
+	}
+	rp.MaxSize = acrp.MaxSize
+
+	for _, mediaType := range acrp.Accept {
+		if !strings.Contains(mediaType, "/") {
+			return fmt.Errorf("bad accept MIME type: %s", mediaType)
+		}
+	}
+	rp.Accept = acrp.Accept
+
+	return nil
+}
+
+// acceptsMediaType returns true if mediaType matches one of the MIME types in accept. An accept entry such as image/*
+// matches all subtypes. An empty accept matches everything.
+func acceptsMediaType(accept []string, mediaType string) bool {
+	if len(accept) == 0 {
+		return true
+	}
+
+	for _, a := range accept {
+		if strings.HasSuffix(a, "/*") {
+			if strings.HasPrefix(mediaType, a[:len(a)-1]) {
+				return true
+			}
+		} else if a == mediaType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// extractMultipartArgs streams the parts of a multipart form into rawArgs. File parts are stored according to the
+// param of the same name so large uploads are never held in memory. Only the first file of each name is used.
+func extractMultipartArgs(r *http.Request, rawArgs map[string]interface{}, params []*RequestParam, uploadPath string) error {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return err
+	}
+
+	values := url.Values{}
+	files := make(map[string]interface{})
+	var valueBytes int64
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		name := part.FormName()
+		if name == "" {
+			continue
+		}
+
+		if part.FileName() == "" {
+			buf, err := ioutil.ReadAll(io.LimitReader(part, maxMultipartValueBytes-valueBytes+1))
+			if err != nil {
+				return err
+			}
+			valueBytes += int64(len(buf))
+			if valueBytes > maxMultipartValueBytes {
+				return errors.New("multipart form values too large")
+			}
+			values.Add(name, string(buf))
+			continue
+		}
+
+		if _, ok := files[name]; ok {
+			continue
+		}
+
+		rp := findRequestParam(params, name)
+		if rp == nil {
+			rp = &RequestParam{Name: name, Type: RequestParamTypeFile}
+		}
+
+		files[name], err = storeUpload(r.Context(), part, rp, uploadPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	setFormValues(rawArgs, values, params)
+	for name, file := range files {
+		rawArgs[name] = file
+	}
+
+	return nil
+}
+
+// storeUpload stores the file part according to rp.
+func storeUpload(ctx context.Context, part *multipart.Part, rp *RequestParam, uploadPath string) (interface{}, error) {
+	br := bufio.NewReaderSize(part, 512)
+	sniff, err := br.Peek(512)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, err
+	}
+
+	contentType, _, err := mime.ParseMediaType(http.DetectContentType(sniff))
+	if err != nil {
+		return nil, err
+	}
+
+	if !acceptsMediaType(rp.Accept, contentType) {
+		return &rejectedFile{
+			Filename: part.FileName(),
+			err:      &ParamError{Code: ParamErrorAccept, Message: fmt.Sprintf("%s is not accepted", contentType)},
+		}, nil
+	}
+
+	var src io.Reader = br
+	if rp.MaxSize > 0 {
+		// Read one byte past the limit to detect uploads that are too large.
+		src = io.LimitReader(br, rp.MaxSize+1)
+	}
+	tooLarge := func(size int64) bool {
+		return rp.MaxSize > 0 && size > rp.MaxSize
+	}
+
+	var upload interface{}
+	var size int64
+	switch rp.Storage {
+	case FileStorageLargeObject:
+		var oid uint32
+		oid, size, err = storeLargeObject(ctx, src, tooLarge)
+		upload = &storedFile{Filename: part.FileName(), Size: size, ContentType: contentType, OID: oid}
+
+	case FileStorageDisk:
+		if uploadPath == "" {
+			return nil, errors.New("disk storage requires an upload path")
+		}
+		var hash string
+		hash, size, err = storeOnDisk(src, uploadPath, tooLarge)
+		upload = &storedFile{Filename: part.FileName(), Size: size, ContentType: contentType, Hash: hash}
+
+	default:
+		// To decode in PostgreSQL use decode and convert_from functions:
+		// decode(args -> 'file' ->> 'body', 'base64') --> decoded bytes
+		// convert_from(decode(args -> 'file' ->> 'body', 'base64'), 'UTF8') --> decoded bytes converted to text
+		var body []byte
+		body, err = ioutil.ReadAll(src)
+		size = int64(len(body))
+		upload = &uploadedFile{
+			Filename:    part.FileName(),
+			Size:        size,
+			ContentType: contentType,
+			Body:        base64.StdEncoding.EncodeToString(body),
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if tooLarge(size) {
+		return &rejectedFile{
+			Filename: part.FileName(),
+			err:      &ParamError{Code: ParamErrorMaxSize, Message: fmt.Sprintf("must be at most %d bytes", rp.MaxSize)},
+		}, nil
+	}
+
+	return upload, nil
+}
+
+// storeLargeObject copies src into a new large object in its own transaction. The large object is discarded if
+// discard returns true for the number of bytes copied.
+func storeLargeObject(ctx context.Context, src io.Reader, discard func(size int64) bool) (oid uint32, size int64, err error) {
+	tx, err := db.App(ctx).Begin(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	los := tx.LargeObjects()
+	oid, err = los.Create(ctx, 0)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	lo, err := los.Open(ctx, oid, pgx.LargeObjectModeWrite)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	size, err = io.Copy(lo, src)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if discard(size) {
+		return 0, size, nil
+	}
+
+	err = lo.Close()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return oid, size, nil
+}
+
+// storeOnDisk copies src into the content-addressed directory uploadPath. The file is discarded if discard returns
+// true for the number of bytes copied.
+func storeOnDisk(src io.Reader, uploadPath string, discard func(size int64) bool) (hash string, size int64, err error) {
+	err = os.MkdirAll(uploadPath, 0755)
+	if err != nil {
+		return "", 0, err
+	}
+
+	tmpFile, err := ioutil.TempFile(uploadPath, ".upload-*")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	digest := sha256.New()
+	size, err = io.Copy(io.MultiWriter(tmpFile, digest), src)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if discard(size) {
+		return "", size, nil
+	}
+
+	err = tmpFile.Close()
+	if err != nil {
+		return "", 0, err
+	}
+
+	hash = hex.EncodeToString(digest.Sum(nil))
+	dir := filepath.Join(uploadPath, hash[:2])
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", 0, err
+	}
+
+	// The path is determined by the contents so if the file already exists it is identical.
+	err = os.Rename(tmpFile.Name(), filepath.Join(dir, hash))
+	if err != nil {
+		return "", 0, err
+	}
+
+	return hash, size, nil
+}
+
+// unlinkLargeObjects deletes the large objects uploaded for a request. It is used when the request fails so the
+// uploads are not orphaned.
+func unlinkLargeObjects(ctx context.Context, rawArgs map[string]interface{}) {
+	for _, v := range rawArgs {
+		if sf, ok := v.(*storedFile); ok && sf.OID != 0 {
+			_, err := db.App(ctx).Exec(ctx, "select lo_unlink($1)", sf.OID)
+			if err != nil {
+				current.Logger(ctx).Error().Caller().Err(err).Uint32("oid", sf.OID).Msg("failed to unlink large object")
+			}
+		}
+	}
+}
+
+// replayableBody preserves a request body so it can be read more than once. Multipart bodies are spooled to a
+// temporary file so uploads are not held in memory.
+type replayableBody struct {
+	buf  []byte
+	file *os.File
+	size int64
+}
+
+func newReplayableBody(r *http.Request) (*replayableBody, error) {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		buf, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		return &replayableBody{buf: buf}, nil
+	}
+
+	file, err := ioutil.TempFile("", "hannibal-body-*")
+	if err != nil {
+		return nil, err
+	}
+	b := &replayableBody{file: file}
+
+	b.size, err = io.Copy(file, r.Body)
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// Reader returns a new reader of the entire body.
+func (b *replayableBody) Reader() io.ReadCloser {
+	if b.file == nil {
+		return ioutil.NopCloser(bytes.NewReader(b.buf))
+	}
+	return ioutil.NopCloser(io.NewSectionReader(b.file, 0, b.size))
+}
+
+func (b *replayableBody) Close() error {
+	if b.file == nil {
+		return nil
+	}
+	b.file.Close()
+	return os.Remove(b.file.Name())
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAcceptsMediaType(t *testing.T) {
+	for i, tt := range []struct {
+		accept    []string
+		mediaType string
+		accepted  bool
+	}{
+		{accept: nil, mediaType: "image/png", accepted: true},
+		{accept: []string{"image/png"}, mediaType: "image/png", accepted: true},
+		{accept: []string{"image/png"}, mediaType: "image/jpeg", accepted: false},
+		{accept: []string{"image/*"}, mediaType: "image/jpeg", accepted: true},
+		{accept: []string{"image/*"}, mediaType: "imagex/jpeg", accepted: false},
+		{accept: []string{"text/plain", "application/pdf"}, mediaType: "application/pdf", accepted: true},
+	} {
+		assert.Equalf(t, tt.accepted, acceptsMediaType(tt.accept, tt.mediaType), "%d", i)
+	}
+}
+
+func TestExtractMultipartArgs(t *testing.T) {
+	pngData := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 100)...)
+
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	require.NoError(t, mw.WriteField("name", "Jack"))
+	require.NoError(t, mw.WriteField("tags", "a"))
+	require.NoError(t, mw.WriteField("tags", "b"))
+	fw, err := mw.CreateFormFile("notes", "notes.txt")
+	require.NoError(t, err)
+	_, err = fw.Write([]byte("hello world"))
+	require.NoError(t, err)
+	fw, err = mw.CreateFormFile("avatar", "avatar.png")
+	require.NoError(t, err)
+	_, err = fw.Write(pngData)
+	require.NoError(t, err)
+	fw, err = mw.CreateFormFile("big", "big.txt")
+	require.NoError(t, err)
+	_, err = fw.Write([]byte(strings.Repeat("x", 20)))
+	require.NoError(t, err)
+	fw, err = mw.CreateFormFile("image", "image.txt")
+	require.NoError(t, err)
+	_, err = fw.Write([]byte("not an image"))
+	require.NoError(t, err)
+	require.NoError(t, mw.Close())
+
+	r := httptest.NewRequest("POST", "/", body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+
+	params := []*RequestParam{
+		{Name: "tags", Type: RequestParamTypeArray},
+		{Name: "avatar", Type: RequestParamTypeFile, Storage: FileStorageDisk, Accept: []string{"image/*"}},
+		{Name: "big", Type: RequestParamTypeFile, MaxSize: 10},
+		{Name: "image", Type: RequestParamTypeFile, Accept: []string{"image/*"}},
+	}
+
+	uploadPath := t.TempDir()
+	rawArgs := make(map[string]interface{})
+	err = extractMultipartArgs(r, rawArgs, params, uploadPath)
+	require.NoError(t, err)
+
+	assert.Equal(t, "Jack", rawArgs["name"])
+	assert.Equal(t, []interface{}{"a", "b"}, rawArgs["tags"])
+
+	assert.Equal(t, &uploadedFile{
+		Filename:    "notes.txt",
+		Size:        11,
+		ContentType: "text/plain",
+		Body:        "aGVsbG8gd29ybGQ=",
+	}, rawArgs["notes"])
+
+	digest := sha256.Sum256(pngData)
+	hash := hex.EncodeToString(digest[:])
+	assert.Equal(t, &storedFile{
+		Filename:    "avatar.png",
+		Size:        int64(len(pngData)),
+		ContentType: "image/png",
+		Hash:        hash,
+	}, rawArgs["avatar"])
+	storedData, err := ioutil.ReadFile(filepath.Join(uploadPath, hash[:2], hash))
+	require.NoError(t, err)
+	assert.Equal(t, pngData, storedData)
+
+	_, err = params[2].Parse(rawArgs["big"])
+	assert.Equal(t, ParamErrorMaxSize, paramErrorCode(err))
+
+	_, err = params[3].Parse(rawArgs["image"])
+	assert.Equal(t, ParamErrorAccept, paramErrorCode(err))
+
+	// Only the stored file remains in the upload path.
+	entries, err := ioutil.ReadDir(uploadPath)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, hash[:2], entries[0].Name())
+}
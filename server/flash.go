@@ -0,0 +1,60 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/securecookie"
+)
+
+const flashCookieName = "hannibal-flash"
+
+// readFlash reads the flash message from r. Any errors are ignored and the flash message is treated as missing.
+func (h *Host) readFlash(r *http.Request) []byte {
+	var flash []byte
+	if cookie, err := r.Cookie(flashCookieName); err == nil {
+		securecookie.DecodeMulti(flashCookieName, cookie.Value, &flash, h.cookieCodecs...)
+	}
+	return flash
+}
+
+// setFlash stores flash to be read by the next request. A nil flash clears the flash message. The flash cookie has the
+// same domain, secure, and same-site attributes as the session cookie of r.
+func (h *Host) setFlash(w http.ResponseWriter, r *http.Request, flash []byte) {
+	cookie := *h.requestSessionStore(r).sessionCookie()
+	cookie.name = flashCookieName
+	cookie.maxAge = 0 // The flash message only lives until the next request.
+
+	var value string
+	if flash != nil {
+		var err error
+		value, err = securecookie.EncodeMulti(flashCookieName, flash, h.cookieCodecs...)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	http.SetCookie(w, cookie.new(value))
+}
+
+// isSafeRedirect returns true if location is a path on the same host. Locations such as //example.com and
+// /\example.com are rejected because browsers treat them as references to another host. Browsers also remove control
+// characters such as tab before resolving a location so they are rejected anywhere as is a backslash.
+func isSafeRedirect(location string) bool {
+	if !strings.HasPrefix(location, "/") || strings.HasPrefix(location, "//") {
+		return false
+	}
+
+	for i := 0; i < len(location); i++ {
+		if c := location[i]; c < 0x20 || c == 0x7f || c == '\\' {
+			return false
+		}
+	}
+
+	u, err := url.Parse(location)
+	if err != nil {
+		return false
+	}
+	return u.Scheme == "" && u.Host == ""
+}
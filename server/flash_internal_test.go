@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jackc/hannibal/current"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetFlashUsesSessionCookieAttributes(t *testing.T) {
+	ctx := current.WithSecretKeyBase(context.Background(), strings.Repeat("a", 64))
+	host := &Host{cookieCodecs: newCookieCodecs(ctx)}
+	store := &cookieSessionStore{
+		codecs: host.cookieCodecs,
+		cookie: &sessionCookie{name: "app-session", domain: "example.com", secure: true, sameSite: http.SameSiteLaxMode, maxAge: 3600},
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r = r.WithContext(context.WithValue(r.Context(), sessionStoreCtxKey, store))
+
+	w := httptest.NewRecorder()
+	host.setFlash(w, r, []byte(`"Saved!"`))
+	cookies := w.Result().Cookies()
+	require.Len(t, cookies, 1)
+	assert.Equal(t, flashCookieName, cookies[0].Name)
+	assert.Equal(t, "example.com", cookies[0].Domain)
+	assert.True(t, cookies[0].Secure)
+	assert.True(t, cookies[0].HttpOnly)
+	assert.Equal(t, http.SameSiteLaxMode, cookies[0].SameSite)
+	assert.Equal(t, 0, cookies[0].MaxAge)
+
+	r.AddCookie(cookies[0])
+	assert.Equal(t, []byte(`"Saved!"`), host.readFlash(r))
+
+	w = httptest.NewRecorder()
+	host.setFlash(w, r, nil)
+	cookies = w.Result().Cookies()
+	require.Len(t, cookies, 1)
+	assert.Equal(t, flashCookieName, cookies[0].Name)
+	assert.Equal(t, -1, cookies[0].MaxAge)
+	assert.True(t, cookies[0].Secure)
+}
+
+func TestIsSafeRedirect(t *testing.T) {
+	for i, tt := range []struct {
+		location string
+		safe     bool
+	}{
+		{location: "/", safe: true},
+		{location: "/todos", safe: true},
+		{location: "/todos?id=1#top", safe: true},
+		{location: "/todos//1", safe: true},
+		{location: "", safe: false},
+		{location: "todos", safe: false},
+		{location: "//example.com", safe: false},
+		{location: `/\example.com`, safe: false},
+		{location: "https://example.com/", safe: false},
+		{location: "javascript:alert(1)", safe: false},
+		{location: "/todos\r\nSet-Cookie: a=b", safe: false},
+		{location: "/\t/example.com", safe: false},
+		{location: "/\n/example.com", safe: false},
+		{location: "/\x00/example.com", safe: false},
+		{location: "/\x7f/example.com", safe: false},
+		{location: "/todos\\..\\example.com", safe: false},
+		{location: "/todos/%2F%2Fexample.com", safe: true},
+	} {
+		assert.Equalf(t, tt.safe, isSafeRedirect(tt.location), "%d: %s", i, tt.location)
+	}
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// setFormValues sets the query string or form values in rawArgs.
+//
+// A key that is repeated is an array if the param of the same name has type array. Otherwise only the first value is
+// used.
+//
+// Keys may use bracket notation to build nested objects and arrays. e.g. address[city]=Dallas is
+// {"address": {"city": "Dallas"}}, tag[]=a&tag[]=b is {"tag": ["a", "b"]}, and items[0][name]=foo is
+// {"items": [{"name": "foo"}]}. Numeric indexes only determine the order of array elements.
+func setFormValues(rawArgs map[string]interface{}, values url.Values, params []*RequestParam) {
+	var bracketKeys []string
+	for key, vs := range values {
+		if _, _, ok := parseBracketKey(key); ok {
+			bracketKeys = append(bracketKeys, key)
+			continue
+		}
+
+		if rp := findRequestParam(params, key); rp != nil && rp.Type == RequestParamTypeArray {
+			a := make([]interface{}, len(vs))
+			for i, v := range vs {
+				a[i] = v
+			}
+			rawArgs[key] = a
+		} else {
+			rawArgs[key] = vs[0]
+		}
+	}
+
+	if bracketKeys == nil {
+		return
+	}
+
+	// Sort so the result does not depend on map iteration order.
+	sort.Strings(bracketKeys)
+
+	nested := make(map[string]interface{})
+	for _, key := range bracketKeys {
+		name, path, _ := parseBracketKey(key)
+		vs := values[key]
+
+		var value interface{}
+		if path[len(path)-1] == "" {
+			a := make([]interface{}, len(vs))
+			for i, v := range vs {
+				a[i] = v
+			}
+			value = a
+			path = path[:len(path)-1]
+		} else {
+			value = vs[0]
+		}
+
+		if len(path) == 0 {
+			nested[name] = value
+			continue
+		}
+
+		m, ok := nested[name].(map[string]interface{})
+		if !ok {
+			m = make(map[string]interface{})
+			nested[name] = m
+		}
+		for _, segment := range path[:len(path)-1] {
+			child, ok := m[segment].(map[string]interface{})
+			if !ok {
+				child = make(map[string]interface{})
+				m[segment] = child
+			}
+			m = child
+		}
+		m[path[len(path)-1]] = value
+	}
+
+	for name, value := range nested {
+		rawArgs[name] = indexedMapsToArrays(value)
+	}
+}
+
+// parseBracketKey splits a key such as items[0][name] into the name items and the path ["0", "name"]. A trailing []
+// is an empty path segment. ok is false if key does not use bracket notation or [] is not at the end.
+func parseBracketKey(key string) (name string, path []string, ok bool) {
+	open := strings.IndexByte(key, '[')
+	if open <= 0 || !strings.HasSuffix(key, "]") {
+		return "", nil, false
+	}
+
+	name = key[:open]
+	rest := key[open:]
+	for rest != "" {
+		if rest[0] != '[' {
+			return "", nil, false
+		}
+		end := strings.IndexByte(rest, ']')
+		if end == -1 {
+			return "", nil, false
+		}
+		segment := rest[1:end]
+		if strings.ContainsAny(segment, "[") {
+			return "", nil, false
+		}
+		path = append(path, segment)
+		rest = rest[end+1:]
+	}
+
+	for _, segment := range path[:len(path)-1] {
+		if segment == "" {
+			return "", nil, false
+		}
+	}
+
+	return name, path, true
+}
+
+// indexedMapsToArrays converts maps where every key is a non-negative integer to arrays ordered by key.
+func indexedMapsToArrays(value interface{}) interface{} {
+	m, ok := value.(map[string]interface{})
+	if !ok {
+		return value
+	}
+
+	for k, v := range m {
+		m[k] = indexedMapsToArrays(v)
+	}
+
+	indexes := make([]int, 0, len(m))
+	byIndex := make(map[int]interface{}, len(m))
+	for k, v := range m {
+		n, err := strconv.Atoi(k)
+		if err != nil || n < 0 {
+			return m
+		}
+		indexes = append(indexes, n)
+		byIndex[n] = v
+	}
+	sort.Ints(indexes)
+
+	a := make([]interface{}, len(indexes))
+	for i, n := range indexes {
+		a[i] = byIndex[n]
+	}
+	return a
+}
+
+func findRequestParam(params []*RequestParam, name string) *RequestParam {
+	for _, rp := range params {
+		if rp.Name == name {
+			return rp
+		}
+	}
+	return nil
+}
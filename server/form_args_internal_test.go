@@ -0,0 +1,84 @@
+package server
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetFormValues(t *testing.T) {
+	params := []*RequestParam{
+		{Name: "tag", Type: RequestParamTypeArray},
+		{Name: "name", Type: RequestParamTypeText},
+	}
+
+	for i, tt := range []struct {
+		query    string
+		expected map[string]interface{}
+	}{
+		{
+			query:    "name=foo&name=bar",
+			expected: map[string]interface{}{"name": "foo"},
+		},
+		{
+			query:    "tag=a&tag=b",
+			expected: map[string]interface{}{"tag": []interface{}{"a", "b"}},
+		},
+		{
+			query:    "tag=a",
+			expected: map[string]interface{}{"tag": []interface{}{"a"}},
+		},
+		{
+			query:    "color[]=red&color[]=blue",
+			expected: map[string]interface{}{"color": []interface{}{"red", "blue"}},
+		},
+		{
+			query: "address[city]=Dallas&address[state]=TX",
+			expected: map[string]interface{}{
+				"address": map[string]interface{}{"city": "Dallas", "state": "TX"},
+			},
+		},
+		{
+			query: "items[1][name]=bar&items[0][name]=foo&items[0][qty]=2",
+			expected: map[string]interface{}{
+				"items": []interface{}{
+					map[string]interface{}{"name": "foo", "qty": "2"},
+					map[string]interface{}{"name": "bar"},
+				},
+			},
+		},
+		{
+			query: "items[10]=b&items[2]=a",
+			expected: map[string]interface{}{
+				"items": []interface{}{"a", "b"},
+			},
+		},
+		{
+			query: "user[address][city]=Dallas&user[tags][]=a&user[tags][]=b",
+			expected: map[string]interface{}{
+				"user": map[string]interface{}{
+					"address": map[string]interface{}{"city": "Dallas"},
+					"tags":    []interface{}{"a", "b"},
+				},
+			},
+		},
+		{
+			query: "a[b=1&a][=2&[a]=3&a[][b]=4",
+			expected: map[string]interface{}{
+				"a[b":    "1",
+				"a][":    "2",
+				"[a]":    "3",
+				"a[][b]": "4",
+			},
+		},
+	} {
+		values, err := url.ParseQuery(tt.query)
+		require.NoErrorf(t, err, "%d", i)
+
+		rawArgs := make(map[string]interface{})
+		setFormValues(rawArgs, values, params)
+		assert.Equalf(t, tt.expected, rawArgs, "%d: %s", i, tt.query)
+	}
+}
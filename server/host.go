@@ -2,7 +2,6 @@ package server
 
 import (
 	"context"
-	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -14,9 +13,11 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/Masterminds/sprig/v3"
 	"github.com/gorilla/securecookie"
+	"github.com/gorilla/websocket"
 	"github.com/jackc/hannibal/appconf"
 	"github.com/jackc/hannibal/current"
 	"github.com/jackc/hannibal/db"
@@ -32,23 +33,45 @@ type Host struct {
 	HTTPListenAddr string
 	AppPath        string
 
+	// UploadPath is the directory for file params with disk storage.
+	UploadPath string
+
 	httpServer   *http.Server
 	deployMutex  sync.Mutex
 	installMutex sync.RWMutex
 	appHandler   http.Handler
 
-	secureCookie *securecookie.SecureCookie
+	cookieCodecs []securecookie.Codec
 
 	deployColor  srvman.Color
 	serviceGroup *srvman.Group
+
+	notifyListenerMutex sync.Mutex
+	notifyListener      *notifyListener
+
+	webSocketsMutex sync.Mutex
+	webSockets      map[*websocket.Conn]struct{}
+
+	sessionSweeperMutex sync.Mutex
+	sessionSweeperStop  chan struct{}
 }
 
+type ctxKey int
+
+const (
+	_ ctxKey = iota
+	releaseInstallLockCtxKey
+	principalCtxKey
+	sessionStoreCtxKey
+	clientIPCtxKey
+	dbIdentityCtxKey
+	csrfRefererCtxKey
+)
+
 func (h *Host) ListenAndServe() error {
 	log := *current.Logger(context.Background())
 
-	cookieHashKey := sha256.Sum256([]byte(current.SecretKeyBase(context.Background()) + "cookie hash key"))
-	cookieBlockKey := sha256.Sum256([]byte(current.SecretKeyBase(context.Background()) + "cookie block key"))
-	h.secureCookie = securecookie.New(cookieHashKey[:], cookieBlockKey[:16])
+	h.cookieCodecs = newCookieCodecs(context.Background())
 
 	r := BaseMux(log)
 
@@ -61,13 +84,17 @@ func (h *Host) ListenAndServe() error {
 
 	r.Mount("/", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		h.installMutex.RLock()
-		defer h.installMutex.RUnlock()
+		var releaseOnce sync.Once
+		release := func() { releaseOnce.Do(h.installMutex.RUnlock) }
+		defer release()
 
+		req = req.WithContext(context.WithValue(req.Context(), releaseInstallLockCtxKey, release))
 		h.appHandler.ServeHTTP(w, req)
 	}))
 
 	if h.AppPath != "" {
-		r.Post("/hannibal-system/deploy", h.handleDeploy)
+		// The deploy route is not part of an app so no proxies are trusted.
+		r.With(withClientIP(nil)).Post("/hannibal-system/deploy", h.handleDeploy)
 	}
 
 	h.httpServer = &http.Server{
@@ -83,7 +110,62 @@ func (h *Host) ListenAndServe() error {
 	return nil
 }
 
+// releaseInstallLock releases the lock on the installed app that is held while a request is served. Long-lived
+// requests such as event streams call this so they do not block loading or deploying a new version of the app.
+func releaseInstallLock(r *http.Request) {
+	if release, ok := r.Context().Value(releaseInstallLockCtxKey).(func()); ok {
+		release()
+	}
+}
+
+// getNotifyListener returns the listener shared by all event stream routes. It is started on first use.
+func (h *Host) getNotifyListener(ctx context.Context) *notifyListener {
+	h.notifyListenerMutex.Lock()
+	defer h.notifyListenerMutex.Unlock()
+
+	if h.notifyListener == nil {
+		h.notifyListener = newNotifyListener(db.GetConfig(ctx).AppConnString)
+	}
+
+	return h.notifyListener
+}
+
+// trackWebSocket registers conn to be closed when h is shut down. The HTTP server does not track hijacked connections.
+func (h *Host) trackWebSocket(conn *websocket.Conn) {
+	h.webSocketsMutex.Lock()
+	defer h.webSocketsMutex.Unlock()
+
+	if h.webSockets == nil {
+		h.webSockets = make(map[*websocket.Conn]struct{})
+	}
+	h.webSockets[conn] = struct{}{}
+}
+
+func (h *Host) untrackWebSocket(conn *websocket.Conn) {
+	h.webSocketsMutex.Lock()
+	defer h.webSocketsMutex.Unlock()
+
+	delete(h.webSockets, conn)
+}
+
 func (h *Host) Shutdown(ctx context.Context) error {
+	// Closing the notify listener ends any event streams. Otherwise they would prevent the HTTP server from shutting
+	// down.
+	h.notifyListenerMutex.Lock()
+	if h.notifyListener != nil {
+		h.notifyListener.Close()
+	}
+	h.notifyListenerMutex.Unlock()
+
+	h.webSocketsMutex.Lock()
+	for conn := range h.webSockets {
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(time.Second))
+		conn.Close()
+	}
+	h.webSocketsMutex.Unlock()
+
+	h.stopSessionSweeper()
+
 	eg, ctx := errgroup.WithContext(ctx)
 	eg.Go(func() error {
 		h.httpServer.SetKeepAlivesEnabled(false)
@@ -0,0 +1,244 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jackc/hannibal/current"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+)
+
+// notifySubscriptionBufferSize is the number of notifications that can be queued for a subscriber. If a subscriber
+// falls further behind notifications for it are dropped.
+const notifySubscriptionBufferSize = 64
+
+// notifyListener multiplexes PostgreSQL LISTEN for any number of subscribers over a single dedicated connection.
+type notifyListener struct {
+	connString string
+
+	mutex         sync.Mutex
+	subscriptions map[string]map[*notifySubscription]struct{}
+	closed        bool
+
+	// wake interrupts waiting for a notification so the set of listened to channels can be updated.
+	wake   chan struct{}
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+type notifySubscription struct {
+	channels []string
+
+	// C receives notifications for any of channels. It is closed when the listener is closed.
+	C chan *pgconn.Notification
+
+	// Listening is closed once the listener is listening on all of channels. Notifications sent before then may be
+	// missed.
+	Listening     chan struct{}
+	listeningOnce sync.Once
+}
+
+func (sub *notifySubscription) markListening() {
+	sub.listeningOnce.Do(func() { close(sub.Listening) })
+}
+
+func newNotifyListener(connString string) *notifyListener {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	l := &notifyListener{
+		connString:    connString,
+		subscriptions: make(map[string]map[*notifySubscription]struct{}),
+		wake:          make(chan struct{}, 1),
+		cancel:        cancel,
+		done:          make(chan struct{}),
+	}
+
+	go l.run(ctx)
+
+	return l
+}
+
+// Subscribe returns a subscription to channels. The caller must call Unsubscribe when finished with it.
+func (l *notifyListener) Subscribe(channels []string) *notifySubscription {
+	sub := &notifySubscription{
+		channels:  channels,
+		C:         make(chan *pgconn.Notification, notifySubscriptionBufferSize),
+		Listening: make(chan struct{}),
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.closed {
+		close(sub.C)
+		sub.markListening()
+		return sub
+	}
+
+	for _, channel := range channels {
+		subs, ok := l.subscriptions[channel]
+		if !ok {
+			subs = make(map[*notifySubscription]struct{})
+			l.subscriptions[channel] = subs
+		}
+		subs[sub] = struct{}{}
+	}
+
+	l.signalWake()
+
+	return sub
+}
+
+func (l *notifyListener) Unsubscribe(sub *notifySubscription) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for _, channel := range sub.channels {
+		if subs, ok := l.subscriptions[channel]; ok {
+			delete(subs, sub)
+			if len(subs) == 0 {
+				delete(l.subscriptions, channel)
+			}
+		}
+	}
+
+	l.signalWake()
+}
+
+// Close stops listening and closes all subscriptions.
+func (l *notifyListener) Close() {
+	l.cancel()
+	<-l.done
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.closed = true
+	closedSubs := make(map[*notifySubscription]struct{})
+	for _, subs := range l.subscriptions {
+		for sub := range subs {
+			if _, ok := closedSubs[sub]; !ok {
+				close(sub.C)
+				sub.markListening()
+				closedSubs[sub] = struct{}{}
+			}
+		}
+	}
+	l.subscriptions = nil
+}
+
+// signalWake must be called with mutex held.
+func (l *notifyListener) signalWake() {
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (l *notifyListener) run(ctx context.Context) {
+	defer close(l.done)
+
+	for {
+		err := l.listen(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		current.Logger(ctx).Error().Caller().Err(err).Msg("notify listener failed")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (l *notifyListener) listen(ctx context.Context) error {
+	conn, err := pgx.Connect(ctx, l.connString)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	listening := make(map[string]struct{})
+
+	for {
+		l.mutex.Lock()
+		wanted := make(map[string]struct{}, len(l.subscriptions))
+		var subs []*notifySubscription
+		for channel, channelSubs := range l.subscriptions {
+			wanted[channel] = struct{}{}
+			for sub := range channelSubs {
+				subs = append(subs, sub)
+			}
+		}
+		l.mutex.Unlock()
+
+		for channel := range wanted {
+			if _, ok := listening[channel]; !ok {
+				_, err := conn.Exec(ctx, "listen "+pgx.Identifier{channel}.Sanitize())
+				if err != nil {
+					return err
+				}
+				listening[channel] = struct{}{}
+			}
+		}
+
+		for channel := range listening {
+			if _, ok := wanted[channel]; !ok {
+				_, err := conn.Exec(ctx, "unlisten "+pgx.Identifier{channel}.Sanitize())
+				if err != nil {
+					return err
+				}
+				delete(listening, channel)
+			}
+		}
+
+		for _, sub := range subs {
+			sub.markListening()
+		}
+
+		waitCtx, cancelWait := context.WithCancel(ctx)
+		wakeWatcherDone := make(chan struct{})
+		go func() {
+			defer close(wakeWatcherDone)
+			select {
+			case <-l.wake:
+				cancelWait()
+			case <-waitCtx.Done():
+			}
+		}()
+
+		notification, err := conn.WaitForNotification(waitCtx)
+		cancelWait()
+		// Ensure the watcher cannot consume a wake signal meant for the next iteration.
+		<-wakeWatcherDone
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			// Waiting was interrupted to update the listened to channels. The connection is still usable.
+			if !conn.IsClosed() {
+				continue
+			}
+			return err
+		}
+
+		l.dispatch(ctx, notification)
+	}
+}
+
+func (l *notifyListener) dispatch(ctx context.Context, notification *pgconn.Notification) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for sub := range l.subscriptions[notification.Channel] {
+		select {
+		case sub.C <- notification:
+		default:
+			current.Logger(ctx).Warn().Str("channel", notification.Channel).Msg("dropped notification for slow subscriber")
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+
+	"github.com/jackc/hannibal/appconf"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	PasswordAlgorithmBcrypt   = "bcrypt"
+	PasswordAlgorithmScrypt   = "scrypt"
+	PasswordAlgorithmArgon2id = "argon2id"
+)
+
+const (
+	passwordSaltLength = 16
+	passwordKeyLength  = 32
+
+	// maxPasswordHashMemory is the most memory in bytes that hashing one password may use. maxPasswordHashIterations
+	// is the most argon2id iterations. Digests are also read from the database so the parameters of a digest must not
+	// be able to exhaust the server.
+	maxPasswordHashMemory     = 1 << 30
+	maxPasswordHashIterations = 1024
+)
+
+// passwordHashSlots limits the number of passwords being hashed at once. Hashing is deliberately expensive and a
+// flood of requests would otherwise exhaust the CPU and memory of the server.
+var passwordHashSlots = make(chan struct{}, runtime.NumCPU())
+
+// acquirePasswordHashSlot waits for a free slot. The returned function must be called to release it.
+func acquirePasswordHashSlot(ctx context.Context) (func(), error) {
+	select {
+	case passwordHashSlots <- struct{}{}:
+		return func() { <-passwordHashSlots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// PasswordHasher digests passwords with Algorithm. Only the parameters used by Algorithm are set.
+//
+// bcrypt uses Cost. scrypt uses Cost as the base 2 logarithm of N, BlockSize as r, and Parallelism as p. argon2id uses
+// Memory in KiB, Iterations, and Parallelism.
+type PasswordHasher struct {
+	Algorithm   string
+	Cost        int
+	BlockSize   int
+	Memory      uint32
+	Iterations  uint32
+	Parallelism int
+}
+
+func newPasswordHasherFromAppConfig(acph appconf.PasswordHash) (*PasswordHasher, error) {
+	h := &PasswordHasher{Algorithm: strings.ToLower(acph.Algorithm)}
+
+	switch h.Algorithm {
+	case "", PasswordAlgorithmBcrypt:
+		h.Algorithm = PasswordAlgorithmBcrypt
+		h.Cost = bcrypt.DefaultCost
+		if acph.Cost != 0 {
+			h.Cost = acph.Cost
+		}
+	case PasswordAlgorithmScrypt:
+		h.Cost = 15
+		if acph.Cost != 0 {
+			h.Cost = acph.Cost
+		}
+		h.BlockSize = 8
+		if acph.BlockSize != 0 {
+			h.BlockSize = acph.BlockSize
+		}
+		h.Parallelism = 1
+		if acph.Parallelism != 0 {
+			h.Parallelism = acph.Parallelism
+		}
+	case PasswordAlgorithmArgon2id:
+		h.Memory = 64 * 1024
+		if acph.Memory != 0 {
+			h.Memory = acph.Memory
+		}
+		h.Iterations = 3
+		if acph.Iterations != 0 {
+			h.Iterations = acph.Iterations
+		}
+		h.Parallelism = 4
+		if acph.Parallelism != 0 {
+			h.Parallelism = acph.Parallelism
+		}
+	default:
+		return nil, fmt.Errorf("unknown password algorithm: %s", acph.Algorithm)
+	}
+
+	err := h.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// validate returns an error if the parameters of h are out of range. It is used for both configured hashers and the
+// hashers parsed from digests.
+func (h *PasswordHasher) validate() error {
+	switch h.Algorithm {
+	case PasswordAlgorithmBcrypt:
+		if h.Cost < bcrypt.MinCost || h.Cost > bcrypt.MaxCost {
+			return fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	case PasswordAlgorithmScrypt:
+		if h.Cost < 1 || h.Cost > 30 {
+			return errors.New("scrypt cost must be between 1 and 30")
+		}
+		if h.BlockSize < 1 || h.Parallelism < 1 || uint64(h.BlockSize)*uint64(h.Parallelism) >= 1<<30 {
+			return errors.New("scrypt block-size and parallelism are too large")
+		}
+		// scrypt uses 128 * r * N bytes and 128 * r * p bytes.
+		if uint64(h.BlockSize) > maxPasswordHashMemory/128>>uint(h.Cost) || 128*uint64(h.BlockSize)*uint64(h.Parallelism) > maxPasswordHashMemory {
+			return fmt.Errorf("scrypt must not use more than %d MiB", maxPasswordHashMemory>>20)
+		}
+	case PasswordAlgorithmArgon2id:
+		if h.Parallelism < 1 || h.Parallelism > 255 {
+			return errors.New("argon2id parallelism must be between 1 and 255")
+		}
+		if h.Memory < 8*uint32(h.Parallelism) {
+			return errors.New("argon2id memory must be at least 8 KiB per thread")
+		}
+		if uint64(h.Memory)*1024 > maxPasswordHashMemory {
+			return fmt.Errorf("argon2id memory must not be more than %d KiB", maxPasswordHashMemory>>10)
+		}
+		if h.Iterations < 1 || h.Iterations > maxPasswordHashIterations {
+			return fmt.Errorf("argon2id iterations must be between 1 and %d", maxPasswordHashIterations)
+		}
+	default:
+		return fmt.Errorf("unknown password algorithm: %s", h.Algorithm)
+	}
+
+	return nil
+}
+
+// Digest returns the digest of password. bcrypt digests are in the standard modular crypt format. scrypt and argon2id
+// digests are in the PHC string format.
+func (h *PasswordHasher) Digest(ctx context.Context, password string) (string, error) {
+	release, err := acquirePasswordHashSlot(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	if h.Algorithm == PasswordAlgorithmBcrypt {
+		digest, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+		if err != nil {
+			return "", err
+		}
+		return string(digest), nil
+	}
+
+	salt := make([]byte, passwordSaltLength)
+	_, err = rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+
+	key, err := h.key(password, salt, passwordKeyLength)
+	if err != nil {
+		return "", err
+	}
+
+	return h.encode(salt, key), nil
+}
+
+// key derives a key of keyLength bytes from password and salt. It is not used for bcrypt.
+func (h *PasswordHasher) key(password string, salt []byte, keyLength int) ([]byte, error) {
+	switch h.Algorithm {
+	case PasswordAlgorithmScrypt:
+		return scrypt.Key([]byte(password), salt, 1<<h.Cost, h.BlockSize, h.Parallelism, keyLength)
+	case PasswordAlgorithmArgon2id:
+		return argon2.IDKey([]byte(password), salt, h.Iterations, h.Memory, uint8(h.Parallelism), uint32(keyLength)), nil
+	default:
+		return nil, fmt.Errorf("unknown password algorithm: %s", h.Algorithm)
+	}
+}
+
+func (h *PasswordHasher) encode(salt, key []byte) string {
+	b64 := base64.RawStdEncoding
+	switch h.Algorithm {
+	case PasswordAlgorithmScrypt:
+		return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s", h.Cost, h.BlockSize, h.Parallelism, b64.EncodeToString(salt), b64.EncodeToString(key))
+	default:
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, h.Memory, h.Iterations, h.Parallelism, b64.EncodeToString(salt), b64.EncodeToString(key))
+	}
+}
+
+// NeedsRehash reports whether digest was not computed with the algorithm and parameters of h. Digests that cannot be
+// parsed need to be rehashed.
+func (h *PasswordHasher) NeedsRehash(digest string) bool {
+	dh, _, _, err := parsePasswordDigest(digest)
+	if err != nil {
+		return true
+	}
+	return *dh != *h
+}
+
+// parsePasswordDigest returns the hasher that computed digest. salt and key are not returned for bcrypt digests.
+func parsePasswordDigest(digest string) (h *PasswordHasher, salt []byte, key []byte, err error) {
+	if strings.HasPrefix(digest, "$2") {
+		cost, err := bcrypt.Cost([]byte(digest))
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return &PasswordHasher{Algorithm: PasswordAlgorithmBcrypt, Cost: cost}, nil, nil, nil
+	}
+
+	fields := strings.Split(digest, "$")
+	h = &PasswordHasher{}
+	var params string
+
+	switch {
+	case len(fields) == 5 && fields[0] == "" && fields[1] == PasswordAlgorithmScrypt:
+		h.Algorithm = PasswordAlgorithmScrypt
+		params = fields[2]
+		_, err = fmt.Sscanf(params, "ln=%d,r=%d,p=%d", &h.Cost, &h.BlockSize, &h.Parallelism)
+	case len(fields) == 6 && fields[0] == "" && fields[1] == PasswordAlgorithmArgon2id:
+		if fields[2] != fmt.Sprintf("v=%d", argon2.Version) {
+			return nil, nil, nil, fmt.Errorf("unsupported argon2id version: %s", fields[2])
+		}
+		h.Algorithm = PasswordAlgorithmArgon2id
+		params = fields[3]
+		_, err = fmt.Sscanf(params, "m=%d,t=%d,p=%d", &h.Memory, &h.Iterations, &h.Parallelism)
+	default:
+		return nil, nil, nil, errors.New("unknown password digest format")
+	}
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("bad password digest parameters: %s", params)
+	}
+	err = h.validate()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("bad password digest parameters: %v", err)
+	}
+
+	b64 := base64.RawStdEncoding
+	salt, err = b64.DecodeString(fields[len(fields)-2])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	key, err = b64.DecodeString(fields[len(fields)-1])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if len(key) == 0 {
+		return nil, nil, nil, errors.New("password digest is missing key")
+	}
+
+	return h, salt, key, nil
+}
+
+// comparePasswordDigest reports whether password matches digest. The algorithm is detected from digest. A digest that
+// cannot be parsed never matches. err is only returned if ctx is canceled while waiting to hash.
+func comparePasswordDigest(ctx context.Context, digest string, password string) (bool, error) {
+	h, salt, key, err := parsePasswordDigest(digest)
+	if err != nil {
+		return false, nil
+	}
+
+	release, err := acquirePasswordHashSlot(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer release()
+
+	if h.Algorithm == PasswordAlgorithmBcrypt {
+		return bcrypt.CompareHashAndPassword([]byte(digest), []byte(password)) == nil, nil
+	}
+
+	computed, err := h.key(password, salt, len(key))
+	if err != nil {
+		return false, nil
+	}
+
+	return subtle.ConstantTimeCompare(computed, key) == 1, nil
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/jackc/hannibal/appconf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPasswordHasherDigest(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tt := range []struct {
+		config appconf.PasswordHash
+		prefix string
+	}{
+		{config: appconf.PasswordHash{Cost: 4}, prefix: "$2a$04$"},
+		{config: appconf.PasswordHash{Algorithm: "scrypt", Cost: 4}, prefix: "$scrypt$ln=4,r=8,p=1$"},
+		{config: appconf.PasswordHash{Algorithm: "argon2id", Memory: 64, Iterations: 1, Parallelism: 1}, prefix: "$argon2id$v=19$m=64,t=1,p=1$"},
+	} {
+		h, err := newPasswordHasherFromAppConfig(tt.config)
+		require.NoError(t, err)
+
+		digest, err := h.Digest(ctx, "secret")
+		require.NoError(t, err)
+		assert.Truef(t, strings.HasPrefix(digest, tt.prefix), "%s does not have prefix %s", digest, tt.prefix)
+		assert.False(t, h.NeedsRehash(digest))
+
+		valid, err := comparePasswordDigest(ctx, digest, "secret")
+		require.NoError(t, err)
+		assert.Truef(t, valid, "%s", h.Algorithm)
+
+		valid, err = comparePasswordDigest(ctx, digest, "wrong")
+		require.NoError(t, err)
+		assert.Falsef(t, valid, "%s", h.Algorithm)
+	}
+}
+
+func TestPasswordHasherNeedsRehash(t *testing.T) {
+	ctx := context.Background()
+
+	bcrypt4, err := newPasswordHasherFromAppConfig(appconf.PasswordHash{Cost: 4})
+	require.NoError(t, err)
+	bcrypt5, err := newPasswordHasherFromAppConfig(appconf.PasswordHash{Cost: 5})
+	require.NoError(t, err)
+	argon2id, err := newPasswordHasherFromAppConfig(appconf.PasswordHash{Algorithm: "argon2id", Memory: 64, Iterations: 1, Parallelism: 1})
+	require.NoError(t, err)
+	argon2idMoreMemory, err := newPasswordHasherFromAppConfig(appconf.PasswordHash{Algorithm: "argon2id", Memory: 128, Iterations: 1, Parallelism: 1})
+	require.NoError(t, err)
+
+	bcryptDigest, err := bcrypt4.Digest(ctx, "secret")
+	require.NoError(t, err)
+	argon2idDigest, err := argon2id.Digest(ctx, "secret")
+	require.NoError(t, err)
+
+	assert.False(t, bcrypt4.NeedsRehash(bcryptDigest))
+	assert.True(t, bcrypt5.NeedsRehash(bcryptDigest))
+	assert.True(t, argon2id.NeedsRehash(bcryptDigest))
+	assert.False(t, argon2id.NeedsRehash(argon2idDigest))
+	assert.True(t, argon2idMoreMemory.NeedsRehash(argon2idDigest))
+	assert.True(t, bcrypt4.NeedsRehash(argon2idDigest))
+	assert.True(t, bcrypt4.NeedsRehash("not found"))
+}
+
+func TestComparePasswordDigestMalformed(t *testing.T) {
+	ctx := context.Background()
+
+	for _, digest := range []string{
+		"",
+		"not found",
+		"$argon2id$v=19$m=64,t=1,p=1$c2FsdA",
+		"$argon2id$v=18$m=64,t=1,p=1$c2FsdA$a2V5",
+		"$scrypt$ln=x,r=8,p=1$c2FsdA$a2V5",
+		"$scrypt$ln=4,r=8,p=1$c2FsdA$",
+		"$scrypt$ln=-1,r=8,p=1$c2FsdA$a2V5",
+		"$scrypt$ln=30,r=8,p=1$c2FsdA$a2V5",
+		"$scrypt$ln=4,r=8,p=100000000$c2FsdA$a2V5",
+		"$scrypt$ln=4,r=0,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=4294967295,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=64,t=4294967295,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=64,t=0,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=64,t=1,p=0$c2FsdA$a2V5",
+	} {
+		valid, err := comparePasswordDigest(ctx, digest, "secret")
+		require.NoErrorf(t, err, "%q", digest)
+		assert.Falsef(t, valid, "%q", digest)
+	}
+}
+
+func TestParsePasswordDigestLimits(t *testing.T) {
+	_, _, _, err := parsePasswordDigest("$scrypt$ln=-1,r=8,p=1$c2FsdA$a2V5")
+	assert.EqualError(t, err, "bad password digest parameters: scrypt cost must be between 1 and 30")
+
+	_, _, _, err = parsePasswordDigest("$argon2id$v=19$m=4294967295,t=1,p=1$c2FsdA$a2V5")
+	assert.EqualError(t, err, "bad password digest parameters: argon2id memory must not be more than 1048576 KiB")
+}
+
+func TestNewPasswordHasherFromAppConfig(t *testing.T) {
+	h, err := newPasswordHasherFromAppConfig(appconf.PasswordHash{})
+	require.NoError(t, err)
+	assert.Equal(t, &PasswordHasher{Algorithm: PasswordAlgorithmBcrypt, Cost: 10}, h)
+
+	h, err = newPasswordHasherFromAppConfig(appconf.PasswordHash{Algorithm: "Argon2id"})
+	require.NoError(t, err)
+	assert.Equal(t, &PasswordHasher{Algorithm: PasswordAlgorithmArgon2id, Memory: 64 * 1024, Iterations: 3, Parallelism: 4}, h)
+
+	h, err = newPasswordHasherFromAppConfig(appconf.PasswordHash{Algorithm: "scrypt"})
+	require.NoError(t, err)
+	assert.Equal(t, &PasswordHasher{Algorithm: PasswordAlgorithmScrypt, Cost: 15, BlockSize: 8, Parallelism: 1}, h)
+
+	for _, tt := range []struct {
+		config    appconf.PasswordHash
+		errString string
+	}{
+		{config: appconf.PasswordHash{Algorithm: "md5"}, errString: "unknown password algorithm: md5"},
+		{config: appconf.PasswordHash{Cost: 40}, errString: "bcrypt cost must be between 4 and 31"},
+		{config: appconf.PasswordHash{Algorithm: "scrypt", Cost: 31}, errString: "scrypt cost must be between 1 and 30"},
+		{config: appconf.PasswordHash{Algorithm: "argon2id", Parallelism: 256}, errString: "argon2id parallelism must be between 1 and 255"},
+		{config: appconf.PasswordHash{Algorithm: "argon2id", Memory: 4}, errString: "argon2id memory must be at least 8 KiB per thread"},
+		{config: appconf.PasswordHash{Algorithm: "argon2id", Memory: 2 << 20}, errString: "argon2id memory must not be more than 1048576 KiB"},
+		{config: appconf.PasswordHash{Algorithm: "argon2id", Iterations: 2000}, errString: "argon2id iterations must be between 1 and 1024"},
+		{config: appconf.PasswordHash{Algorithm: "scrypt", Cost: 25}, errString: "scrypt must not use more than 1024 MiB"},
+	} {
+		_, err := newPasswordHasherFromAppConfig(tt.config)
+		assert.EqualError(t, err, tt.errString)
+	}
+}
@@ -2,14 +2,16 @@ package server
 
 import (
 	"bytes"
-	"encoding/base64"
+	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
 	"io"
-	"io/ioutil"
+	"mime"
 	"net/http"
+	"sort"
 	"strings"
 	"time"
 
@@ -19,13 +21,18 @@ import (
 	"github.com/jackc/hannibal/db"
 	"github.com/jackc/pgconn"
 	"github.com/jackc/pgtype"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/jackc/pgx/v4"
+	"github.com/shopspring/decimal"
 )
 
 var allowedInArgs = []string{
 	"args",
 	"raw_args",
 	"cookie_session",
+	"request",
+	"headers",
+	"remote_ip",
+	"principal",
 }
 
 var allowedOutArgs = []string{
@@ -35,41 +42,62 @@ var allowedOutArgs = []string{
 	"template_data",
 	"cookie_session",
 	"response_headers",
+	"resp_bytes",
+	"resp_text",
+	"content_type",
+	"filename",
+	"layout",
+	"template_block",
+	"redirect",
+	"flash",
 }
 
 type PGFuncHandler struct {
 	Params              []*RequestParam
 	DigestPassword      *DigestPassword
 	CheckPasswordDigest *CheckPasswordDigest
+	ErrorResponses      []*ErrorResponse
+	Transaction         *Transaction
+	RequestHeaders      []string
 	SQL                 string
 	FuncInArgs          []string
 	RootTemplate        *template.Template
 	Host                *Host
-}
 
-type uploadedFile struct {
-	Filename string `json:"filename"`
-	Size     int64  `json:"size"`
-	Body     string `json:"body"`
+	// ContentNegotiation enables choosing between JSON and HTML responses with the Accept header. When the client
+	// prefers JSON the template_data of a template response is sent as JSON. When the client prefers HTML and Template
+	// is set a resp_body response is rendered with Template.
+	ContentNegotiation bool
+	Template           *template.Template
+
+	// Layout wraps template responses. The rendered template is available to the layout as content.
+	Layout *template.Template
+
+	// TypedInArgs are the in arguments that are not one of allowedInArgs. Each receives the parsed value of the
+	// request param of the same name or the raw value if there is no such param. A request whose param for a typed in
+	// argument fails to parse is rejected with 400 Bad Request. InArgTypes are the PostgreSQL type
+	// names of the in arguments. json and jsonb arguments receive their value encoded as JSON.
+	TypedInArgs []string
+	InArgTypes  map[string]string
 }
 
-func extractRawArgs(r *http.Request) (map[string]interface{}, error) {
-	rawArgs := make(map[string]interface{})
-	for key, values := range r.URL.Query() {
-		rawArgs[key] = values[0]
-	}
+func extractRawArgs(r *http.Request, params []*RequestParam, uploadPath string) (map[string]interface{}, error) {
+	queryArgs := make(map[string]interface{})
+	setFormValues(queryArgs, r.URL.Query(), params)
 
+	pathArgs := make(map[string]interface{})
 	routeParams := chi.RouteContext(r.Context()).URLParams
 	for i := 0; i < len(routeParams.Keys); i++ {
-		rawArgs[routeParams.Keys[i]] = routeParams.Values[i]
+		pathArgs[routeParams.Keys[i]] = routeParams.Values[i]
 	}
 
+	bodyArgs := make(map[string]interface{})
 	contentType := r.Header.Get("Content-Type")
 	switch {
 	case contentType == "application/json":
 		decoder := json.NewDecoder(r.Body)
 		decoder.UseNumber()
-		err := decoder.Decode(&rawArgs)
+		err := decoder.Decode(&bodyArgs)
 		if err != nil {
 			return nil, err
 		}
@@ -78,43 +106,60 @@ func extractRawArgs(r *http.Request) (map[string]interface{}, error) {
 		if err != nil {
 			return nil, err
 		}
-		for key, values := range r.PostForm {
-			rawArgs[key] = values[0]
-		}
+		setFormValues(bodyArgs, r.PostForm, params)
 	case strings.HasPrefix(contentType, "multipart/form-data"):
-		err := r.ParseMultipartForm(5 * 1024 * 1024)
+		err := extractMultipartArgs(r, bodyArgs, params, uploadPath)
 		if err != nil {
 			return nil, err
 		}
-		for key, values := range r.MultipartForm.Value {
-			rawArgs[key] = values[0]
+	}
+
+	// For params without a source a body value takes precedence over a path value which takes precedence over a query
+	// value.
+	rawArgs := make(map[string]interface{}, len(queryArgs)+len(pathArgs)+len(bodyArgs))
+	for _, m := range []map[string]interface{}{queryArgs, pathArgs, bodyArgs} {
+		for k, v := range m {
+			rawArgs[k] = v
 		}
+	}
 
-		// File support is experimental. It encodes the body of the file in base64. It's not clear that this is a good
-		// idea as opposed to requiring the use of an external handler.
-		//
-		// To decode in PostgreSQL use decode and convert_from functions:
-		// decode(args -> 'file' ->> 'body', 'base64') --> decoded bytes
-		// convert_from(decode(args -> 'file' ->> 'body', 'base64'), 'UTF8') --> decoded bytes converted to text
-		for key, values := range r.MultipartForm.File {
-			fileBody, err := func() ([]byte, error) {
-				mpFile, err := values[0].Open()
-				if err != nil {
-					return nil, err
+	for _, rp := range params {
+		if rp.Source == RequestParamSourceAny {
+			continue
+		}
+
+		var value interface{}
+		var ok bool
+		switch rp.Source {
+		case RequestParamSourceQuery:
+			value, ok = queryArgs[rp.Name]
+		case RequestParamSourcePath:
+			value, ok = pathArgs[rp.Name]
+		case RequestParamSourceBody:
+			value, ok = bodyArgs[rp.Name]
+		case RequestParamSourceHeader:
+			if values := r.Header.Values(rp.SourceName); len(values) > 0 {
+				if rp.Type == RequestParamTypeArray {
+					a := make([]interface{}, len(values))
+					for i, v := range values {
+						a[i] = v
+					}
+					value, ok = a, true
+				} else {
+					value, ok = values[0], true
 				}
-				defer mpFile.Close()
-				return ioutil.ReadAll(mpFile)
-			}()
-			if err != nil {
-				return nil, err
 			}
-
-			rawArgs[key] = &uploadedFile{
-				Filename: values[0].Filename,
-				Size:     values[0].Size,
-				Body:     base64.StdEncoding.EncodeToString(fileBody),
+		case RequestParamSourceCookie:
+			if cookie, err := r.Cookie(rp.SourceName); err == nil {
+				value, ok = cookie.Value, true
 			}
 		}
+
+		if ok {
+			rawArgs[rp.Name] = value
+		} else {
+			delete(rawArgs, rp.Name)
+		}
 	}
 
 	return rawArgs, nil
@@ -123,155 +168,221 @@ func extractRawArgs(r *http.Request) (map[string]interface{}, error) {
 func (h *PGFuncHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
-	rawArgs, err := extractRawArgs(r)
+	rawArgs, err := extractRawArgs(r, h.Params, h.Host.UploadPath)
 	if err != nil {
 		panic(err)
 	}
 
-	var argErrors map[string]string
+	// Large objects uploaded for the request are only kept if the function is called successfully.
+	called := false
+	defer func() {
+		if !called {
+			unlinkLargeObjects(ctx, rawArgs)
+		}
+	}()
+
+	queryArgs := parseRequestParams(h.Params, rawArgs)
+
+	// A function without an args argument cannot see the param errors so the request is rejected. A typed in argument
+	// whose param failed to parse has no value to pass so the request is also rejected.
+	if argErrors, ok := queryArgs["__errors__"].(map[string]string); ok && len(h.TypedInArgs) > 0 && (!h.hasInArg("args") || h.hasTypedInArgError(argErrors)) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		err := json.NewEncoder(w).Encode(map[string]interface{}{"errors": argErrors})
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	requestCookieSession, err := h.Host.readCookieSession(r)
+	if err != nil {
+		logQueryError(ctx, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	sqlArgsSource := &httpSQLArgs{
+		queryArgs:      queryArgs,
+		rawArgs:        rawArgs,
+		cookieSession:  requestCookieSession,
+		request:        r,
+		requestHeaders: h.RequestHeaders,
+	}
 
-	var queryArgs map[string]interface{}
-	if len(h.Params) != 0 {
-		queryArgs = make(map[string]interface{}, len(h.Params))
-		for _, qp := range h.Params {
-			if value, err := qp.Parse(rawArgs[qp.Name]); err == nil {
-				queryArgs[qp.Name] = value
-			} else {
-				if argErrors == nil {
-					argErrors = make(map[string]string)
+	dbIdentity := contextDBIdentity(ctx)
+	transaction := h.Transaction
+	if transaction == nil && dbIdentity != nil {
+		// The role and settings are set locally so they must be in a transaction.
+		transaction = &Transaction{}
+	}
+
+	// runQuery calls query with the role and settings of the database identity of r in transaction if there is one.
+	runQuery := func(query func(conn db.DBConn) error) error {
+		withIdentity := func(conn db.DBConn) error {
+			if dbIdentity != nil {
+				err := dbIdentity.apply(ctx, conn, sqlArgsSource)
+				if err != nil {
+					return err
 				}
-				argErrors[qp.Name] = err.Error()
 			}
+			return query(conn)
 		}
 
-		if argErrors != nil {
-			queryArgs["__errors__"] = argErrors
+		if transaction != nil {
+			return transaction.Run(ctx, db.App(ctx), withIdentity)
 		}
+		return withIdentity(db.App(ctx))
 	}
 
-	// Read the cookie session. Ignore any errors and treat as missing.
-	var requestCookieSession []byte
-	if cookie, err := r.Cookie("hannibal-session"); err == nil {
-		h.Host.secureCookie.Decode("hannibal-session", cookie.Value, &requestCookieSession)
-	}
-
+	// Hashing passwords is slow. A new digest does not depend on the database so it is made before the transaction
+	// begins and a retried transaction does not hash again.
 	if h.DigestPassword != nil {
 		if password, ok := queryArgs[h.DigestPassword.PasswordParam]; ok {
 			if password, ok := password.(string); ok && password != "" {
-				passwordDigest, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+				passwordDigest, err := h.DigestPassword.Hasher.Digest(ctx, password)
 				if err != nil {
-					panic(err)
+					handleQueryError(w, r, h.ErrorResponses, err)
+					return
 				}
-				queryArgs[h.DigestPassword.DigestParam] = string(passwordDigest)
+				queryArgs[h.DigestPassword.DigestParam] = passwordDigest
 			}
 		}
 	}
 
+	var password interface{}
+	var passwordCheck passwordCheck
 	if h.CheckPasswordDigest != nil {
-		passwordInterface := queryArgs[h.CheckPasswordDigest.PasswordParam]
+		password = queryArgs[h.CheckPasswordDigest.PasswordParam]
 		delete(queryArgs, h.CheckPasswordDigest.PasswordParam)
-
-		if password, ok := passwordInterface.(string); ok {
-			sqlArgs := buildHTTPSQLArgs(h.CheckPasswordDigest.FuncInArgs, queryArgs, rawArgs, requestCookieSession)
-
-			var passwordDigest []byte
-			err = db.App(ctx).QueryRow(ctx, h.CheckPasswordDigest.SQL, sqlArgs...).Scan(
-				&passwordDigest,
-			)
-			if err != nil {
-				panic(err)
-			}
-
-			err := bcrypt.CompareHashAndPassword(passwordDigest, []byte(password))
-			queryArgs[h.CheckPasswordDigest.ResultParam] = err == nil
-		}
 	}
 
-	sqlArgs := buildHTTPSQLArgs(h.FuncInArgs, queryArgs, rawArgs, requestCookieSession)
-
 	var status pgtype.Int2
 	var respBody []byte
 	var templateName pgtype.Text
 	var templateData map[string]interface{}
 	var responseCookieSession []byte
 	var responseHeaders map[string]string
-
-	err = db.App(ctx).QueryRow(ctx, h.SQL, sqlArgs...).Scan(
-		&status,
-		&respBody,
-		&templateName,
-		&templateData,
-		&responseCookieSession,
-		&responseHeaders,
-	)
-	if err != nil {
-		// TODO - need to be able to report errors somehow
-
-		event := current.Logger(ctx).Error().Caller().Err(err)
-		var pgErr *pgconn.PgError
-		if errors.As(err, &pgErr) {
-			event.Str("pgSeverity", pgErr.Severity)
-			event.Str("pgCode", pgErr.Code)
-			event.Str("pgMessage", pgErr.Message)
-			if pgErr.Detail != "" {
-				event.Str("pgDetail", pgErr.Detail)
-			}
-			if pgErr.Hint != "" {
-				event.Str("pgHint", pgErr.Hint)
-			}
-			if pgErr.Position != 0 {
-				event.Int32("pgPosition", pgErr.Position)
-			}
-			if pgErr.InternalPosition != 0 {
-				event.Int32("pgInternalPosition", pgErr.InternalPosition)
-			}
-			if pgErr.InternalQuery != "" {
-				event.Str("pgInternalQuery", pgErr.InternalQuery)
-			}
-			if pgErr.Where != "" {
-				event.Str("pgWhere", pgErr.Where)
-			}
-			if pgErr.SchemaName != "" {
-				event.Str("pgSchemaName", pgErr.SchemaName)
-			}
-			if pgErr.TableName != "" {
-				event.Str("pgTableName", pgErr.TableName)
-			}
-			if pgErr.ColumnName != "" {
-				event.Str("pgColumnName", pgErr.ColumnName)
-			}
-			if pgErr.DataTypeName != "" {
-				event.Str("pgDataTypeName", pgErr.DataTypeName)
-			}
-			if pgErr.ConstraintName != "" {
-				event.Str("pgConstraintName", pgErr.ConstraintName)
+	var respBytes []byte
+	var layoutName pgtype.Text
+	var templateBlock pgtype.Text
+	var redirect pgtype.Text
+	var flash []byte
+	var respText pgtype.Text
+	var contentType pgtype.Text
+	var filename pgtype.Text
+
+	// query may be called more than once when the route's transaction is retried.
+	query := func(conn db.DBConn) error {
+		// The password digest is read in the same transaction as the function is called.
+		if password, ok := password.(string); ok {
+			err := h.checkPassword(ctx, conn, queryArgs, sqlArgsSource, password, &passwordCheck)
+			if err != nil {
+				return err
 			}
 		}
-		event.Send()
+
+		var err error
+		sqlArgsSource.extra, err = h.typedInArgValues(queryArgs, rawArgs)
+		if err != nil {
+			return err
+		}
+
+		sqlArgs := buildHTTPSQLArgs(h.FuncInArgs, sqlArgsSource)
+
+		return conn.QueryRow(ctx, h.SQL, sqlArgs...).Scan(
+			&status,
+			&respBody,
+			&templateName,
+			&templateData,
+			&responseCookieSession,
+			&responseHeaders,
+			&respBytes,
+			&respText,
+			&contentType,
+			&filename,
+			&layoutName,
+			&templateBlock,
+			&redirect,
+			&flash,
+		)
+	}
+
+	err = runQuery(query)
+	if err != nil {
+		handleQueryError(w, r, h.ErrorResponses, err)
+		return
+	}
+	called = true
+
+	// The function has already run but nothing has been sent. An unsafe redirect is a bug in the function.
+	if redirect.Status == pgtype.Present && !isSafeRedirect(redirect.String) {
+		current.Logger(ctx).Error().Caller().Str("redirect", redirect.String).Msg("unsafe redirect")
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	// Only send session cookie response if it has changed from the request.
+	// Only save the session if it has changed from the request.
 	if bytes.Compare(requestCookieSession, responseCookieSession) != 0 {
-		cookie := &http.Cookie{
-			Name:     "hannibal-session",
-			Path:     "/",
-			Secure:   false, // TODO - false in dev mode -- configurable in production
-			HttpOnly: true,
+		err := h.Host.writeCookieSession(w, r, responseCookieSession)
+		if err != nil {
+			logQueryError(ctx, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
 		}
+	}
 
-		if responseCookieSession != nil {
-			encoded, err := h.Host.secureCookie.Encode("hannibal-session", responseCookieSession)
-			if err != nil {
-				panic(err)
-			}
-			cookie.Value = encoded
-		} else {
-			cookie.Expires = time.Unix(0, 0)
+	if flash != nil {
+		h.Host.setFlash(w, r, flash)
+	}
+
+	if redirect.Status == pgtype.Present {
+		// status can select a different redirect such as 307 or 308.
+		redirectStatus := http.StatusSeeOther
+		if status.Status == pgtype.Present && status.Int >= 300 && status.Int <= 399 {
+			redirectStatus = int(status.Int)
 		}
 
-		http.SetCookie(w, cookie)
+		for k, v := range responseHeaders {
+			w.Header().Add(k, v)
+		}
+		http.Redirect(w, r, redirect.String, redirectStatus)
+		return
+	}
+
+	var tmpl *template.Template
+	if templateName.Status == pgtype.Present {
+		tmpl = h.RootTemplate.Lookup(templateName.String)
+		if tmpl == nil {
+			panic("template not found: " + templateName.String)
+		}
+	}
+
+	if h.ContentNegotiation {
+		w.Header().Add("Vary", "Accept")
+
+		switch preferredMediaType(r) {
+		case mediaTypeJSON:
+			if tmpl != nil {
+				if templateData == nil {
+					templateData = make(map[string]interface{})
+				}
+				respBody, err = json.Marshal(templateData)
+				if err != nil {
+					panic(err)
+				}
+				tmpl = nil
+			}
+		case mediaTypeHTML:
+			if respBody != nil && h.Template != nil {
+				templateData, err = templateDataFromRespBody(respBody)
+				if err != nil {
+					panic(err)
+				}
+				respBody = nil
+				tmpl = h.Template
+			}
+		}
 	}
 
 	var respBodyReader io.Reader
@@ -281,25 +392,92 @@ func (h *PGFuncHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		respBodyReader = bytes.NewReader(respBody)
 	}
 
-	if templateName.Status == pgtype.Present {
+	if tmpl != nil {
 		w.Header().Add("Content-Type", "text/html")
-		tmpl := h.RootTemplate.Lookup(templateName.String)
-		if tmpl == nil {
-			panic("template not found: " + templateName.String)
-		}
 
 		if templateData == nil {
 			templateData = make(map[string]interface{})
 		}
 		templateData["csrfField"] = csrf.TemplateField(r)
 
-		respWriter := &bytes.Buffer{}
-		respBodyReader = respWriter
+		// A flash message is shown once by the next rendered template. A flash message set by this response is for the
+		// next request so it must not be cleared.
+		if requestFlash := h.Host.readFlash(r); requestFlash != nil {
+			var flashData interface{}
+			if err := json.Unmarshal(requestFlash, &flashData); err == nil {
+				templateData["flash"] = flashData
+			}
+			if flash == nil {
+				h.Host.setFlash(w, r, nil)
+			}
+		}
 
+		layout := h.Layout
+		if layoutName.Status == pgtype.Present {
+			layout = nil
+			// An empty layout disables the route layout.
+			if layoutName.String != "" {
+				layout = h.RootTemplate.Lookup(layoutName.String)
+				if layout == nil {
+					panic("layout not found: " + layoutName.String)
+				}
+			}
+		}
+		if layout != nil {
+			w.Header().Add("Vary", "HX-Request")
+		}
+
+		// Render only the named block for partial page updates.
+		if templateBlock.Status == pgtype.Present {
+			tmpl = h.RootTemplate.Lookup(templateBlock.String)
+			if tmpl == nil {
+				panic("template block not found: " + templateBlock.String)
+			}
+			layout = nil
+		}
+
+		if isHTMXPartialRequest(r) {
+			layout = nil
+		}
+
+		respWriter := &bytes.Buffer{}
 		err := tmpl.Execute(respWriter, templateData)
 		if err != nil {
 			panic(err)
 		}
+
+		if layout != nil {
+			templateData["content"] = template.HTML(respWriter.String())
+
+			respWriter = &bytes.Buffer{}
+			err := layout.Execute(respWriter, templateData)
+			if err != nil {
+				panic(err)
+			}
+		}
+
+		respBodyReader = respWriter
+	}
+
+	// resp_bytes and resp_text may be served with http.ServeContent so they need to be seekable.
+	var content io.ReadSeeker
+	var contentDigest [sha256.Size]byte
+	if respBytes != nil {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		content = bytes.NewReader(respBytes)
+		contentDigest = sha256.Sum256(respBytes)
+	} else if respText.Status == pgtype.Present {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		content = strings.NewReader(respText.String)
+		contentDigest = sha256.Sum256([]byte(respText.String))
+	}
+
+	if contentType.Status == pgtype.Present {
+		w.Header().Set("Content-Type", contentType.String)
+	}
+
+	if filename.Status == pgtype.Present {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename.String}))
 	}
 
 	if responseHeaders != nil {
@@ -308,6 +486,20 @@ func (h *PGFuncHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if content != nil {
+		// http.ServeContent handles Content-Length, Range, and conditional requests. It always responds with a success
+		// status so it can only be used when the function did not set a different status.
+		if status.Status != pgtype.Present || status.Int == http.StatusOK {
+			if w.Header().Get("ETag") == "" {
+				w.Header().Set("ETag", fmt.Sprintf(`"%x"`, contentDigest))
+			}
+			http.ServeContent(w, r, "", time.Time{}, content)
+			return
+		}
+
+		respBodyReader = content
+	}
+
 	if status.Status == pgtype.Present {
 		w.WriteHeader(int(status.Int))
 	}
@@ -320,38 +512,278 @@ func (h *PGFuncHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func buildHTTPSQLArgs(funcInArgs []string, queryArgs, rawArgs map[string]interface{}, requestCookieSession []byte) []interface{} {
+// isHTMXPartialRequest returns true if r was made by htmx to replace part of a page. Boosted requests replace the whole
+// body so they still need the layout.
+func isHTMXPartialRequest(r *http.Request) bool {
+	return r.Header.Get("HX-Request") == "true" && r.Header.Get("HX-Boosted") != "true"
+}
+
+// templateDataFromRespBody converts a resp_body to template data. A JSON object is used directly. Any other value is
+// available to the template as body.
+func templateDataFromRespBody(respBody []byte) (map[string]interface{}, error) {
+	var body interface{}
+	err := json.Unmarshal(respBody, &body)
+	if err != nil {
+		return nil, err
+	}
+
+	if templateData, ok := body.(map[string]interface{}); ok {
+		return templateData, nil
+	}
+
+	return map[string]interface{}{"body": body}, nil
+}
+
+func parseRequestParams(params []*RequestParam, rawArgs map[string]interface{}) map[string]interface{} {
+	if len(params) == 0 {
+		return nil
+	}
+
+	var argErrors map[string]string
+	var argErrorCodes map[string]string
+	addError := func(name string, err error) {
+		if argErrors == nil {
+			argErrors = make(map[string]string)
+			argErrorCodes = make(map[string]string)
+		}
+		argErrors[name] = err.Error()
+		argErrorCodes[name] = paramErrorCode(err)
+	}
+
+	queryArgs := make(map[string]interface{}, len(params))
+	for _, qp := range params {
+		if value, err := qp.Parse(rawArgs[qp.Name]); err == nil {
+			queryArgs[qp.Name] = value
+		} else {
+			addError(qp.Name, err)
+		}
+	}
+
+	equalsErrors := checkEqualsParams(params, queryArgs, func(name string) bool {
+		_, failed := argErrors[name]
+		return failed
+	})
+	for name, err := range equalsErrors {
+		addError(name, err)
+	}
+
+	if argErrors != nil {
+		queryArgs["__errors__"] = argErrors
+		queryArgs["__error_codes__"] = argErrorCodes
+	}
+
+	return queryArgs
+}
+
+// handleQueryError responds to err with the first matching error response. If none match the error is logged and an
+// internal server error is returned.
+func handleQueryError(w http.ResponseWriter, r *http.Request, ers []*ErrorResponse, err error) {
+	if er, pgErr := findErrorResponse(ers, err); er != nil {
+		current.Logger(r.Context()).Info().Str("pgCode", pgErr.Code).Str("pgMessage", pgErr.Message).Int("status", er.Status).Msg("mapped database error to error response")
+		er.ServeError(w, r, pgErr)
+		return
+	}
+
+	logQueryError(r.Context(), err)
+	http.Error(w, "Internal server error", http.StatusInternalServerError)
+}
+
+// logQueryError logs err with all available PostgreSQL error fields.
+func logQueryError(ctx context.Context, err error) {
+	event := current.Logger(ctx).Error().Caller().Err(err)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		event.Str("pgSeverity", pgErr.Severity)
+		event.Str("pgCode", pgErr.Code)
+		event.Str("pgMessage", pgErr.Message)
+		if pgErr.Detail != "" {
+			event.Str("pgDetail", pgErr.Detail)
+		}
+		if pgErr.Hint != "" {
+			event.Str("pgHint", pgErr.Hint)
+		}
+		if pgErr.Position != 0 {
+			event.Int32("pgPosition", pgErr.Position)
+		}
+		if pgErr.InternalPosition != 0 {
+			event.Int32("pgInternalPosition", pgErr.InternalPosition)
+		}
+		if pgErr.InternalQuery != "" {
+			event.Str("pgInternalQuery", pgErr.InternalQuery)
+		}
+		if pgErr.Where != "" {
+			event.Str("pgWhere", pgErr.Where)
+		}
+		if pgErr.SchemaName != "" {
+			event.Str("pgSchemaName", pgErr.SchemaName)
+		}
+		if pgErr.TableName != "" {
+			event.Str("pgTableName", pgErr.TableName)
+		}
+		if pgErr.ColumnName != "" {
+			event.Str("pgColumnName", pgErr.ColumnName)
+		}
+		if pgErr.DataTypeName != "" {
+			event.Str("pgDataTypeName", pgErr.DataTypeName)
+		}
+		if pgErr.ConstraintName != "" {
+			event.Str("pgConstraintName", pgErr.ConstraintName)
+		}
+	}
+	event.Send()
+}
+
+// httpSQLArgs contains the values that can be passed to the in arguments of a function.
+type httpSQLArgs struct {
+	queryArgs      map[string]interface{}
+	rawArgs        map[string]interface{}
+	cookieSession  []byte
+	request        *http.Request
+	requestHeaders []string
+
+	// extra contains the values of in arguments that are only allowed for particular functions.
+	extra map[string]interface{}
+}
+
+func buildHTTPSQLArgs(funcInArgs []string, a *httpSQLArgs) []interface{} {
 	sqlArgs := make([]interface{}, 0, len(funcInArgs))
 	for _, ia := range funcInArgs {
 		switch ia {
 		case "args":
-			sqlArgs = append(sqlArgs, queryArgs)
+			sqlArgs = append(sqlArgs, a.queryArgs)
 		case "raw_args":
-			sqlArgs = append(sqlArgs, rawArgs)
+			sqlArgs = append(sqlArgs, a.rawArgs)
 		case "cookie_session":
-			sqlArgs = append(sqlArgs, requestCookieSession)
+			sqlArgs = append(sqlArgs, a.cookieSession)
+		case "request":
+			sqlArgs = append(sqlArgs, requestArg(a.request, a.requestHeaders))
+		case "headers":
+			sqlArgs = append(sqlArgs, headersArg(a.request, a.requestHeaders))
+		case "remote_ip":
+			sqlArgs = append(sqlArgs, remoteIP(a.request))
+		case "principal":
+			sqlArgs = append(sqlArgs, requestPrincipal(a.request))
+		default:
+			sqlArgs = append(sqlArgs, a.extra[ia])
 		}
 	}
 
 	return sqlArgs
 }
 
-func NewPGFuncHandler(name string, inArgMap map[string]struct{}, outArgMap map[string]struct{}) (*PGFuncHandler, error) {
-	if name == "" {
-		return nil, errors.New("name cannot be empty")
+func (h *PGFuncHandler) hasInArg(name string) bool {
+	for _, a := range h.FuncInArgs {
+		if a == name {
+			return true
+		}
+	}
+	return false
+}
+
+func isAllowedInArg(name string) bool {
+	for _, a := range allowedInArgs {
+		if a == name {
+			return true
+		}
 	}
+	return false
+}
+
+// passwordCheck is the result of comparing a password to a password digest.
+type passwordCheck struct {
+	digest   string
+	checked  bool
+	valid    bool
+	rehashed string
+}
+
+// checkPassword gets the password digest with h.CheckPasswordDigest on conn and compares it to password. The result
+// and the rehashed digest if one is needed are stored in queryArgs. The comparison is not a query but it is made
+// without ending the transaction of conn so the digest cannot change before the function is called. check keeps the
+// result so a retried transaction only compares again if the digest has changed.
+func (h *PGFuncHandler) checkPassword(ctx context.Context, conn db.DBConn, queryArgs map[string]interface{}, sqlArgsSource *httpSQLArgs, password string, check *passwordCheck) error {
+	delete(queryArgs, h.CheckPasswordDigest.ResultParam)
+	if h.CheckPasswordDigest.RehashParam != "" {
+		delete(queryArgs, h.CheckPasswordDigest.RehashParam)
+	}
+
+	sqlArgs := buildHTTPSQLArgs(h.CheckPasswordDigest.FuncInArgs, sqlArgsSource)
 
-	if _, hasStatus := outArgMap["status"]; !hasStatus {
-		if _, hasRespBody := outArgMap["resp_body"]; !hasRespBody {
-			if _, hasTemplate := outArgMap["template"]; !hasTemplate {
-				return nil, errors.New("missing status, resp_body, and template out arguments")
+	var passwordDigest pgtype.Text
+	err := conn.QueryRow(ctx, h.CheckPasswordDigest.SQL, sqlArgs...).Scan(&passwordDigest)
+	if err != nil {
+		return err
+	}
+
+	if !check.checked || check.digest != passwordDigest.String {
+		valid, err := comparePasswordDigest(ctx, passwordDigest.String, password)
+		if err != nil {
+			return err
+		}
+
+		var rehashed string
+		if valid && h.CheckPasswordDigest.RehashParam != "" && h.CheckPasswordDigest.Hasher.NeedsRehash(passwordDigest.String) {
+			rehashed, err = h.CheckPasswordDigest.Hasher.Digest(ctx, password)
+			if err != nil {
+				return err
 			}
 		}
+
+		*check = passwordCheck{digest: passwordDigest.String, checked: true, valid: valid, rehashed: rehashed}
+	}
+
+	queryArgs[h.CheckPasswordDigest.ResultParam] = check.valid
+	if check.rehashed != "" {
+		queryArgs[h.CheckPasswordDigest.RehashParam] = check.rehashed
 	}
 
+	return nil
+}
+
+// hasTypedInArgError returns true if the param of any typed in argument of h is in argErrors.
+func (h *PGFuncHandler) hasTypedInArgError(argErrors map[string]string) bool {
+	for _, name := range h.TypedInArgs {
+		if _, ok := argErrors[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// typedInArgValues returns the values of the typed in arguments of h. The raw value is only used when there is no
+// param for the argument. Unparsed input is never passed for an argument with a param.
+func (h *PGFuncHandler) typedInArgValues(queryArgs map[string]interface{}, rawArgs map[string]interface{}) (map[string]interface{}, error) {
+	values := make(map[string]interface{}, len(h.TypedInArgs))
+	for _, name := range h.TypedInArgs {
+		value, ok := queryArgs[name]
+		if !ok && findRequestParam(h.Params, name) == nil {
+			value = rawArgs[name]
+		}
+
+		switch v := value.(type) {
+		case decimal.Decimal:
+			value = v.String()
+		}
+
+		if typeName := h.InArgTypes[name]; (typeName == "json" || typeName == "jsonb") && value != nil {
+			buf, err := json.Marshal(value)
+			if err != nil {
+				return nil, err
+			}
+			value = buf
+		}
+
+		values[name] = value
+	}
+
+	return values, nil
+}
+
+// orderInArgs returns the names in inArgMap in the order of allowedInArgs followed by extraInArgs. inArgMap is
+// consumed.
+func orderInArgs(inArgMap map[string]struct{}, extraInArgs ...string) ([]string, error) {
 	inArgs := make([]string, 0, len(inArgMap))
-	// Allowed input arguments in order.
-	for _, a := range allowedInArgs {
+	for _, a := range append(allowedInArgs[:len(allowedInArgs):len(allowedInArgs)], extraInArgs...) {
 		if _, ok := inArgMap[a]; ok {
 			inArgs = append(inArgs, a)
 			delete(inArgMap, a)
@@ -365,6 +797,38 @@ func NewPGFuncHandler(name string, inArgMap map[string]struct{}, outArgMap map[s
 		}
 	}
 
+	return inArgs, nil
+}
+
+func NewPGFuncHandler(name string, inArgMap map[string]struct{}, outArgMap map[string]struct{}) (*PGFuncHandler, error) {
+	if name == "" {
+		return nil, errors.New("name cannot be empty")
+	}
+
+	hasResponseArg := false
+	for _, a := range []string{"status", "resp_body", "template", "resp_bytes", "resp_text", "redirect"} {
+		if _, ok := outArgMap[a]; ok {
+			hasResponseArg = true
+			break
+		}
+	}
+	if !hasResponseArg {
+		return nil, errors.New("missing status, resp_body, template, resp_bytes, resp_text, and redirect out arguments")
+	}
+
+	var typedInArgs []string
+	for a := range inArgMap {
+		if !isAllowedInArg(a) {
+			typedInArgs = append(typedInArgs, a)
+		}
+	}
+	sort.Strings(typedInArgs)
+
+	inArgs, err := orderInArgs(inArgMap, typedInArgs...)
+	if err != nil {
+		return nil, err
+	}
+
 	sb := &strings.Builder{}
 
 	sb.WriteString("select ")
@@ -385,7 +849,7 @@ func NewPGFuncHandler(name string, inArgMap map[string]struct{}, outArgMap map[s
 		if i > 0 {
 			sb.WriteString(", ")
 		}
-		fmt.Fprintf(sb, "%s => $%d", arg, i+1)
+		fmt.Fprintf(sb, "%s => $%d", pgx.Identifier{arg}.Sanitize(), i+1)
 	}
 	sb.WriteString(")")
 
@@ -397,8 +861,9 @@ func NewPGFuncHandler(name string, inArgMap map[string]struct{}, outArgMap map[s
 	}
 
 	h := &PGFuncHandler{
-		SQL:        sb.String(),
-		FuncInArgs: inArgs,
+		SQL:         sb.String(),
+		FuncInArgs:  inArgs,
+		TypedInArgs: typedInArgs,
 	}
 
 	return h, nil
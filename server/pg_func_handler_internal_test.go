@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtractRawArgsSources(t *testing.T) {
+	params := []*RequestParam{
+		{Name: "id", Type: RequestParamTypeText, Source: RequestParamSourcePath},
+		{Name: "q", Type: RequestParamTypeText, Source: RequestParamSourceQuery},
+		{Name: "name", Type: RequestParamTypeText, Source: RequestParamSourceBody},
+		{Name: "tenantID", Type: RequestParamTypeText, Source: RequestParamSourceHeader, SourceName: "X-Tenant-Id"},
+		{Name: "theme", Type: RequestParamTypeText, Source: RequestParamSourceCookie, SourceName: "theme"},
+		{Name: "missing", Type: RequestParamTypeText, Source: RequestParamSourceHeader, SourceName: "X-Missing"},
+	}
+
+	r := httptest.NewRequest("POST", "/widgets/42?q=search&name=fromquery&missing=fromquery", strings.NewReader(`{"id": "99", "q": "frombody", "name": "widget", "other": "body"}`))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("X-Tenant-Id", "acme")
+	r.AddCookie(&http.Cookie{Name: "theme", Value: "dark"})
+
+	routeContext := chi.NewRouteContext()
+	routeContext.URLParams.Add("id", "42")
+	r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, routeContext))
+
+	rawArgs, err := extractRawArgs(r, params, "")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"id":       "42",
+		"q":        "search",
+		"name":     "widget",
+		"tenantID": "acme",
+		"theme":    "dark",
+		"other":    "body",
+	}, rawArgs)
+}
+
+func TestPGFuncHandlerTypedInArgValues(t *testing.T) {
+	h := &PGFuncHandler{
+		TypedInArgs: []string{"amount", "data", "missing", "title", "todo_id"},
+		InArgTypes:  map[string]string{"amount": "numeric", "data": "jsonb", "missing": "text", "title": "text", "todo_id": "integer"},
+	}
+
+	values, err := h.typedInArgValues(
+		map[string]interface{}{"amount": decimal.RequireFromString("1.50"), "title": "Buy milk", "todo_id": int32(42)},
+		map[string]interface{}{"data": "hello", "title": "  Buy milk  ", "todo_id": "42"},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"amount":  "1.5",
+		"data":    []byte(`"hello"`),
+		"missing": nil,
+		"title":   "Buy milk",
+		"todo_id": int32(42),
+	}, values)
+}
+
+func TestPGFuncHandlerTypedInArgValuesDoesNotPassUnparsedInput(t *testing.T) {
+	h := &PGFuncHandler{
+		Params:      []*RequestParam{{Name: "todo_id", Type: RequestParamTypeInt}},
+		TypedInArgs: []string{"todo_id"},
+		InArgTypes:  map[string]string{"todo_id": "integer"},
+	}
+
+	values, err := h.typedInArgValues(
+		map[string]interface{}{"__errors__": map[string]string{"todo_id": "not a number"}},
+		map[string]interface{}{"todo_id": "abc"},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"todo_id": nil}, values)
+
+	assert.True(t, h.hasTypedInArgError(map[string]string{"todo_id": "not a number"}))
+	assert.False(t, h.hasTypedInArgError(map[string]string{"other": "missing"}))
+}
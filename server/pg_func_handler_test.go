@@ -11,19 +11,20 @@ import (
 func TestNewPGFuncHandler(t *testing.T) {
 	// Success cases
 	for _, tt := range []struct {
-		desc      string
-		name      string
-		inArgMap  map[string]struct{}
-		outArgMap map[string]struct{}
-		sql       string
-		inArgs    []string
+		desc        string
+		name        string
+		inArgMap    map[string]struct{}
+		outArgMap   map[string]struct{}
+		sql         string
+		inArgs      []string
+		typedInArgs []string
 	}{
 		{
 			desc:      "simple",
 			name:      "get_foo",
 			inArgMap:  map[string]struct{}{"args": {}},
 			outArgMap: map[string]struct{}{"resp_body": {}},
-			sql:       "select null as status, resp_body, null as template, null as template_data, null as cookie_session, null as response_headers from get_foo(args => $1)",
+			sql:       `select null as status, resp_body, null as template, null as template_data, null as cookie_session, null as response_headers, null as resp_bytes, null as resp_text, null as content_type, null as filename, null as layout, null as template_block, null as redirect, null as flash from get_foo("args" => $1)`,
 			inArgs:    []string{"args"},
 		},
 		{
@@ -31,9 +32,27 @@ func TestNewPGFuncHandler(t *testing.T) {
 			name:      "get_foo",
 			inArgMap:  map[string]struct{}{"args": {}},
 			outArgMap: map[string]struct{}{"resp_body": {}, "status": {}},
-			sql:       "select status, resp_body, null as template, null as template_data, null as cookie_session, null as response_headers from get_foo(args => $1)",
+			sql:       `select status, resp_body, null as template, null as template_data, null as cookie_session, null as response_headers, null as resp_bytes, null as resp_text, null as content_type, null as filename, null as layout, null as template_block, null as redirect, null as flash from get_foo("args" => $1)`,
 			inArgs:    []string{"args"},
 		},
+		{
+			desc:        "typed in arguments",
+			name:        "get_foo",
+			inArgMap:    map[string]struct{}{"title": {}, "cookie_session": {}, "todo_id": {}},
+			outArgMap:   map[string]struct{}{"resp_body": {}},
+			sql:         `select null as status, resp_body, null as template, null as template_data, null as cookie_session, null as response_headers, null as resp_bytes, null as resp_text, null as content_type, null as filename, null as layout, null as template_block, null as redirect, null as flash from get_foo("cookie_session" => $1, "title" => $2, "todo_id" => $3)`,
+			inArgs:      []string{"cookie_session", "title", "todo_id"},
+			typedInArgs: []string{"title", "todo_id"},
+		},
+		{
+			desc:        "typed in argument that requires quoting",
+			name:        "get_foo",
+			inArgMap:    map[string]struct{}{"todoID": {}},
+			outArgMap:   map[string]struct{}{"resp_body": {}},
+			sql:         `select null as status, resp_body, null as template, null as template_data, null as cookie_session, null as response_headers, null as resp_bytes, null as resp_text, null as content_type, null as filename, null as layout, null as template_block, null as redirect, null as flash from get_foo("todoID" => $1)`,
+			inArgs:      []string{"todoID"},
+			typedInArgs: []string{"todoID"},
+		},
 	} {
 		t.Run(tt.desc, func(t *testing.T) {
 			h, err := server.NewPGFuncHandler(tt.name, tt.inArgMap, tt.outArgMap)
@@ -41,6 +60,7 @@ func TestNewPGFuncHandler(t *testing.T) {
 			require.NotNil(t, h)
 			assert.Equal(t, tt.sql, h.SQL)
 			assert.Equal(t, tt.inArgs, h.FuncInArgs)
+			assert.Equal(t, tt.typedInArgs, h.TypedInArgs)
 		})
 	}
 
@@ -59,13 +79,6 @@ func TestNewPGFuncHandler(t *testing.T) {
 			outArgMap: map[string]struct{}{"resp_body": {}},
 			errString: "name cannot be empty",
 		},
-		{
-			desc:      "unknown in argument",
-			name:      "foo",
-			inArgMap:  map[string]struct{}{"args": {}, "bad": {}},
-			outArgMap: map[string]struct{}{"resp_body": {}},
-			errString: "unknown arg: bad",
-		},
 		{
 			desc:      "unknown out argument",
 			name:      "foo",
@@ -78,7 +91,7 @@ func TestNewPGFuncHandler(t *testing.T) {
 			name:      "foo",
 			inArgMap:  map[string]struct{}{"args": {}},
 			outArgMap: map[string]struct{}{},
-			errString: "missing status, resp_body, and template out arguments",
+			errString: "missing status, resp_body, template, resp_bytes, resp_text, and redirect out arguments",
 		},
 	} {
 		h, err := server.NewPGFuncHandler(tt.name, tt.inArgMap, tt.outArgMap)
@@ -0,0 +1,237 @@
+package server
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/jackc/hannibal/db"
+	"github.com/jackc/pgx/v4"
+)
+
+const (
+	StreamFormatNDJSON    = "ndjson"
+	StreamFormatJSONArray = "json-array"
+	StreamFormatCSV       = "csv"
+)
+
+// streamFlushRows is the number of rows written between explicit flushes of the response.
+const streamFlushRows = 100
+
+// PGFuncStreamHandler calls a set-returning function and writes each row to the response as it is received. The
+// function can only have the standard in arguments such as args and cookie_session. Typed in arguments are not
+// supported.
+type PGFuncStreamHandler struct {
+	Params         []*RequestParam
+	Format         string
+	ErrorResponses []*ErrorResponse
+	RequestHeaders []string
+	SQL            string
+	FuncInArgs     []string
+	Host           *Host
+}
+
+func NewPGFuncStreamHandler(name string, format string, inArgMap map[string]struct{}) (*PGFuncStreamHandler, error) {
+	if name == "" {
+		return nil, errors.New("name cannot be empty")
+	}
+
+	// Typed in arguments are only supported by PGFuncHandler. A stream function reads its params from args.
+	for a := range inArgMap {
+		if !isAllowedInArg(a) {
+			return nil, fmt.Errorf("typed in argument %s is not supported with stream; use args", a)
+		}
+	}
+
+	inArgs, err := orderInArgs(inArgMap)
+	if err != nil {
+		return nil, err
+	}
+
+	sb := &strings.Builder{}
+
+	switch format {
+	case StreamFormatNDJSON, StreamFormatJSONArray:
+		// Let PostgreSQL encode each row as JSON.
+		sb.WriteString("select row_to_json(r) from ")
+	case StreamFormatCSV:
+		sb.WriteString("select * from ")
+	default:
+		return nil, fmt.Errorf("unknown stream format: %s", format)
+	}
+
+	fmt.Fprintf(sb, "%s(", name)
+	for i, arg := range inArgs {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		fmt.Fprintf(sb, "%s => $%d", pgx.Identifier{arg}.Sanitize(), i+1)
+	}
+	sb.WriteString(")")
+
+	if format != StreamFormatCSV {
+		sb.WriteString(" r")
+	}
+
+	h := &PGFuncStreamHandler{
+		Format:     format,
+		SQL:        sb.String(),
+		FuncInArgs: inArgs,
+	}
+
+	return h, nil
+}
+
+func (h *PGFuncStreamHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	rawArgs, err := extractRawArgs(r, h.Params, h.Host.UploadPath)
+	if err != nil {
+		panic(err)
+	}
+
+	queryArgs := parseRequestParams(h.Params, rawArgs)
+	requestCookieSession, err := h.Host.readCookieSession(r)
+	if err != nil {
+		logQueryError(ctx, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	sqlArgsSource := &httpSQLArgs{
+		queryArgs:      queryArgs,
+		rawArgs:        rawArgs,
+		cookieSession:  requestCookieSession,
+		request:        r,
+		requestHeaders: h.RequestHeaders,
+	}
+	sqlArgs := buildHTTPSQLArgs(h.FuncInArgs, sqlArgsSource)
+	if h.Format == StreamFormatCSV {
+		// An empty map requests the text format for every result column. This lets CSV values be written exactly as
+		// PostgreSQL formats them.
+		sqlArgs = append([]interface{}{pgx.QueryResultFormatsByOID{}}, sqlArgs...)
+	}
+
+	// The role and settings of a database identity are local to a transaction so the entire stream is read in one.
+	conn := db.App(ctx)
+	var tx pgx.Tx
+	if dbIdentity := contextDBIdentity(ctx); dbIdentity != nil {
+		tx, err = conn.Begin(ctx)
+		if err != nil {
+			handleQueryError(w, r, h.ErrorResponses, err)
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		err = dbIdentity.apply(ctx, tx, sqlArgsSource)
+		if err != nil {
+			handleQueryError(w, r, h.ErrorResponses, err)
+			return
+		}
+		conn = tx
+	}
+
+	rows, err := conn.Query(ctx, h.SQL, sqlArgs...)
+	if err != nil {
+		handleQueryError(w, r, h.ErrorResponses, err)
+		return
+	}
+	defer rows.Close()
+
+	// Read the first row before writing anything. Errors raised by the function are usually received here and can
+	// still be reported with an error status.
+	hasRow := rows.Next()
+	if !hasRow && rows.Err() != nil {
+		handleQueryError(w, r, h.ErrorResponses, rows.Err())
+		return
+	}
+
+	var csvWriter *csv.Writer
+
+	switch h.Format {
+	case StreamFormatNDJSON:
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	case StreamFormatJSONArray:
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("["))
+	case StreamFormatCSV:
+		w.Header().Set("Content-Type", "text/csv")
+		csvWriter = csv.NewWriter(w)
+		fieldDescriptions := rows.FieldDescriptions()
+		header := make([]string, len(fieldDescriptions))
+		for i, fd := range fieldDescriptions {
+			header[i] = string(fd.Name)
+		}
+		csvWriter.Write(header)
+	}
+
+	flusher, _ := w.(http.Flusher)
+	var record []string
+	rowCount := 0
+
+	for hasRow {
+		switch h.Format {
+		case StreamFormatNDJSON, StreamFormatJSONArray:
+			if h.Format == StreamFormatJSONArray && rowCount > 0 {
+				w.Write([]byte(","))
+			}
+			w.Write(rows.RawValues()[0])
+			if h.Format == StreamFormatNDJSON {
+				w.Write([]byte("\n"))
+			}
+		case StreamFormatCSV:
+			rawValues := rows.RawValues()
+			if record == nil {
+				record = make([]string, len(rawValues))
+			}
+			for i, v := range rawValues {
+				record[i] = string(v) // NULL is written as an empty field.
+			}
+			csvWriter.Write(record)
+		}
+
+		rowCount++
+		if rowCount%streamFlushRows == 0 {
+			flushStream(csvWriter, flusher)
+		}
+
+		hasRow = rows.Next()
+	}
+
+	if rows.Err() != nil {
+		// The response status and possibly some rows have already been sent. Aborting the response is the only way left
+		// to tell the client the result is incomplete. The rows written so far are flushed first. The response is never
+		// completed so the client gets an error instead of a short result.
+		logQueryError(ctx, rows.Err())
+		flushStream(csvWriter, flusher)
+		panic(http.ErrAbortHandler)
+	}
+
+	if tx != nil {
+		rows.Close()
+		// The response cannot report a failed commit anymore so it is aborted like a failed stream.
+		err = tx.Commit(ctx)
+		if err != nil {
+			logQueryError(ctx, err)
+			flushStream(csvWriter, flusher)
+			panic(http.ErrAbortHandler)
+		}
+	}
+
+	if h.Format == StreamFormatJSONArray {
+		w.Write([]byte("]"))
+	}
+
+	flushStream(csvWriter, flusher)
+}
+
+func flushStream(csvWriter *csv.Writer, flusher http.Flusher) {
+	if csvWriter != nil {
+		csvWriter.Flush()
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+}
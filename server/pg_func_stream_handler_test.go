@@ -0,0 +1,89 @@
+package server_test
+
+import (
+	"testing"
+
+	"github.com/jackc/hannibal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewPGFuncStreamHandler(t *testing.T) {
+	// Success cases
+	for _, tt := range []struct {
+		desc     string
+		name     string
+		format   string
+		inArgMap map[string]struct{}
+		sql      string
+		inArgs   []string
+	}{
+		{
+			desc:     "ndjson",
+			name:     "get_foos",
+			format:   server.StreamFormatNDJSON,
+			inArgMap: map[string]struct{}{"args": {}},
+			sql:      `select row_to_json(r) from get_foos("args" => $1) r`,
+			inArgs:   []string{"args"},
+		},
+		{
+			desc:     "json-array",
+			name:     "get_foos",
+			format:   server.StreamFormatJSONArray,
+			inArgMap: map[string]struct{}{"cookie_session": {}, "args": {}},
+			sql:      `select row_to_json(r) from get_foos("args" => $1, "cookie_session" => $2) r`,
+			inArgs:   []string{"args", "cookie_session"},
+		},
+		{
+			desc:     "csv",
+			name:     "get_foos",
+			format:   server.StreamFormatCSV,
+			inArgMap: map[string]struct{}{},
+			sql:      "select * from get_foos()",
+			inArgs:   []string{},
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			h, err := server.NewPGFuncStreamHandler(tt.name, tt.format, tt.inArgMap)
+			require.NoError(t, err)
+			require.NotNil(t, h)
+			assert.Equal(t, tt.sql, h.SQL)
+			assert.Equal(t, tt.inArgs, h.FuncInArgs)
+		})
+	}
+
+	// Fail cases
+	for i, tt := range []struct {
+		desc      string
+		name      string
+		format    string
+		inArgMap  map[string]struct{}
+		errString string
+	}{
+		{
+			desc:      "empty name",
+			name:      "",
+			format:    server.StreamFormatNDJSON,
+			inArgMap:  map[string]struct{}{"args": {}},
+			errString: "name cannot be empty",
+		},
+		{
+			desc:      "unknown format",
+			name:      "foo",
+			format:    "xml",
+			inArgMap:  map[string]struct{}{"args": {}},
+			errString: "unknown stream format: xml",
+		},
+		{
+			desc:      "unknown in argument",
+			name:      "foo",
+			format:    server.StreamFormatCSV,
+			inArgMap:  map[string]struct{}{"args": {}, "bad": {}},
+			errString: "typed in argument bad is not supported with stream; use args",
+		},
+	} {
+		h, err := server.NewPGFuncStreamHandler(tt.name, tt.format, tt.inArgMap)
+		assert.EqualErrorf(t, err, tt.errString, "%d: %s", i, tt.desc)
+		assert.Nilf(t, h, "%d: %s", i, tt.desc)
+	}
+}
@@ -0,0 +1,378 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackc/hannibal/appconf"
+	"github.com/jackc/hannibal/db"
+)
+
+const (
+	RateLimitKeyIP        = "ip"
+	RateLimitKeySession   = "session"
+	RateLimitKeyPrincipal = "principal"
+	RateLimitKeyFunc      = "func"
+)
+
+const (
+	RateLimitStoreMemory   = "memory"
+	RateLimitStoreDatabase = "database"
+)
+
+const (
+	defaultRateLimitSessionKey = "user_id"
+
+	// rateLimitSweepInterval is how often full buckets are removed from a rate limit store.
+	rateLimitSweepInterval = 10 * time.Minute
+)
+
+// rateLimitStore keeps the token buckets of a RateLimiter.
+type rateLimitStore interface {
+	// take refills the bucket key to now and takes a token from it if one is available. capacity is the maximum number
+	// of tokens in the bucket and refillRate is the number of tokens added per second. remaining is the number of
+	// tokens left in the bucket.
+	take(ctx context.Context, key string, capacity, refillRate float64, now time.Time) (allowed bool, remaining float64, err error)
+}
+
+// RateLimiter limits the requests of each key with a token bucket. Requests that exceed the limit are rejected with
+// 429 Too Many Requests.
+//
+// The key of a request is its client IP address, a field of its cookie_session, its principal, or the text returned
+// by KeyFunc. Requests without a session field or principal use their client IP address. Requests for which KeyFunc
+// returns null are not limited.
+//
+// The client IP address is the same address as the remote_ip in argument. The address in the X-Forwarded-For or
+// X-Real-IP header is only used when the connection is from one of the trusted-proxies. Otherwise a client could avoid
+// the limit by sending a different address with each request. Behind a proxy that is not trusted all requests share the
+// proxy's limit. A request without a client IP address is rejected.
+type RateLimiter struct {
+	// Name distinguishes the buckets of different rate limiters in the same store.
+	Name string
+
+	Key        string
+	SessionKey string
+	KeyFunc    *sqlFuncCall
+
+	// Capacity is the number of requests that can be made at once. RefillRate is the number of requests per second
+	// that are added back.
+	Capacity   float64
+	RefillRate float64
+
+	Store rateLimitStore
+	Host  *Host
+
+	// now returns the current time. It is replaced in tests.
+	now func() time.Time
+}
+
+func newRateLimiterFromAppConfig(ctx context.Context, dbconn db.DBConn, schema string, name string, acrl *appconf.RateLimit) (*RateLimiter, error) {
+	rl := &RateLimiter{
+		Name: name,
+		Key:  acrl.Key,
+		now:  time.Now,
+	}
+
+	switch rl.Key {
+	case "":
+		rl.Key = RateLimitKeyIP
+	case RateLimitKeyIP, RateLimitKeySession, RateLimitKeyPrincipal, RateLimitKeyFunc:
+	default:
+		return nil, fmt.Errorf("bad rate-limit.key value: %s", acrl.Key)
+	}
+
+	if acrl.SessionKey != "" && rl.Key != RateLimitKeySession {
+		return nil, errors.New("rate-limit.session-key requires session key")
+	}
+	if rl.Key == RateLimitKeySession {
+		rl.SessionKey = defaultRateLimitSessionKey
+		if acrl.SessionKey != "" {
+			rl.SessionKey = acrl.SessionKey
+		}
+	}
+
+	if (acrl.KeyFunc != "") != (rl.Key == RateLimitKeyFunc) {
+		return nil, errors.New("rate-limit.key-func is required by and only allowed with func key")
+	}
+	if acrl.KeyFunc != "" {
+		callName, inArgs, _, err := getSQLFuncArgs(ctx, dbconn, schema, acrl.KeyFunc)
+		if err != nil {
+			return nil, err
+		}
+
+		// Request params have not been parsed when the function is called.
+		for _, name := range []string{"args", "raw_args"} {
+			if _, ok := inArgs[name]; ok {
+				return nil, fmt.Errorf("rate-limit.key-func %s cannot have %s in argument", acrl.KeyFunc, name)
+			}
+		}
+
+		rl.KeyFunc, err = newSQLFuncCall(callName, inArgs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build call for function %s: %v", acrl.KeyFunc, err)
+		}
+	}
+
+	if acrl.Limit <= 0 {
+		return nil, errors.New("rate-limit.limit must be positive")
+	}
+
+	if acrl.Per == "" {
+		return nil, errors.New("rate-limit requires per")
+	}
+	per, err := time.ParseDuration(acrl.Per)
+	if err != nil {
+		return nil, fmt.Errorf("bad rate-limit.per value: %v", err)
+	}
+	if per <= 0 {
+		return nil, fmt.Errorf("rate-limit.per must be positive: %s", acrl.Per)
+	}
+	rl.RefillRate = float64(acrl.Limit) / per.Seconds()
+
+	if acrl.Burst < 0 {
+		return nil, errors.New("rate-limit.burst must not be negative")
+	}
+	rl.Capacity = float64(acrl.Limit)
+	if acrl.Burst != 0 {
+		rl.Capacity = float64(acrl.Burst)
+	}
+
+	switch acrl.Store {
+	case "", RateLimitStoreMemory:
+		rl.Store = newMemoryRateLimitStore()
+	case RateLimitStoreDatabase:
+		rl.Store = &databaseRateLimitStore{}
+	default:
+		return nil, fmt.Errorf("bad rate-limit.store value: %s", acrl.Store)
+	}
+
+	return rl, nil
+}
+
+// key returns the key of r. ok is false if r is not limited.
+func (rl *RateLimiter) key(r *http.Request) (key string, ok bool, err error) {
+	ipKey := func() (string, bool, error) {
+		// Requests without an address must not share one bucket or escape the limit.
+		ip := remoteIP(r)
+		if ip == nil {
+			return "", false, errors.New("cannot rate limit request without a client IP address")
+		}
+		return "ip:" + ip.String(), true, nil
+	}
+
+	switch rl.Key {
+	case RateLimitKeySession:
+		cookieSession, err := rl.Host.readCookieSession(r)
+		if err != nil {
+			return "", false, err
+		}
+
+		var session map[string]interface{}
+		if json.Unmarshal(cookieSession, &session) == nil {
+			if v, ok := session[rl.SessionKey]; ok && v != nil {
+				return fmt.Sprintf("session:%v", v), true, nil
+			}
+		}
+		return ipKey()
+	case RateLimitKeyPrincipal:
+		if principal := requestPrincipal(r); principal != nil {
+			return "principal:" + string(principal), true, nil
+		}
+		return ipKey()
+	case RateLimitKeyFunc:
+		cookieSession, err := rl.Host.readCookieSession(r)
+		if err != nil {
+			return "", false, err
+		}
+
+		sqlArgs := &httpSQLArgs{
+			cookieSession: cookieSession,
+			request:       r,
+		}
+
+		var key *string
+		ctx := r.Context()
+		err = contextDBIdentity(ctx).run(ctx, sqlArgs, func(conn db.DBConn) error {
+			return conn.QueryRow(ctx, rl.KeyFunc.SQL, buildHTTPSQLArgs(rl.KeyFunc.FuncInArgs, sqlArgs)...).Scan(&key)
+		})
+		if err != nil {
+			return "", false, err
+		}
+		if key == nil {
+			return "", false, nil
+		}
+		return "func:" + *key, true, nil
+	default:
+		return ipKey()
+	}
+}
+
+// setHeaders sets the RateLimit-Limit, RateLimit-Remaining, and RateLimit-Reset headers. RateLimit-Reset is the number
+// of seconds until the bucket is full again.
+func (rl *RateLimiter) setHeaders(w http.ResponseWriter, remaining float64) {
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(int(rl.Capacity)))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(int(math.Floor(remaining))))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds((rl.Capacity-remaining)/rl.RefillRate)))
+}
+
+// ceilSeconds rounds seconds up to a whole number of seconds. It first rounds to the millisecond so floating point
+// error does not add a second.
+func ceilSeconds(seconds float64) int {
+	return int(math.Ceil(math.Round(seconds*1000) / 1000))
+}
+
+// rateLimitHandler rejects requests to Handler that exceed the limit of RateLimiter.
+type rateLimitHandler struct {
+	RateLimiter    *RateLimiter
+	ErrorResponses []*ErrorResponse
+	Handler        http.Handler
+}
+
+func (h *rateLimitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rl := h.RateLimiter
+
+	key, ok, err := rl.key(r)
+	if err != nil {
+		handleQueryError(w, r, h.ErrorResponses, err)
+		return
+	}
+	if !ok {
+		h.Handler.ServeHTTP(w, r)
+		return
+	}
+
+	allowed, remaining, err := rl.Store.take(r.Context(), rl.Name+"|"+key, rl.Capacity, rl.RefillRate, rl.now())
+	if err != nil {
+		handleQueryError(w, r, h.ErrorResponses, err)
+		return
+	}
+
+	rl.setHeaders(w, remaining)
+
+	if !allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds((1-remaining)/rl.RefillRate)))
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+
+	h.Handler.ServeHTTP(w, r)
+}
+
+// refillTokens returns the tokens in a bucket that had tokens elapsed ago.
+func refillTokens(tokens, capacity, refillRate float64, elapsed time.Duration) float64 {
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	return math.Min(capacity, tokens+elapsed.Seconds()*refillRate)
+}
+
+type tokenBucket struct {
+	tokens     float64
+	updateTime time.Time
+	capacity   float64
+	refillRate float64
+}
+
+// memoryRateLimitStore keeps buckets in memory. It is only suitable for a single server.
+type memoryRateLimitStore struct {
+	mutex     sync.Mutex
+	buckets   map[string]*tokenBucket
+	sweepTime time.Time
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{buckets: make(map[string]*tokenBucket)}
+}
+
+func (s *memoryRateLimitStore) take(ctx context.Context, key string, capacity, refillRate float64, now time.Time) (bool, float64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.sweep(now)
+
+	b, ok := s.buckets[key]
+	if ok {
+		b.tokens = refillTokens(b.tokens, capacity, refillRate, now.Sub(b.updateTime))
+		if now.After(b.updateTime) {
+			b.updateTime = now
+		}
+	} else {
+		b = &tokenBucket{tokens: capacity, updateTime: now}
+		s.buckets[key] = b
+	}
+	b.capacity = capacity
+	b.refillRate = refillRate
+
+	if b.tokens < 1 {
+		return false, b.tokens, nil
+	}
+
+	b.tokens--
+	return true, b.tokens, nil
+}
+
+// sweep removes full buckets at most once per rateLimitSweepInterval. A full bucket is the same as a missing bucket.
+// s.mutex must be held.
+func (s *memoryRateLimitStore) sweep(now time.Time) {
+	if now.Sub(s.sweepTime) < rateLimitSweepInterval {
+		return
+	}
+	s.sweepTime = now
+
+	for key, b := range s.buckets {
+		if refillTokens(b.tokens, b.capacity, b.refillRate, now.Sub(b.updateTime)) >= b.capacity {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+// databaseRateLimitStore keeps buckets in the rate_limits table of the system schema. It can be shared by multiple
+// servers.
+type databaseRateLimitStore struct {
+	mutex     sync.Mutex
+	sweepTime time.Time
+}
+
+func (s *databaseRateLimitStore) take(ctx context.Context, key string, capacity, refillRate float64, now time.Time) (bool, float64, error) {
+	sysSchema := db.QuoteSchema(db.GetConfig(ctx).SysSchema)
+
+	err := s.sweep(ctx, now)
+	if err != nil {
+		return false, 0, err
+	}
+
+	var allowed bool
+	var remaining float64
+	err = db.Sys(ctx).QueryRow(
+		ctx,
+		fmt.Sprintf("select allowed, remaining from %s.rate_limit_take($1, $2, $3, $4)", sysSchema),
+		key, capacity, refillRate, now,
+	).Scan(&allowed, &remaining)
+	if err != nil {
+		return false, 0, err
+	}
+
+	return allowed, remaining, nil
+}
+
+// sweep deletes expired buckets at most once per rateLimitSweepInterval.
+func (s *databaseRateLimitStore) sweep(ctx context.Context, now time.Time) error {
+	s.mutex.Lock()
+	if now.Sub(s.sweepTime) < rateLimitSweepInterval {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.sweepTime = now
+	s.mutex.Unlock()
+
+	sysSchema := db.QuoteSchema(db.GetConfig(ctx).SysSchema)
+	_, err := db.Sys(ctx).Exec(ctx, fmt.Sprintf("delete from %s.rate_limits where expire_time <= $1", sysSchema), now)
+	return err
+}
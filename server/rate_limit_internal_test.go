@@ -0,0 +1,207 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/hannibal/appconf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock is a clock for tests that only moves when advanced.
+type fakeClock struct {
+	mutex sync.Mutex
+	t     time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{t: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.t = c.t.Add(d)
+}
+
+func TestNewRateLimiterFromAppConfig(t *testing.T) {
+	ctx := context.Background()
+
+	rl, err := newRateLimiterFromAppConfig(ctx, nil, "public", "global", &appconf.RateLimit{Limit: 10, Per: "1m"})
+	require.NoError(t, err)
+	assert.Equal(t, "global", rl.Name)
+	assert.Equal(t, RateLimitKeyIP, rl.Key)
+	assert.Equal(t, 10.0, rl.Capacity)
+	assert.InDelta(t, 10.0/60, rl.RefillRate, 0.000001)
+	assert.IsType(t, &memoryRateLimitStore{}, rl.Store)
+
+	rl, err = newRateLimiterFromAppConfig(ctx, nil, "public", "POST /login", &appconf.RateLimit{Key: "session", Limit: 5, Per: "1h", Burst: 20, Store: "database"})
+	require.NoError(t, err)
+	assert.Equal(t, RateLimitKeySession, rl.Key)
+	assert.Equal(t, defaultRateLimitSessionKey, rl.SessionKey)
+	assert.Equal(t, 20.0, rl.Capacity)
+	assert.IsType(t, &databaseRateLimitStore{}, rl.Store)
+
+	for _, tt := range []struct {
+		config    *appconf.RateLimit
+		errString string
+	}{
+		{config: &appconf.RateLimit{Key: "cookie", Limit: 1, Per: "1s"}, errString: "bad rate-limit.key value: cookie"},
+		{config: &appconf.RateLimit{SessionKey: "account_id", Limit: 1, Per: "1s"}, errString: "rate-limit.session-key requires session key"},
+		{config: &appconf.RateLimit{Key: "func", Limit: 1, Per: "1s"}, errString: "rate-limit.key-func is required by and only allowed with func key"},
+		{config: &appconf.RateLimit{KeyFunc: "rate_limit_key", Limit: 1, Per: "1s"}, errString: "rate-limit.key-func is required by and only allowed with func key"},
+		{config: &appconf.RateLimit{Per: "1s"}, errString: "rate-limit.limit must be positive"},
+		{config: &appconf.RateLimit{Limit: 1}, errString: "rate-limit requires per"},
+		{config: &appconf.RateLimit{Limit: 1, Per: "often"}, errString: `bad rate-limit.per value: time: invalid duration "often"`},
+		{config: &appconf.RateLimit{Limit: 1, Per: "0s"}, errString: "rate-limit.per must be positive: 0s"},
+		{config: &appconf.RateLimit{Limit: 1, Per: "1s", Burst: -1}, errString: "rate-limit.burst must not be negative"},
+		{config: &appconf.RateLimit{Limit: 1, Per: "1s", Store: "redis"}, errString: "bad rate-limit.store value: redis"},
+	} {
+		_, err := newRateLimiterFromAppConfig(ctx, nil, "public", "global", tt.config)
+		assert.EqualError(t, err, tt.errString)
+	}
+}
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	ctx := context.Background()
+	clock := newFakeClock()
+	store := newMemoryRateLimitStore()
+
+	// A bucket with a capacity of 2 that refills 1 token per second.
+	for i, tt := range []struct {
+		advance   time.Duration
+		allowed   bool
+		remaining float64
+	}{
+		{allowed: true, remaining: 1},
+		{allowed: true, remaining: 0},
+		{allowed: false, remaining: 0},
+		{advance: 500 * time.Millisecond, allowed: false, remaining: 0.5},
+		{advance: 500 * time.Millisecond, allowed: true, remaining: 0},
+		{advance: time.Hour, allowed: true, remaining: 1},
+	} {
+		clock.advance(tt.advance)
+		allowed, remaining, err := store.take(ctx, "a", 2, 1, clock.now())
+		require.NoError(t, err)
+		assert.Equalf(t, tt.allowed, allowed, "%d", i)
+		assert.InDeltaf(t, tt.remaining, remaining, 0.000001, "%d", i)
+	}
+
+	// Buckets are independent.
+	allowed, remaining, err := store.take(ctx, "b", 2, 1, clock.now())
+	require.NoError(t, err)
+	assert.True(t, allowed)
+	assert.Equal(t, 1.0, remaining)
+
+	// Full buckets are swept.
+	clock.advance(rateLimitSweepInterval)
+	_, _, err = store.take(ctx, "c", 2, 1, clock.now())
+	require.NoError(t, err)
+	assert.Len(t, store.buckets, 1)
+}
+
+func TestRateLimitHandler(t *testing.T) {
+	clock := newFakeClock()
+	rl, err := newRateLimiterFromAppConfig(context.Background(), nil, "public", "global", &appconf.RateLimit{Limit: 2, Per: "1m"})
+	require.NoError(t, err)
+	rl.now = clock.now
+
+	handler := &rateLimitHandler{
+		RateLimiter: rl,
+		Handler:     http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	}
+
+	request := func(remoteAddr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := request("192.0.2.1:1234")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "2", w.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "1", w.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "30", w.Header().Get("RateLimit-Reset"))
+
+	// The port is not part of the key.
+	w = request("192.0.2.1:5678")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "60", w.Header().Get("RateLimit-Reset"))
+
+	w = request("192.0.2.1:1234")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "30", w.Header().Get("Retry-After"))
+	assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+
+	// Other clients are not affected.
+	w = request("192.0.2.2:1234")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	clock.advance(20 * time.Second)
+	w = request("192.0.2.1:1234")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "10", w.Header().Get("Retry-After"))
+
+	clock.advance(10 * time.Second)
+	w = request("192.0.2.1:1234")
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestRateLimiterKeyPrincipal(t *testing.T) {
+	rl := &RateLimiter{Key: RateLimitKeyPrincipal}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	key, ok, err := rl.key(r)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "ip:192.0.2.1", key)
+
+	r = r.WithContext(context.WithValue(r.Context(), principalCtxKey, []byte(`{"id": 1}`)))
+	key, ok, err = rl.key(r)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, `principal:{"id": 1}`, key)
+}
+
+func TestRateLimiterKeyIPTrustedProxies(t *testing.T) {
+	trustedProxies, err := parseTrustedProxies([]string{"10.0.0.0/8"})
+	require.NoError(t, err)
+
+	rl := &RateLimiter{Key: RateLimitKeyIP}
+
+	var key string
+	handler := withClientIP(trustedProxies)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, _, err = rl.key(r)
+	}))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.1.2.3:1234"
+	r.Header.Set("X-Forwarded-For", "203.0.113.7, 198.51.100.1")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	require.NoError(t, err)
+	assert.Equal(t, "ip:198.51.100.1", key)
+}
+
+func TestRateLimiterKeyIPWithoutAddress(t *testing.T) {
+	rl := &RateLimiter{Key: RateLimitKeyIP}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "@"
+	_, _, err := rl.key(r)
+	require.EqualError(t, err, "cannot rate limit request without a client IP address")
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/middleware"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/hlog"
+)
+
+// requestArg builds the value of the request in argument. Only the headers named in allowedHeaders are included.
+func requestArg(r *http.Request, allowedHeaders []string) map[string]interface{} {
+	arg := map[string]interface{}{
+		"method":  r.Method,
+		"path":    r.URL.Path,
+		"query":   r.URL.RawQuery,
+		"host":    r.Host,
+		"headers": headersArg(r, allowedHeaders),
+	}
+
+	if ip := remoteIP(r); ip != nil {
+		arg["remoteIP"] = ip.String()
+	}
+
+	if requestID := requestID(r); requestID != "" {
+		arg["requestID"] = requestID
+	}
+
+	return arg
+}
+
+// headersArg builds the value of the headers in argument. Only the headers named in allowedHeaders are included. Keys
+// are lower case and multiple values for the same header are joined with ", ".
+func headersArg(r *http.Request, allowedHeaders []string) map[string]string {
+	headers := make(map[string]string, len(allowedHeaders))
+	for _, name := range allowedHeaders {
+		if values := r.Header.Values(name); len(values) > 0 {
+			headers[strings.ToLower(name)] = strings.Join(values, ", ")
+		}
+	}
+	return headers
+}
+
+// withClientIP resolves the client IP address of each request with trustedProxies. It is returned by remoteIP and
+// logged as remote_ip.
+func withClientIP(trustedProxies []*net.IPNet) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := remoteIP(r)
+			if ip != nil {
+				ip = forwardedClientIP(ip, r.Header, trustedProxies)
+				hlog.FromRequest(r).UpdateContext(func(c zerolog.Context) zerolog.Context {
+					return c.Str("remote_ip", ip.String())
+				})
+			}
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPCtxKey, ip)))
+		})
+	}
+}
+
+// remoteIP returns the client IP address resolved by withClientIP. Without withClientIP it is the address of the
+// connection. It returns nil if the address cannot be parsed.
+func remoteIP(r *http.Request) net.IP {
+	if ip, ok := r.Context().Value(clientIPCtxKey).(net.IP); ok {
+		return ip
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return net.ParseIP(host)
+}
+
+// forwardedClientIP returns the client IP address of a request from peer. If peer is in trustedProxies the address is
+// taken from the X-Forwarded-For header or from X-Real-IP if there is no X-Forwarded-For. Each proxy appends the
+// address it received the request from to X-Forwarded-For so everything to the left of the last untrusted address can
+// be set by the client. X-Forwarded-For is read from the right skipping trusted proxies.
+func forwardedClientIP(peer net.IP, header http.Header, trustedProxies []*net.IPNet) net.IP {
+	if !ipInNetworks(peer, trustedProxies) {
+		return peer
+	}
+
+	var hops []string
+	for _, v := range header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(v, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+
+	if len(hops) == 0 {
+		if ip := net.ParseIP(strings.TrimSpace(header.Get("X-Real-IP"))); ip != nil {
+			return ip
+		}
+		return peer
+	}
+
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hops[i])
+		if ip == nil {
+			// The last trusted proxy forwarded an address it did not check.
+			break
+		}
+
+		client = ip
+		if !ipInNetworks(ip, trustedProxies) {
+			break
+		}
+	}
+
+	return client
+}
+
+func ipInNetworks(ip net.IP, networks []*net.IPNet) bool {
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies parses the trusted-proxies config. Each proxy is an IP address or a CIDR such as 10.0.0.0/8.
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(proxies))
+	for _, p := range proxies {
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("bad trusted-proxies value: %s", p)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("bad trusted-proxies value: %s", p)
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// requestID returns the request ID that is logged and sent in the X-Request-Id response header.
+func requestID(r *http.Request) string {
+	if id, ok := hlog.IDFromRequest(r); ok {
+		return id.String()
+	}
+
+	return middleware.GetReqID(r.Context())
+}
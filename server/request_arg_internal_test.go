@@ -0,0 +1,120 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/hlog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeadersArg(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Add("User-Agent", "test agent")
+	r.Header.Add("Accept-Language", "en-US")
+	r.Header.Add("Accept-Language", "de")
+	r.Header.Add("Authorization", "secret")
+
+	headers := headersArg(r, []string{"User-Agent", "accept-language", "X-Missing"})
+	assert.Equal(t, map[string]string{"user-agent": "test agent", "accept-language": "en-US, de"}, headers)
+}
+
+func TestRemoteIP(t *testing.T) {
+	for _, tt := range []struct {
+		remoteAddr string
+		ip         string
+	}{
+		{remoteAddr: "192.168.0.1:4321", ip: "192.168.0.1"},
+		{remoteAddr: "192.168.0.1", ip: "192.168.0.1"},
+		{remoteAddr: "[::1]:4321", ip: "::1"},
+		{remoteAddr: "not an ip", ip: "<nil>"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remoteAddr
+		assert.Equal(t, tt.ip, remoteIP(r).String(), tt.remoteAddr)
+	}
+}
+
+func TestWithClientIP(t *testing.T) {
+	trustedProxies, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.9"})
+	require.NoError(t, err)
+
+	for i, tt := range []struct {
+		remoteAddr   string
+		forwardedFor string
+		realIP       string
+		trustProxies bool
+		expectedIP   string
+	}{
+		{remoteAddr: "192.0.2.1:1234", expectedIP: "192.0.2.1"},
+		{remoteAddr: "192.0.2.1:1234", forwardedFor: "198.51.100.1", expectedIP: "192.0.2.1"},
+		{remoteAddr: "192.0.2.1:1234", forwardedFor: "198.51.100.1", trustProxies: true, expectedIP: "192.0.2.1"},
+		{remoteAddr: "10.1.2.3:1234", forwardedFor: "198.51.100.1", trustProxies: true, expectedIP: "198.51.100.1"},
+		{remoteAddr: "192.0.2.9:1234", forwardedFor: "198.51.100.1", trustProxies: true, expectedIP: "198.51.100.1"},
+		{remoteAddr: "10.1.2.3:1234", forwardedFor: "198.51.100.1", expectedIP: "10.1.2.3"},
+		// The client can set the addresses to the left of the address appended by the trusted proxy.
+		{remoteAddr: "10.1.2.3:1234", forwardedFor: "203.0.113.7, 198.51.100.1", trustProxies: true, expectedIP: "198.51.100.1"},
+		{remoteAddr: "10.1.2.3:1234", forwardedFor: "203.0.113.7, 198.51.100.1, 10.0.0.5", trustProxies: true, expectedIP: "198.51.100.1"},
+		{remoteAddr: "10.1.2.3:1234", forwardedFor: "10.0.0.4, 10.0.0.5", trustProxies: true, expectedIP: "10.0.0.4"},
+		{remoteAddr: "10.1.2.3:1234", forwardedFor: "198.51.100.1, bogus", trustProxies: true, expectedIP: "10.1.2.3"},
+		{remoteAddr: "10.1.2.3:1234", realIP: "198.51.100.1", trustProxies: true, expectedIP: "198.51.100.1"},
+		{remoteAddr: "192.0.2.1:1234", realIP: "198.51.100.1", trustProxies: true, expectedIP: "192.0.2.1"},
+	} {
+		var proxies []*net.IPNet
+		if tt.trustProxies {
+			proxies = trustedProxies
+		}
+
+		var ip net.IP
+		handler := withClientIP(proxies)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip = remoteIP(r)
+		}))
+
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remoteAddr
+		if tt.forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", tt.forwardedFor)
+		}
+		if tt.realIP != "" {
+			r.Header.Set("X-Real-IP", tt.realIP)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+		assert.Equalf(t, tt.expectedIP, ip.String(), "%d", i)
+	}
+}
+
+func TestWithClientIPLogsRemoteIP(t *testing.T) {
+	trustedProxies, err := parseTrustedProxies([]string{"10.0.0.0/8"})
+	require.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	handler := hlog.NewHandler(zerolog.New(buf))(withClientIP(trustedProxies)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hlog.FromRequest(r).Info().Msg("test")
+	})))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.1.2.3:1234"
+	r.Header.Set("X-Forwarded-For", "203.0.113.7, 198.51.100.1")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	assert.Contains(t, buf.String(), `"remote_ip":"198.51.100.1"`)
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	networks, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.9", "2001:db8::1"})
+	require.NoError(t, err)
+	require.Len(t, networks, 3)
+	assert.Equal(t, "10.0.0.0/8", networks[0].String())
+	assert.Equal(t, "192.0.2.9/32", networks[1].String())
+	assert.Equal(t, "2001:db8::1/128", networks[2].String())
+
+	_, err = parseTrustedProxies([]string{"proxy.example.com"})
+	assert.EqualError(t, err, "bad trusted-proxies value: proxy.example.com")
+
+	_, err = parseTrustedProxies([]string{"10.0.0.0/99"})
+	assert.EqualError(t, err, "bad trusted-proxies value: 10.0.0.0/99")
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jackc/hannibal/appconf"
+	"github.com/shopspring/decimal"
+)
+
+// Error codes for request param errors. They are available to functions in args -> '__error_codes__'.
+const (
+	ParamErrorMissing     = "missing"
+	ParamErrorInvalid     = "invalid"
+	ParamErrorMin         = "min"
+	ParamErrorMax         = "max"
+	ParamErrorMinLength   = "min_length"
+	ParamErrorMaxLength   = "max_length"
+	ParamErrorPattern     = "pattern"
+	ParamErrorOneOf       = "one_of"
+	ParamErrorMinItems    = "min_items"
+	ParamErrorMaxItems    = "max_items"
+	ParamErrorEqualsParam = "equals_param"
+	ParamErrorMaxSize     = "max_size"
+	ParamErrorAccept      = "accept"
+)
+
+// ParamError is a request param error with a code that does not depend on the wording of the message.
+type ParamError struct {
+	Code    string
+	Message string
+}
+
+func (e *ParamError) Error() string {
+	return e.Message
+}
+
+// paramErrorCode returns the code for an error returned by RequestParam.Parse. Errors without a code are type
+// conversion failures.
+func paramErrorCode(err error) string {
+	var pe *ParamError
+	if errors.As(err, &pe) {
+		return pe.Code
+	}
+	return ParamErrorInvalid
+}
+
+func (rp *RequestParam) isNumber() bool {
+	switch rp.Type {
+	case RequestParamTypeInt, RequestParamTypeBigint, RequestParamTypeDecimal, RequestParamTypeFloat8:
+		return true
+	}
+	return false
+}
+
+func (rp *RequestParam) isText() bool {
+	switch rp.Type {
+	case RequestParamTypeText, RequestParamTypeEmail, RequestParamTypeURL, RequestParamTypeEnum:
+		return true
+	}
+	return false
+}
+
+func requestParamConstraintsFromAppConfig(rp *RequestParam, acrp *appconf.RequestParam) error {
+	if acrp.Min != nil || acrp.Max != nil {
+		if !rp.isNumber() {
+			return errors.New("min and max require a number type")
+		}
+		if acrp.Min != nil {
+			min := decimal.NewFromFloat(*acrp.Min)
+			rp.Min = &min
+		}
+		if acrp.Max != nil {
+			max := decimal.NewFromFloat(*acrp.Max)
+			rp.Max = &max
+		}
+	}
+
+	if acrp.MinLength != nil || acrp.MaxLength != nil || acrp.Pattern != "" {
+		if !rp.isText() {
+			return errors.New("min-length, max-length, and pattern require a text type")
+		}
+		rp.MinLength = acrp.MinLength
+		rp.MaxLength = acrp.MaxLength
+		if acrp.Pattern != "" {
+			var err error
+			rp.Pattern, err = regexp.Compile(`^(?:` + acrp.Pattern + `)$`)
+			if err != nil {
+				return fmt.Errorf("bad pattern: %v", err)
+			}
+		}
+	}
+
+	if acrp.OneOf != nil {
+		if !rp.isText() && !rp.isNumber() {
+			return errors.New("one-of requires a text or number type")
+		}
+		rp.OneOf = acrp.OneOf
+	}
+
+	if acrp.MinItems != nil || acrp.MaxItems != nil {
+		if rp.Type != RequestParamTypeArray {
+			return errors.New("min-items and max-items require type array")
+		}
+		rp.MinItems = acrp.MinItems
+		rp.MaxItems = acrp.MaxItems
+	}
+
+	rp.EqualsParam = acrp.EqualsParam
+
+	return nil
+}
+
+// checkConstraints checks the parsed value of rp.
+func (rp *RequestParam) checkConstraints(value interface{}) error {
+	if value == nil {
+		return nil
+	}
+
+	if rp.Min != nil || rp.Max != nil {
+		var num decimal.Decimal
+		switch value := value.(type) {
+		case int32:
+			num = decimal.NewFromInt32(value)
+		case int64:
+			num = decimal.NewFromInt(value)
+		case float64:
+			num = decimal.NewFromFloat(value)
+		case decimal.Decimal:
+			num = value
+		}
+
+		if rp.Min != nil && num.LessThan(*rp.Min) {
+			return &ParamError{Code: ParamErrorMin, Message: fmt.Sprintf("must be at least %s", rp.Min)}
+		}
+		if rp.Max != nil && num.GreaterThan(*rp.Max) {
+			return &ParamError{Code: ParamErrorMax, Message: fmt.Sprintf("must be at most %s", rp.Max)}
+		}
+	}
+
+	if s, ok := value.(string); ok {
+		length := utf8.RuneCountInString(s)
+		if rp.MinLength != nil && length < *rp.MinLength {
+			return &ParamError{Code: ParamErrorMinLength, Message: fmt.Sprintf("must be at least %d characters", *rp.MinLength)}
+		}
+		if rp.MaxLength != nil && length > *rp.MaxLength {
+			return &ParamError{Code: ParamErrorMaxLength, Message: fmt.Sprintf("must be at most %d characters", *rp.MaxLength)}
+		}
+		if rp.Pattern != nil && !rp.Pattern.MatchString(s) {
+			return &ParamError{Code: ParamErrorPattern, Message: "does not match pattern"}
+		}
+	}
+
+	if rp.OneOf != nil {
+		s := fmt.Sprint(value)
+		found := false
+		for _, v := range rp.OneOf {
+			if s == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return &ParamError{Code: ParamErrorOneOf, Message: fmt.Sprintf("not one of %s", strings.Join(rp.OneOf, ", "))}
+		}
+	}
+
+	if a, ok := value.([]interface{}); ok {
+		if rp.MinItems != nil && len(a) < *rp.MinItems {
+			return &ParamError{Code: ParamErrorMinItems, Message: fmt.Sprintf("must have at least %d elements", *rp.MinItems)}
+		}
+		if rp.MaxItems != nil && len(a) > *rp.MaxItems {
+			return &ParamError{Code: ParamErrorMaxItems, Message: fmt.Sprintf("must have at most %d elements", *rp.MaxItems)}
+		}
+	}
+
+	return nil
+}
+
+// checkEqualsParams checks the EqualsParam constraint of each of params against the parsed values. It returns the
+// errors by param name. Params that already failed to parse are skipped.
+func checkEqualsParams(params []*RequestParam, values map[string]interface{}, failed func(name string) bool) map[string]error {
+	var errs map[string]error
+	for _, rp := range params {
+		if rp.EqualsParam == "" || failed(rp.Name) || failed(rp.EqualsParam) {
+			continue
+		}
+
+		if !reflect.DeepEqual(values[rp.Name], values[rp.EqualsParam]) {
+			if errs == nil {
+				errs = make(map[string]error)
+			}
+			errs[rp.Name] = &ParamError{Code: ParamErrorEqualsParam, Message: fmt.Sprintf("does not match %s", rp.EqualsParam)}
+		}
+	}
+
+	return errs
+}
@@ -6,9 +6,23 @@ import (
 )
 
 type reverseProxy struct {
-	rp *httputil.ReverseProxy
+	rp   *httputil.ReverseProxy
+	host *Host
 }
 
 func (rp *reverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// The cookie session is passed to the backend in a header. It must only ever come from Hannibal.
+	r.Header.Del("X-Hannibal-Cookie-Session")
+
+	cookieSession, err := rp.host.readCookieSession(r)
+	if err != nil {
+		logQueryError(r.Context(), err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if cookieSession != nil {
+		r.Header.Set("X-Hannibal-Cookie-Session", string(cookieSession))
+	}
+
 	rp.rp.ServeHTTP(w, r)
 }
@@ -1,8 +1,14 @@
 package server
 
 import (
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
+	"net/http"
+
+	"github.com/gorilla/securecookie"
+	"github.com/jackc/hannibal/current"
 )
 
 func GenerateSecretKeyBase() (string, error) {
@@ -14,3 +20,99 @@ func GenerateSecretKeyBase() (string, error) {
 
 	return hex.EncodeToString(secretKey), nil
 }
+
+// secretKeyBases returns the current secret key base followed by the previous secret key bases.
+func secretKeyBases(ctx context.Context) []string {
+	return append([]string{current.SecretKeyBase(ctx)}, current.PreviousSecretKeyBases(ctx)...)
+}
+
+// newCookieCodecs returns the codecs for encrypted cookies. Values are encoded with the first codec which uses the
+// current secret key base. Values encoded with any of the secret key bases can be decoded.
+func newCookieCodecs(ctx context.Context) []securecookie.Codec {
+	var keyPairs [][]byte
+	for _, skb := range secretKeyBases(ctx) {
+		hashKey := sha256.Sum256([]byte(skb + "cookie hash key"))
+		blockKey := sha256.Sum256([]byte(skb + "cookie block key"))
+		keyPairs = append(keyPairs, hashKey[:], blockKey[:16])
+	}
+
+	return securecookie.CodecsFromPairs(keyPairs...)
+}
+
+const (
+	// defaultCSRFCookieName and defaultCSRFMaxAge must match the defaults of github.com/gorilla/csrf.
+	defaultCSRFCookieName = "_gorilla_csrf"
+	defaultCSRFMaxAge     = 12 * 60 * 60
+)
+
+// csrfKeys returns the CSRF authentication keys derived from the current secret key base followed by the previous
+// secret key bases.
+func csrfKeys(ctx context.Context) [][]byte {
+	var keys [][]byte
+	for _, skb := range secretKeyBases(ctx) {
+		key := sha256.Sum256([]byte(skb + "CSRF key"))
+		keys = append(keys, key[:])
+	}
+	return keys
+}
+
+// newCSRFKeyRotation returns middleware that allows CSRF cookies signed with a previous key to be used. The CSRF
+// middleware only knows the current key. When the cookie named cookieName cannot be decoded with the current key but
+// can be decoded with a previous key it is re-signed with the current key before the request is passed on. This keeps
+// CSRF tokens that were issued before the secret key base was rotated valid.
+func newCSRFKeyRotation(cookieName string, maxAge int, keys [][]byte) func(http.Handler) http.Handler {
+	codecs := make([]*securecookie.SecureCookie, len(keys))
+	for i, key := range keys {
+		// Configure the codecs the same as github.com/gorilla/csrf.
+		codecs[i] = securecookie.New(key, nil)
+		codecs[i].SetSerializer(securecookie.JSONEncoder{})
+		codecs[i].MaxAge(maxAge)
+	}
+
+	resign := func(value string) (string, bool) {
+		var token []byte
+		if codecs[0].Decode(cookieName, value, &token) == nil {
+			return "", false
+		}
+
+		for _, c := range codecs[1:] {
+			if c.Decode(cookieName, value, &token) == nil {
+				encoded, err := codecs[0].Encode(cookieName, token)
+				if err != nil {
+					return "", false
+				}
+				return encoded, true
+			}
+		}
+
+		return "", false
+	}
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cookie, err := r.Cookie(cookieName)
+			if err != nil {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			value, ok := resign(cookie.Value)
+			if !ok {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			cookies := r.Cookies()
+			r = r.Clone(r.Context())
+			r.Header.Del("Cookie")
+			for _, c := range cookies {
+				if c.Name == cookieName {
+					c.Value = value
+				}
+				r.AddCookie(c)
+			}
+
+			h.ServeHTTP(w, r)
+		})
+	}
+}
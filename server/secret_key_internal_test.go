@@ -0,0 +1,65 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/csrf"
+	"github.com/jackc/hannibal/current"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCSRFKeyRotation(t *testing.T) {
+	oldSKB := strings.Repeat("a", 64)
+	newSKB := strings.Repeat("b", 64)
+
+	var token string
+	oldKeys := csrfKeys(current.WithSecretKeyBase(context.Background(), oldSKB))
+	oldHandler := csrf.Protect(oldKeys[0])(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token = csrf.Token(r)
+	}))
+
+	w := httptest.NewRecorder()
+	oldHandler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	cookies := w.Result().Cookies()
+	require.Len(t, cookies, 1)
+	require.NotEmpty(t, token)
+
+	newRequest := func() *http.Request {
+		r := httptest.NewRequest("POST", "/", nil)
+		r.Header.Set("X-CSRF-Token", token)
+		r.AddCookie(&http.Cookie{Name: "other", Value: "unchanged"})
+		r.AddCookie(cookies[0])
+		return r
+	}
+
+	var otherCookie string
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie("other")
+		require.NoError(t, err)
+		otherCookie = cookie.Value
+	})
+
+	keys := csrfKeys(current.WithPreviousSecretKeyBases(current.WithSecretKeyBase(context.Background(), newSKB), []string{oldSKB}))
+	require.Len(t, keys, 2)
+
+	// Without rotation the token is rejected.
+	w = httptest.NewRecorder()
+	csrf.Protect(keys[0])(ok).ServeHTTP(w, newRequest())
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = httptest.NewRecorder()
+	newCSRFKeyRotation(defaultCSRFCookieName, defaultCSRFMaxAge, keys)(csrf.Protect(keys[0])(ok)).ServeHTTP(w, newRequest())
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "unchanged", otherCookie)
+
+	// A cookie signed with a key that is no longer used is rejected.
+	keys = csrfKeys(current.WithPreviousSecretKeyBases(current.WithSecretKeyBase(context.Background(), newSKB), []string{strings.Repeat("c", 64)}))
+	w = httptest.NewRecorder()
+	newCSRFKeyRotation(defaultCSRFCookieName, defaultCSRFMaxAge, keys)(csrf.Protect(keys[0])(ok)).ServeHTTP(w, newRequest())
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
@@ -23,6 +23,7 @@ func Serve(config *Config) {
 	host := &Host{
 		HTTPListenAddr: config.ListenAddress,
 		AppPath:        config.AppPath,
+		UploadPath:     filepath.Join(config.AppPath, "uploads"),
 	}
 
 	err := host.Load(context.Background(), filepath.Join(host.AppPath, "current"))
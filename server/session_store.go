@@ -0,0 +1,437 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/jackc/hannibal/appconf"
+	"github.com/jackc/hannibal/current"
+	"github.com/jackc/hannibal/db"
+	"github.com/jackc/pgx/v4"
+)
+
+const (
+	SessionStoreCookie   = "cookie"
+	SessionStoreDatabase = "database"
+)
+
+const defaultSessionCookieName = "hannibal-session"
+
+const (
+	defaultSessionIdleTimeout = 24 * time.Hour
+	defaultSessionMaxLifetime = 30 * 24 * time.Hour
+	defaultSessionUserKey     = "user_id"
+
+	// sessionTokenLength is the number of random bytes in a database session token.
+	sessionTokenLength = 32
+
+	// sessionTouchInterval is how often the access time of a database session is updated. Updating it on every request
+	// would make every request a write.
+	sessionTouchInterval = time.Minute
+
+	// sessionSweepInterval is how often expired database sessions are deleted.
+	sessionSweepInterval = 10 * time.Minute
+)
+
+// sessionStore loads and saves the cookie_session of requests.
+type sessionStore interface {
+	// load returns the session of r or nil if r does not have a session.
+	load(ctx context.Context, r *http.Request) ([]byte, error)
+
+	// save stores session as the session of r. It returns the cookie to send in the response or nil if the cookie is
+	// unchanged. A nil session ends the session of r.
+	save(ctx context.Context, r *http.Request, session []byte) (*http.Cookie, error)
+
+	// sessionCookie returns the attributes of the session cookie.
+	sessionCookie() *sessionCookie
+}
+
+func newSessionStoreFromAppConfig(ctx context.Context, acs *appconf.Session) (sessionStore, error) {
+	if acs == nil {
+		acs = &appconf.Session{}
+	}
+
+	cookie, err := sessionCookieFromAppConfig(acs)
+	if err != nil {
+		return nil, err
+	}
+
+	switch acs.Store {
+	case "", SessionStoreCookie:
+		if acs.IdleTimeout != "" || acs.MaxLifetime != "" || acs.UserKey != "" {
+			return nil, errors.New("session idle-timeout, max-lifetime, and user-key require database store")
+		}
+
+		codecs := newCookieCodecs(ctx)
+		if cookie.maxAge > 0 {
+			// The encoded value carries a timestamp that is checked separately from the expiration of the cookie.
+			for _, c := range codecs {
+				c.(*securecookie.SecureCookie).MaxAge(cookie.maxAge)
+			}
+		}
+
+		return &cookieSessionStore{codecs: codecs, cookie: cookie}, nil
+	case SessionStoreDatabase:
+	default:
+		return nil, fmt.Errorf("bad session.store value: %s", acs.Store)
+	}
+
+	s := &databaseSessionStore{
+		idleTimeout: defaultSessionIdleTimeout,
+		maxLifetime: defaultSessionMaxLifetime,
+		userKey:     defaultSessionUserKey,
+		cookie:      cookie,
+	}
+
+	if acs.IdleTimeout != "" {
+		s.idleTimeout, err = time.ParseDuration(acs.IdleTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("bad session.idle-timeout value: %v", err)
+		}
+		if s.idleTimeout <= 0 {
+			return nil, fmt.Errorf("session.idle-timeout must be positive: %s", acs.IdleTimeout)
+		}
+	}
+
+	if acs.MaxLifetime != "" {
+		s.maxLifetime, err = time.ParseDuration(acs.MaxLifetime)
+		if err != nil {
+			return nil, fmt.Errorf("bad session.max-lifetime value: %v", err)
+		}
+		if s.maxLifetime <= 0 {
+			return nil, fmt.Errorf("session.max-lifetime must be positive: %s", acs.MaxLifetime)
+		}
+	}
+
+	if acs.UserKey != "" {
+		s.userKey = acs.UserKey
+	}
+
+	return s, nil
+}
+
+// sessionCookie contains the attributes of the session cookie. The cookie is always HttpOnly.
+type sessionCookie struct {
+	name     string
+	domain   string
+	secure   bool
+	sameSite http.SameSite
+	maxAge   int
+}
+
+func defaultSessionCookie() *sessionCookie {
+	return &sessionCookie{name: defaultSessionCookieName}
+}
+
+func sessionCookieFromAppConfig(acs *appconf.Session) (*sessionCookie, error) {
+	c := defaultSessionCookie()
+
+	if acs.CookieName != "" {
+		c.name = acs.CookieName
+	}
+	c.domain = acs.Domain
+	if acs.Secure != nil {
+		c.secure = *acs.Secure
+	}
+
+	if acs.SameSite != "" {
+		switch strings.ToLower(acs.SameSite) {
+		case "none":
+			c.sameSite = http.SameSiteNoneMode
+		case "lax":
+			c.sameSite = http.SameSiteLaxMode
+		case "strict":
+			c.sameSite = http.SameSiteStrictMode
+		default:
+			return nil, fmt.Errorf("bad session.same-site value: %s", acs.SameSite)
+		}
+
+		// Browsers reject cookies with SameSite=None that are not secure.
+		if c.sameSite == http.SameSiteNoneMode && !c.secure {
+			return nil, errors.New("session.same-site none requires secure")
+		}
+	}
+
+	if acs.MaxAge != nil {
+		if *acs.MaxAge < 0 {
+			return nil, fmt.Errorf("session.max-age must not be negative: %d", *acs.MaxAge)
+		}
+		c.maxAge = *acs.MaxAge
+	}
+
+	return c, nil
+}
+
+// new returns the session cookie with value. An empty value deletes the cookie.
+func (c *sessionCookie) new(value string) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     c.name,
+		Value:    value,
+		Path:     "/",
+		Domain:   c.domain,
+		Secure:   c.secure,
+		HttpOnly: true,
+		SameSite: c.sameSite,
+	}
+
+	if value == "" {
+		cookie.Expires = time.Unix(0, 0)
+		cookie.MaxAge = -1
+	} else if c.maxAge > 0 {
+		cookie.MaxAge = c.maxAge
+		cookie.Expires = time.Now().Add(time.Duration(c.maxAge) * time.Second)
+	}
+
+	return cookie
+}
+
+// cookieSessionStore keeps the entire session in an encrypted cookie.
+type cookieSessionStore struct {
+	codecs []securecookie.Codec
+	cookie *sessionCookie
+}
+
+// load ignores any errors decoding the cookie and treats the session as missing.
+func (s *cookieSessionStore) load(ctx context.Context, r *http.Request) ([]byte, error) {
+	var session []byte
+	if cookie, err := r.Cookie(s.cookie.name); err == nil {
+		securecookie.DecodeMulti(defaultSessionCookieName, cookie.Value, &session, s.codecs...)
+	}
+	return session, nil
+}
+
+func (s *cookieSessionStore) sessionCookie() *sessionCookie {
+	return s.cookie
+}
+
+func (s *cookieSessionStore) save(ctx context.Context, r *http.Request, session []byte) (*http.Cookie, error) {
+	if session == nil {
+		return s.cookie.new(""), nil
+	}
+
+	encoded, err := securecookie.EncodeMulti(defaultSessionCookieName, session, s.codecs...)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.cookie.new(encoded), nil
+}
+
+// databaseSessionStore keeps sessions in the sessions table of the system schema. The cookie only contains a random
+// token. The table stores the SHA-256 digest of the token so the contents of the table cannot be used to hijack a
+// session.
+//
+// A session expires when it has not been used for idleTimeout or when it is older than maxLifetime. The value of
+// userKey in the session is stored with it so the invalidate_sessions function can end all the sessions of a user. A
+// new token is issued whenever the user changes to prevent session fixation.
+type databaseSessionStore struct {
+	idleTimeout time.Duration
+	maxLifetime time.Duration
+	userKey     string
+	cookie      *sessionCookie
+}
+
+// token returns the session token from the cookie of r or nil.
+func (s *databaseSessionStore) token(r *http.Request) []byte {
+	cookie, err := r.Cookie(s.cookie.name)
+	if err != nil {
+		return nil
+	}
+
+	token, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil || len(token) != sessionTokenLength {
+		return nil
+	}
+
+	return token
+}
+
+func sessionTokenDigest(token []byte) []byte {
+	digest := sha256.Sum256(token)
+	return digest[:]
+}
+
+func (s *databaseSessionStore) sessionCookie() *sessionCookie {
+	return s.cookie
+}
+
+func (s *databaseSessionStore) load(ctx context.Context, r *http.Request) ([]byte, error) {
+	token := s.token(r)
+	if token == nil {
+		return nil, nil
+	}
+	id := sessionTokenDigest(token)
+	sysSchema := db.QuoteSchema(db.GetConfig(ctx).SysSchema)
+
+	var session []byte
+	var stale bool
+	err := db.Sys(ctx).QueryRow(
+		ctx,
+		fmt.Sprintf("select data, access_time < now() - $2::interval from %s.sessions where id = $1 and expire_time > now()", sysSchema),
+		id, sessionTouchInterval,
+	).Scan(&session, &stale)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if stale {
+		_, err := db.Sys(ctx).Exec(
+			ctx,
+			fmt.Sprintf("update %s.sessions set access_time = now(), expire_time = least(creation_time + $2::interval, now() + $3::interval) where id = $1", sysSchema),
+			id, s.maxLifetime, s.idleTimeout,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return session, nil
+}
+
+func (s *databaseSessionStore) save(ctx context.Context, r *http.Request, session []byte) (*http.Cookie, error) {
+	sysSchema := db.QuoteSchema(db.GetConfig(ctx).SysSchema)
+
+	if token := s.token(r); token != nil {
+		id := sessionTokenDigest(token)
+
+		if session != nil {
+			ct, err := db.Sys(ctx).Exec(
+				ctx,
+				fmt.Sprintf(`update %s.sessions
+set data = $2, access_time = now(), expire_time = least(creation_time + $4::interval, now() + $5::interval)
+where id = $1 and expire_time > now() and user_id is not distinct from ($2::jsonb ->> $3)`, sysSchema),
+				id, session, s.userKey, s.maxLifetime, s.idleTimeout,
+			)
+			if err != nil {
+				return nil, err
+			}
+			if ct.RowsAffected() == 1 {
+				return nil, nil
+			}
+		}
+
+		// The session is being ended, has expired, or belongs to a different user.
+		_, err := db.Sys(ctx).Exec(ctx, fmt.Sprintf("delete from %s.sessions where id = $1", sysSchema), id)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if session == nil {
+		return s.cookie.new(""), nil
+	}
+
+	token := make([]byte, sessionTokenLength)
+	_, err := rand.Read(token)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Sys(ctx).Exec(
+		ctx,
+		fmt.Sprintf(`insert into %s.sessions (id, user_id, data, creation_time, access_time, expire_time)
+values ($1, $2::jsonb ->> $3, $2, now(), now(), now() + least($4::interval, $5::interval))`, sysSchema),
+		sessionTokenDigest(token), session, s.userKey, s.maxLifetime, s.idleTimeout,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.cookie.new(base64.RawURLEncoding.EncodeToString(token)), nil
+}
+
+// sweepSessions deletes expired database sessions.
+func sweepSessions(ctx context.Context) error {
+	sysSchema := db.QuoteSchema(db.GetConfig(ctx).SysSchema)
+	_, err := db.Sys(ctx).Exec(ctx, fmt.Sprintf("delete from %s.sessions where expire_time <= now()", sysSchema))
+	return err
+}
+
+// startSessionSweeper starts periodically deleting expired database sessions. It runs until h is shut down. Calling it
+// again has no effect.
+func (h *Host) startSessionSweeper() {
+	h.sessionSweeperMutex.Lock()
+	defer h.sessionSweeperMutex.Unlock()
+
+	if h.sessionSweeperStop != nil {
+		return
+	}
+
+	stop := make(chan struct{})
+	h.sessionSweeperStop = stop
+
+	go func() {
+		ticker := time.NewTicker(sessionSweepInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				ctx, cancel := context.WithTimeout(context.Background(), sessionSweepInterval)
+				err := sweepSessions(ctx)
+				cancel()
+				if err != nil {
+					current.Logger(ctx).Error().Caller().Err(err).Msg("failed to sweep expired sessions")
+				}
+			}
+		}
+	}()
+}
+
+func (h *Host) stopSessionSweeper() {
+	h.sessionSweeperMutex.Lock()
+	defer h.sessionSweeperMutex.Unlock()
+
+	if h.sessionSweeperStop != nil {
+		close(h.sessionSweeperStop)
+		h.sessionSweeperStop = nil
+	}
+}
+
+// withSessionStore returns middleware that makes store the session store of requests.
+func withSessionStore(store sessionStore) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), sessionStoreCtxKey, store)))
+		})
+	}
+}
+
+// requestSessionStore returns the session store of r. Requests that are not served by an app handler use the cookie
+// store with the default cookie.
+func (h *Host) requestSessionStore(r *http.Request) sessionStore {
+	if store, ok := r.Context().Value(sessionStoreCtxKey).(sessionStore); ok {
+		return store
+	}
+	return &cookieSessionStore{codecs: h.cookieCodecs, cookie: defaultSessionCookie()}
+}
+
+// readCookieSession reads the cookie session of r from its session store.
+func (h *Host) readCookieSession(r *http.Request) ([]byte, error) {
+	return h.requestSessionStore(r).load(r.Context(), r)
+}
+
+// writeCookieSession saves session as the cookie session of r and sets the session cookie on w if it changed.
+func (h *Host) writeCookieSession(w http.ResponseWriter, r *http.Request, session []byte) error {
+	cookie, err := h.requestSessionStore(r).save(r.Context(), r, session)
+	if err != nil {
+		return err
+	}
+	if cookie != nil {
+		http.SetCookie(w, cookie)
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/hannibal/appconf"
+	"github.com/jackc/hannibal/current"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewSessionStoreFromAppConfig(t *testing.T) {
+	ctx := current.WithSecretKeyBase(context.Background(), strings.Repeat("a", 64))
+
+	store, err := newSessionStoreFromAppConfig(ctx, nil)
+	require.NoError(t, err)
+	require.IsType(t, &cookieSessionStore{}, store)
+	assert.Len(t, store.(*cookieSessionStore).codecs, 1)
+	assert.Equal(t, defaultSessionCookie(), store.(*cookieSessionStore).cookie)
+
+	store, err = newSessionStoreFromAppConfig(ctx, &appconf.Session{Store: "database"})
+	require.NoError(t, err)
+	assert.Equal(t, &databaseSessionStore{
+		idleTimeout: defaultSessionIdleTimeout,
+		maxLifetime: defaultSessionMaxLifetime,
+		userKey:     defaultSessionUserKey,
+		cookie:      defaultSessionCookie(),
+	}, store)
+
+	secure := true
+	maxAge := 3600
+	store, err = newSessionStoreFromAppConfig(ctx, &appconf.Session{
+		Store:       "database",
+		IdleTimeout: "30m",
+		MaxLifetime: "168h",
+		UserKey:     "account_id",
+		CookieName:  "app-session",
+		Domain:      "example.com",
+		Secure:      &secure,
+		SameSite:    "Strict",
+		MaxAge:      &maxAge,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, &databaseSessionStore{
+		idleTimeout: 30 * time.Minute,
+		maxLifetime: 168 * time.Hour,
+		userKey:     "account_id",
+		cookie: &sessionCookie{
+			name:     "app-session",
+			domain:   "example.com",
+			secure:   true,
+			sameSite: http.SameSiteStrictMode,
+			maxAge:   3600,
+		},
+	}, store)
+
+	negativeMaxAge := -1
+	for _, tt := range []struct {
+		config    *appconf.Session
+		errString string
+	}{
+		{config: &appconf.Session{Store: "redis"}, errString: "bad session.store value: redis"},
+		{config: &appconf.Session{IdleTimeout: "1h"}, errString: "session idle-timeout, max-lifetime, and user-key require database store"},
+		{config: &appconf.Session{Store: "database", IdleTimeout: "soon"}, errString: `bad session.idle-timeout value: time: invalid duration "soon"`},
+		{config: &appconf.Session{Store: "database", MaxLifetime: "-1h"}, errString: "session.max-lifetime must be positive: -1h"},
+		{config: &appconf.Session{SameSite: "sometimes"}, errString: "bad session.same-site value: sometimes"},
+		{config: &appconf.Session{SameSite: "none"}, errString: "session.same-site none requires secure"},
+		{config: &appconf.Session{MaxAge: &negativeMaxAge}, errString: "session.max-age must not be negative: -1"},
+	} {
+		_, err := newSessionStoreFromAppConfig(ctx, tt.config)
+		assert.EqualError(t, err, tt.errString)
+	}
+}
+
+func TestSessionCookieNew(t *testing.T) {
+	c := &sessionCookie{name: "app-session", domain: "example.com", secure: true, sameSite: http.SameSiteLaxMode}
+
+	cookie := c.new("value")
+	assert.Equal(t, &http.Cookie{
+		Name:     "app-session",
+		Value:    "value",
+		Path:     "/",
+		Domain:   "example.com",
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}, cookie)
+
+	cookie = c.new("")
+	assert.Equal(t, -1, cookie.MaxAge)
+	assert.True(t, cookie.Expires.Before(time.Now()))
+
+	c.maxAge = 3600
+	cookie = c.new("value")
+	assert.Equal(t, 3600, cookie.MaxAge)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), cookie.Expires, time.Minute)
+}
+
+func TestCookieSessionStore(t *testing.T) {
+	ctx := current.WithSecretKeyBase(context.Background(), strings.Repeat("a", 64))
+	store := &cookieSessionStore{codecs: newCookieCodecs(ctx), cookie: defaultSessionCookie()}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	session, err := store.load(ctx, r)
+	require.NoError(t, err)
+	assert.Nil(t, session)
+
+	cookie, err := store.save(ctx, r, []byte(`{"user_id": 1}`))
+	require.NoError(t, err)
+	assert.Equal(t, defaultSessionCookieName, cookie.Name)
+	assert.True(t, cookie.HttpOnly)
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+	session, err = store.load(ctx, r)
+	require.NoError(t, err)
+	assert.Equal(t, []byte(`{"user_id": 1}`), session)
+
+	cookie, err = store.save(ctx, r, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "", cookie.Value)
+	assert.True(t, cookie.Expires.Before(time.Now()))
+
+	// A cookie that cannot be decoded is treated as a missing session.
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(store.cookie.new("garbage"))
+	session, err = store.load(ctx, r)
+	require.NoError(t, err)
+	assert.Nil(t, session)
+}
+
+func TestCookieSessionStoreSecretKeyBaseRotation(t *testing.T) {
+	oldSKB := strings.Repeat("a", 64)
+	newSKB := strings.Repeat("b", 64)
+
+	oldCtx := current.WithSecretKeyBase(context.Background(), oldSKB)
+	oldStore := &cookieSessionStore{codecs: newCookieCodecs(oldCtx), cookie: defaultSessionCookie()}
+	cookie, err := oldStore.save(oldCtx, httptest.NewRequest("GET", "/", nil), []byte(`{"user_id": 1}`))
+	require.NoError(t, err)
+
+	// A cookie encoded with a previous secret key base can be decoded.
+	ctx := current.WithPreviousSecretKeyBases(current.WithSecretKeyBase(context.Background(), newSKB), []string{oldSKB})
+	store := &cookieSessionStore{codecs: newCookieCodecs(ctx), cookie: defaultSessionCookie()}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+	session, err := store.load(ctx, r)
+	require.NoError(t, err)
+	assert.Equal(t, []byte(`{"user_id": 1}`), session)
+
+	// New cookies are encoded with the current secret key base.
+	cookie, err = store.save(ctx, r, session)
+	require.NoError(t, err)
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+	session, err = oldStore.load(oldCtx, r)
+	require.NoError(t, err)
+	assert.Nil(t, session)
+
+	// A cookie encoded with a secret key base that is no longer used cannot be decoded.
+	ctx = current.WithPreviousSecretKeyBases(current.WithSecretKeyBase(context.Background(), newSKB), []string{})
+	store = &cookieSessionStore{codecs: newCookieCodecs(ctx), cookie: defaultSessionCookie()}
+	cookie, err = oldStore.save(oldCtx, httptest.NewRequest("GET", "/", nil), []byte(`{"user_id": 1}`))
+	require.NoError(t, err)
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+	session, err = store.load(ctx, r)
+	require.NoError(t, err)
+	assert.Nil(t, session)
+}
+
+func TestDatabaseSessionStoreToken(t *testing.T) {
+	store := &databaseSessionStore{cookie: defaultSessionCookie()}
+	token := []byte(strings.Repeat("t", sessionTokenLength))
+
+	for i, tt := range []struct {
+		cookieValue string
+		token       []byte
+	}{
+		{cookieValue: base64.RawURLEncoding.EncodeToString(token), token: token},
+		{cookieValue: base64.RawURLEncoding.EncodeToString(token[1:]), token: nil},
+		{cookieValue: "not base64!", token: nil},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(store.cookie.new(tt.cookieValue))
+		assert.Equalf(t, tt.token, store.token(r), "%d", i)
+	}
+
+	assert.Nil(t, store.token(httptest.NewRequest("GET", "/", nil)))
+}
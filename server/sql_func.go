@@ -0,0 +1,255 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/hannibal/db"
+	"github.com/jackc/pgx/v4"
+)
+
+// sqlFunc describes a SQL function. ArgTypes are the PostgreSQL type names as returned by format_type.
+type sqlFunc struct {
+	// CallName is the name used to call the function in SQL. Functions in the app schema are called by their
+	// unqualified name because the app schema is renamed when a deploy is activated.
+	CallName string
+
+	ArgNames []string
+	ArgModes []string
+	ArgTypes []string
+}
+
+const introspectSQLFuncSQL = `select p.proname, n.nspname, p.proargmodes::text[], p.proargnames,
+	array(select format_type(t, null) from unnest(coalesce(p.proallargtypes, p.proargtypes::oid[])) with ordinality u(t, n) order by n)
+from pg_proc p
+	join pg_namespace n on n.oid = p.pronamespace
+where p.oid = $1`
+
+// introspectSQLFunc introspects the function name. name may be qualified with a schema such as auth.login and may
+// include a signature such as login(args jsonb, cookie_session jsonb) to select one of several overloads. Unqualified
+// names are in schema.
+func introspectSQLFunc(ctx context.Context, dbconn db.DBConn, schema string, name string) (*sqlFunc, error) {
+	oid, err := resolveSQLFunc(ctx, dbconn, schema, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to introspect function %s: %v", name, err)
+	}
+
+	f, funcSchema, funcName, err := introspectSQLFuncByOID(ctx, dbconn, oid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to introspect function %s: %v", name, err)
+	}
+
+	if funcSchema == schema {
+		f.CallName = pgx.Identifier{funcName}.Sanitize()
+	} else {
+		f.CallName = pgx.Identifier{funcSchema, funcName}.Sanitize()
+	}
+
+	err = checkSQLFuncOverloads(ctx, dbconn, oid, f)
+	if err != nil {
+		return nil, fmt.Errorf("function %s: %v", name, err)
+	}
+
+	return f, nil
+}
+
+// splitSQLFuncName splits name into its schema, function name, and signature. schema is used if name is not
+// qualified.
+func splitSQLFuncName(schema string, name string) (funcSchema string, funcName string, signature string) {
+	funcName = name
+	if i := strings.IndexByte(name, '('); i != -1 {
+		funcName, signature = strings.TrimSpace(name[:i]), name[i:]
+	}
+
+	funcSchema = schema
+	if i := strings.IndexByte(funcName, '.'); i != -1 {
+		funcSchema, funcName = funcName[:i], funcName[i+1:]
+	}
+
+	return funcSchema, funcName, signature
+}
+
+// resolveSQLFunc returns the OID of the function name.
+func resolveSQLFunc(ctx context.Context, dbconn db.DBConn, schema string, name string) (uint32, error) {
+	funcSchema, funcName, signature := splitSQLFuncName(schema, name)
+
+	if signature != "" {
+		tx, err := dbconn.Begin(ctx)
+		if err != nil {
+			return 0, err
+		}
+		defer tx.Rollback(ctx)
+
+		// Types in the signature may be defined in schema. It is not in the search path during a deploy.
+		_, err = tx.Exec(ctx, "select set_config('search_path', $1 || ', ' || current_setting('search_path'), true)", db.QuoteSchema(schema))
+		if err != nil {
+			return 0, err
+		}
+
+		var oid uint32
+		err = tx.QueryRow(ctx, "select $1::regprocedure::oid", pgx.Identifier{funcSchema, funcName}.Sanitize()+signature).Scan(&oid)
+		if err != nil {
+			return 0, err
+		}
+		return oid, nil
+	}
+
+	rows, _ := dbconn.Query(ctx, "select oid from pg_proc where proname = $1 and pronamespace = ($2::text)::regnamespace", funcName, funcSchema)
+	defer rows.Close()
+
+	var oids []uint32
+	for rows.Next() {
+		var oid uint32
+		err := rows.Scan(&oid)
+		if err != nil {
+			return 0, err
+		}
+		oids = append(oids, oid)
+	}
+	if rows.Err() != nil {
+		return 0, rows.Err()
+	}
+
+	switch len(oids) {
+	case 0:
+		return 0, errors.New("function does not exist")
+	case 1:
+		return oids[0], nil
+	default:
+		return 0, fmt.Errorf("function is overloaded: specify a signature such as %s(args jsonb)", name)
+	}
+}
+
+func introspectSQLFuncByOID(ctx context.Context, dbconn db.DBConn, oid uint32) (f *sqlFunc, funcSchema string, funcName string, err error) {
+	f = &sqlFunc{}
+	err = dbconn.QueryRow(ctx, introspectSQLFuncSQL, oid).Scan(&funcName, &funcSchema, &f.ArgModes, &f.ArgNames, &f.ArgTypes)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	return f, funcSchema, funcName, nil
+}
+
+// checkSQLFuncOverloads returns an error if another overload of the function oid could be called with the in argument
+// names of f. Functions are called with named arguments so such an overload could not be distinguished. An overload
+// with additional in arguments that all have defaults can also be called with the names of f.
+func checkSQLFuncOverloads(ctx context.Context, dbconn db.DBConn, oid uint32, f *sqlFunc) error {
+	inArgs, _, err := f.inOutArgs()
+	if err != nil {
+		return err
+	}
+
+	rows, _ := dbconn.Query(ctx, `select o.oid::regprocedure::text, o.proargmodes::text[], o.proargnames, o.pronargs, o.pronargdefaults
+from pg_proc p
+	join pg_proc o on o.proname = p.proname and o.pronamespace = p.pronamespace and o.oid <> p.oid
+where p.oid = $1`, oid)
+	defer rows.Close()
+
+	for rows.Next() {
+		var signature string
+		var numInArgs, numInArgDefaults int16
+		overload := &sqlFunc{}
+		err := rows.Scan(&signature, &overload.ArgModes, &overload.ArgNames, &numInArgs, &numInArgDefaults)
+		if err != nil {
+			return err
+		}
+
+		if overload.callableWith(inArgs, int(numInArgs), int(numInArgDefaults)) {
+			return fmt.Errorf("overload %s can be called with the same argument names", signature)
+		}
+	}
+
+	return rows.Err()
+}
+
+// callableWith returns true if f can be called with exactly the named arguments in names. numInArgs is the number of
+// in arguments of f. The last numInArgDefaults of them have defaults and can be omitted.
+func (f *sqlFunc) callableWith(names map[string]struct{}, numInArgs, numInArgDefaults int) bool {
+	// proargmodes is null when all arguments are in arguments.
+	inArgNames := make([]string, 0, numInArgs)
+	for i := 0; len(inArgNames) < numInArgs; i++ {
+		if i < len(f.ArgModes) && f.ArgModes[i] != "i" && f.ArgModes[i] != "b" && f.ArgModes[i] != "v" {
+			continue
+		}
+		var name string
+		if i < len(f.ArgNames) {
+			name = f.ArgNames[i]
+		}
+		inArgNames = append(inArgNames, name)
+	}
+
+	matched := 0
+	for i, name := range inArgNames {
+		if _, ok := names[name]; ok {
+			matched++
+		} else if i < numInArgs-numInArgDefaults {
+			return false
+		}
+	}
+
+	return matched == len(names)
+}
+
+// inOutArgs returns the names of the in and out arguments of f.
+func (f *sqlFunc) inOutArgs() (inArgs map[string]struct{}, outArgs map[string]struct{}, err error) {
+	inArgs = make(map[string]struct{})
+	outArgs = make(map[string]struct{})
+
+	for i, n := range f.ArgNames {
+		var mode string
+		if len(f.ArgModes) <= i {
+			mode = "i"
+		} else {
+			mode = f.ArgModes[i]
+		}
+
+		switch mode {
+		case "i":
+			inArgs[n] = struct{}{}
+		case "o":
+			outArgs[n] = struct{}{}
+		case "b":
+			inArgs[n] = struct{}{}
+			outArgs[n] = struct{}{}
+		case "t":
+			// Column of a function declared as returns table(...).
+			outArgs[n] = struct{}{}
+		default:
+			return nil, nil, fmt.Errorf("unknown proargmode: %s", n)
+		}
+	}
+
+	return inArgs, outArgs, nil
+}
+
+// inArgTypes returns the type names of the in arguments of f by name.
+func (f *sqlFunc) inArgTypes() map[string]string {
+	types := make(map[string]string)
+	for i, n := range f.ArgNames {
+		if i < len(f.ArgModes) && f.ArgModes[i] != "i" && f.ArgModes[i] != "b" {
+			continue
+		}
+		if i < len(f.ArgTypes) {
+			types[n] = f.ArgTypes[i]
+		}
+	}
+	return types
+}
+
+// getSQLFuncArgs introspects the function name. It returns the name to call the function with and the names of its
+// in and out arguments.
+func getSQLFuncArgs(ctx context.Context, dbconn db.DBConn, schema string, name string) (callName string, inArgs map[string]struct{}, outArgs map[string]struct{}, err error) {
+	f, err := introspectSQLFunc(ctx, dbconn, schema, name)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	inArgs, outArgs, err = f.inOutArgs()
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	return f.CallName, inArgs, outArgs, nil
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitSQLFuncName(t *testing.T) {
+	for i, tt := range []struct {
+		name       string
+		funcSchema string
+		funcName   string
+		signature  string
+	}{
+		{name: "get_todos", funcSchema: "app", funcName: "get_todos"},
+		{name: "auth.login", funcSchema: "auth", funcName: "login"},
+		{name: "login(args jsonb, cookie_session jsonb)", funcSchema: "app", funcName: "login", signature: "(args jsonb, cookie_session jsonb)"},
+		{name: "auth.login (jsonb)", funcSchema: "auth", funcName: "login", signature: "(jsonb)"},
+		{name: "get_todos()", funcSchema: "app", funcName: "get_todos", signature: "()"},
+	} {
+		funcSchema, funcName, signature := splitSQLFuncName("app", tt.name)
+		assert.Equalf(t, tt.funcSchema, funcSchema, "%d: %s", i, tt.name)
+		assert.Equalf(t, tt.funcName, funcName, "%d: %s", i, tt.name)
+		assert.Equalf(t, tt.signature, signature, "%d: %s", i, tt.name)
+	}
+}
+
+func TestSQLFuncCallableWith(t *testing.T) {
+	for i, tt := range []struct {
+		desc             string
+		f                *sqlFunc
+		numInArgs        int
+		numInArgDefaults int
+		names            []string
+		callable         bool
+	}{
+		{
+			desc:      "same names",
+			f:         &sqlFunc{ArgNames: []string{"args", "resp_body"}, ArgModes: []string{"i", "o"}},
+			numInArgs: 1,
+			names:     []string{"args"},
+			callable:  true,
+		},
+		{
+			desc:      "additional required argument",
+			f:         &sqlFunc{ArgNames: []string{"args", "cookie_session", "resp_body"}, ArgModes: []string{"i", "i", "o"}},
+			numInArgs: 2,
+			names:     []string{"args"},
+			callable:  false,
+		},
+		{
+			desc:             "additional argument with default",
+			f:                &sqlFunc{ArgNames: []string{"args", "cookie_session", "resp_body"}, ArgModes: []string{"i", "i", "o"}},
+			numInArgs:        2,
+			numInArgDefaults: 1,
+			names:            []string{"args"},
+			callable:         true,
+		},
+		{
+			desc:             "missing argument",
+			f:                &sqlFunc{ArgNames: []string{"args"}},
+			numInArgs:        1,
+			numInArgDefaults: 1,
+			names:            []string{"args", "cookie_session"},
+			callable:         false,
+		},
+		{
+			desc:             "all in arguments without modes",
+			f:                &sqlFunc{ArgNames: []string{"args", "cookie_session"}},
+			numInArgs:        2,
+			numInArgDefaults: 1,
+			names:            []string{"args"},
+			callable:         true,
+		},
+		{
+			desc:      "unnamed argument",
+			f:         &sqlFunc{},
+			numInArgs: 1,
+			names:     []string{},
+			callable:  false,
+		},
+		{
+			desc:     "no arguments",
+			f:        &sqlFunc{},
+			names:    []string{},
+			callable: true,
+		},
+	} {
+		names := make(map[string]struct{}, len(tt.names))
+		for _, n := range tt.names {
+			names[n] = struct{}{}
+		}
+		assert.Equalf(t, tt.callable, tt.f.callableWith(names, tt.numInArgs, tt.numInArgDefaults), "%d: %s", i, tt.desc)
+	}
+}
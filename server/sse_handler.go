@@ -0,0 +1,202 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jackc/hannibal/appconf"
+	"github.com/jackc/hannibal/current"
+	"github.com/jackc/hannibal/db"
+)
+
+// sseKeepAliveInterval is how often a comment is sent on an idle event stream. This prevents proxies from closing the
+// connection and detects disconnected clients.
+const sseKeepAliveInterval = 30 * time.Second
+
+// SSEHandler sends PostgreSQL notifications to the client as server-sent events. Each notification is sent as an event
+// named for the channel it was received on with the payload as its data.
+//
+// The channels are either the static Channel or the result of ChannelsFunc. ChannelsFunc returns a text[] and can be
+// used to authorize the request. If it returns null or an empty array the request is forbidden.
+//
+// If FilterFunc is set it is called for each notification with the additional in arguments channel and payload. It
+// returns the text to send as the event data or null to skip the notification.
+type SSEHandler struct {
+	Params         []*RequestParam
+	Channel        string
+	ChannelsFunc   *sqlFuncCall
+	FilterFunc     *sqlFuncCall
+	ErrorResponses []*ErrorResponse
+	RequestHeaders []string
+	Host           *Host
+}
+
+func newSSEHandlerFromAppConfig(ctx context.Context, dbconn db.DBConn, schema string, acsse *appconf.SSE) (*SSEHandler, error) {
+	if (acsse.Channel == "") == (acsse.ChannelsFunc == "") {
+		return nil, errors.New("sse must have exactly one of channel and channels-func")
+	}
+
+	h := &SSEHandler{
+		Channel: acsse.Channel,
+	}
+
+	if acsse.ChannelsFunc != "" {
+		callName, inArgs, _, err := getSQLFuncArgs(ctx, dbconn, schema, acsse.ChannelsFunc)
+		if err != nil {
+			return nil, err
+		}
+
+		h.ChannelsFunc, err = newSQLFuncCall(callName, inArgs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build call for function %s: %v", acsse.ChannelsFunc, err)
+		}
+	}
+
+	if acsse.FilterFunc != "" {
+		callName, inArgs, _, err := getSQLFuncArgs(ctx, dbconn, schema, acsse.FilterFunc)
+		if err != nil {
+			return nil, err
+		}
+
+		h.FilterFunc, err = newSQLFuncCall(callName, inArgs, "channel", "payload")
+		if err != nil {
+			return nil, fmt.Errorf("failed to build call for function %s: %v", acsse.FilterFunc, err)
+		}
+	}
+
+	return h, nil
+}
+
+func (h *SSEHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		panic("response writer does not support flushing")
+	}
+
+	rawArgs, err := extractRawArgs(r, h.Params, h.Host.UploadPath)
+	if err != nil {
+		panic(err)
+	}
+
+	queryArgs := parseRequestParams(h.Params, rawArgs)
+	requestCookieSession, err := h.Host.readCookieSession(r)
+	if err != nil {
+		logQueryError(ctx, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	sqlArgs := &httpSQLArgs{
+		queryArgs:      queryArgs,
+		rawArgs:        rawArgs,
+		cookieSession:  requestCookieSession,
+		request:        r,
+		requestHeaders: h.RequestHeaders,
+	}
+
+	var channels []string
+	if h.ChannelsFunc != nil {
+		err := contextDBIdentity(ctx).run(ctx, sqlArgs, func(conn db.DBConn) error {
+			return conn.QueryRow(ctx, h.ChannelsFunc.SQL, buildHTTPSQLArgs(h.ChannelsFunc.FuncInArgs, sqlArgs)...).Scan(&channels)
+		})
+		if err != nil {
+			handleQueryError(w, r, h.ErrorResponses, err)
+			return
+		}
+		if len(channels) == 0 {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+	} else {
+		channels = []string{h.Channel}
+	}
+
+	listener := h.Host.getNotifyListener(ctx)
+	sub := listener.Subscribe(channels)
+	defer listener.Unsubscribe(sub)
+
+	// The stream may stay open indefinitely. It must not prevent the app from being reloaded or deployed.
+	releaseInstallLock(r)
+
+	// Wait until notifications cannot be missed before telling the client the stream is open.
+	select {
+	case <-sub.Listening:
+	case <-ctx.Done():
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-keepAlive.C:
+			io.WriteString(w, ": keepalive\n\n")
+			flusher.Flush()
+		case notification, ok := <-sub.C:
+			if !ok {
+				return
+			}
+
+			data := notification.Payload
+			if h.FilterFunc != nil {
+				sqlArgs.extra = map[string]interface{}{
+					"channel": notification.Channel,
+					"payload": notification.Payload,
+				}
+
+				var filtered *string
+				err := contextDBIdentity(ctx).run(ctx, sqlArgs, func(conn db.DBConn) error {
+					return conn.QueryRow(ctx, h.FilterFunc.SQL, buildHTTPSQLArgs(h.FilterFunc.FuncInArgs, sqlArgs)...).Scan(&filtered)
+				})
+				if err != nil {
+					if ctx.Err() == nil {
+						logQueryError(ctx, err)
+					}
+					return
+				}
+				if filtered == nil {
+					continue
+				}
+				data = *filtered
+			}
+
+			err := writeSSEEvent(w, notification.Channel, data)
+			if err != nil {
+				current.Logger(ctx).Debug().Err(err).Msg("failed to write event")
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// writeSSEEvent writes an event in the text/event-stream format. Each line of data is written as a separate data field.
+func writeSSEEvent(w io.Writer, event string, data string) error {
+	sb := &strings.Builder{}
+	if event != "" {
+		fmt.Fprintf(sb, "event: %s\n", event)
+	}
+	for _, line := range strings.Split(strings.ReplaceAll(data, "\r\n", "\n"), "\n") {
+		fmt.Fprintf(sb, "data: %s\n", line)
+	}
+	sb.WriteString("\n")
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
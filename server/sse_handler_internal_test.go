@@ -0,0 +1,28 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteSSEEvent(t *testing.T) {
+	for i, tt := range []struct {
+		event    string
+		data     string
+		expected string
+	}{
+		{event: "todos", data: `{"id":1}`, expected: "event: todos\ndata: {\"id\":1}\n\n"},
+		{event: "", data: "hello", expected: "data: hello\n\n"},
+		{event: "todos", data: "", expected: "event: todos\ndata: \n\n"},
+		{event: "todos", data: "line 1\nline 2", expected: "event: todos\ndata: line 1\ndata: line 2\n\n"},
+		{event: "todos", data: "line 1\r\nline 2", expected: "event: todos\ndata: line 1\ndata: line 2\n\n"},
+	} {
+		buf := &bytes.Buffer{}
+		err := writeSSEEvent(buf, tt.event, tt.data)
+		require.NoErrorf(t, err, "%d", i)
+		assert.Equalf(t, tt.expected, buf.String(), "%d", i)
+	}
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/hannibal/appconf"
+	"github.com/jackc/hannibal/current"
+	"github.com/jackc/hannibal/db"
+	"github.com/jackc/pgconn"
+)
+
+const defaultTransactionMaxRetries = 3
+
+// Transaction configures the transaction a route function is called in.
+type Transaction struct {
+	Isolation        string
+	ReadOnly         bool
+	StatementTimeout time.Duration
+	LockTimeout      time.Duration
+	TimeZone         string
+	MaxRetries       int
+}
+
+func transactionFromAppConfig(act *appconf.Transaction) (*Transaction, error) {
+	t := &Transaction{
+		ReadOnly: act.ReadOnly,
+		TimeZone: act.TimeZone,
+	}
+
+	switch strings.ToLower(act.Isolation) {
+	case "":
+	case "serializable":
+		t.Isolation = "serializable"
+	case "repeatable-read", "repeatable read":
+		t.Isolation = "repeatable read"
+	case "read-committed", "read committed":
+		t.Isolation = "read committed"
+	default:
+		return nil, fmt.Errorf("bad transaction.isolation value: %s", act.Isolation)
+	}
+
+	if act.StatementTimeout != "" {
+		var err error
+		t.StatementTimeout, err = time.ParseDuration(act.StatementTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("bad transaction.statement-timeout value: %v", err)
+		}
+		// PostgreSQL timeouts are whole milliseconds and 0 disables the timeout.
+		if t.StatementTimeout < time.Millisecond {
+			return nil, fmt.Errorf("transaction.statement-timeout must be at least 1ms: %s", act.StatementTimeout)
+		}
+	}
+
+	if act.LockTimeout != "" {
+		var err error
+		t.LockTimeout, err = time.ParseDuration(act.LockTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("bad transaction.lock-timeout value: %v", err)
+		}
+		if t.LockTimeout < time.Millisecond {
+			return nil, fmt.Errorf("transaction.lock-timeout must be at least 1ms: %s", act.LockTimeout)
+		}
+	}
+
+	if act.MaxRetries != nil {
+		if *act.MaxRetries < 0 {
+			return nil, fmt.Errorf("transaction.max-retries must not be negative: %d", *act.MaxRetries)
+		}
+		t.MaxRetries = *act.MaxRetries
+	} else {
+		t.MaxRetries = defaultTransactionMaxRetries
+	}
+
+	return t, nil
+}
+
+// SetupSQL returns the SQL to execute at the beginning of each transaction. It returns an empty string if there is
+// nothing to set.
+func (t *Transaction) SetupSQL() string {
+	var statements []string
+
+	var modes []string
+	if t.Isolation != "" {
+		modes = append(modes, fmt.Sprintf("isolation level %s", t.Isolation))
+	}
+	if t.ReadOnly {
+		modes = append(modes, "read only")
+	}
+	if len(modes) > 0 {
+		statements = append(statements, fmt.Sprintf("set transaction %s", strings.Join(modes, ", ")))
+	}
+
+	if t.StatementTimeout != 0 {
+		statements = append(statements, fmt.Sprintf("set local statement_timeout = %d", t.StatementTimeout.Milliseconds()))
+	}
+	if t.LockTimeout != 0 {
+		statements = append(statements, fmt.Sprintf("set local lock_timeout = %d", t.LockTimeout.Milliseconds()))
+	}
+	if t.TimeZone != "" {
+		statements = append(statements, fmt.Sprintf("set local time zone %s", quoteLiteral(t.TimeZone)))
+	}
+
+	return strings.Join(statements, "; ")
+}
+
+// Run calls f in a transaction. If the transaction fails with a serialization failure or a deadlock it is retried up
+// to MaxRetries times.
+func (t *Transaction) Run(ctx context.Context, conn db.DBConn, f func(db.DBConn) error) error {
+	for attempt := 0; ; attempt++ {
+		err := t.runOnce(ctx, conn, f)
+		if err == nil {
+			return nil
+		}
+
+		if attempt >= t.MaxRetries || !isRetryableTransactionError(err) {
+			return err
+		}
+
+		current.Logger(ctx).Info().Err(err).Int("attempt", attempt+1).Msg("retrying transaction")
+	}
+}
+
+func (t *Transaction) runOnce(ctx context.Context, conn db.DBConn, f func(db.DBConn) error) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if setupSQL := t.SetupSQL(); setupSQL != "" {
+		_, err = tx.Exec(ctx, setupSQL)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = f(tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+func isRetryableTransactionError(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		// serialization_failure and deadlock_detected
+		return pgErr.Code == "40001" || pgErr.Code == "40P01"
+	}
+	return false
+}
+
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
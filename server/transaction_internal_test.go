@@ -0,0 +1,40 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jackc/hannibal/appconf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransactionFromAppConfigMaxRetries(t *testing.T) {
+	intPtr := func(n int) *int { return &n }
+
+	tx, err := transactionFromAppConfig(&appconf.Transaction{})
+	require.NoError(t, err)
+	assert.Equal(t, defaultTransactionMaxRetries, tx.MaxRetries)
+
+	tx, err = transactionFromAppConfig(&appconf.Transaction{MaxRetries: intPtr(0)})
+	require.NoError(t, err)
+	assert.Equal(t, 0, tx.MaxRetries)
+
+	_, err = transactionFromAppConfig(&appconf.Transaction{MaxRetries: intPtr(-1)})
+	require.EqualError(t, err, "transaction.max-retries must not be negative: -1")
+}
+
+func TestTransactionFromAppConfigTimeouts(t *testing.T) {
+	tx, err := transactionFromAppConfig(&appconf.Transaction{StatementTimeout: "2s", LockTimeout: "1ms"})
+	require.NoError(t, err)
+	assert.Equal(t, 2*time.Second, tx.StatementTimeout)
+	assert.Equal(t, time.Millisecond, tx.LockTimeout)
+
+	for _, s := range []string{"0s", "-1s", "500us"} {
+		_, err = transactionFromAppConfig(&appconf.Transaction{StatementTimeout: s})
+		assert.EqualErrorf(t, err, "transaction.statement-timeout must be at least 1ms: "+s, "%s", s)
+
+		_, err = transactionFromAppConfig(&appconf.Transaction{LockTimeout: s})
+		assert.EqualErrorf(t, err, "transaction.lock-timeout must be at least 1ms: "+s, "%s", s)
+	}
+}
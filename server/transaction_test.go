@@ -0,0 +1,52 @@
+package server_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jackc/hannibal/server"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransactionSetupSQL(t *testing.T) {
+	for _, tt := range []struct {
+		desc string
+		t    *server.Transaction
+		sql  string
+	}{
+		{
+			desc: "empty",
+			t:    &server.Transaction{},
+			sql:  "",
+		},
+		{
+			desc: "isolation",
+			t:    &server.Transaction{Isolation: "serializable"},
+			sql:  "set transaction isolation level serializable",
+		},
+		{
+			desc: "isolation and read only",
+			t:    &server.Transaction{Isolation: "repeatable read", ReadOnly: true},
+			sql:  "set transaction isolation level repeatable read, read only",
+		},
+		{
+			desc: "timeouts",
+			t:    &server.Transaction{StatementTimeout: 2 * time.Second, LockTimeout: 500 * time.Millisecond},
+			sql:  "set local statement_timeout = 2000; set local lock_timeout = 500",
+		},
+		{
+			desc: "time zone",
+			t:    &server.Transaction{TimeZone: "America/Chicago"},
+			sql:  "set local time zone 'America/Chicago'",
+		},
+		{
+			desc: "time zone with quote",
+			t:    &server.Transaction{TimeZone: "it's"},
+			sql:  "set local time zone 'it''s'",
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			assert.Equal(t, tt.sql, tt.t.SetupSQL())
+		})
+	}
+}
@@ -0,0 +1,434 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/jackc/hannibal/appconf"
+	"github.com/jackc/hannibal/current"
+	"github.com/jackc/hannibal/db"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+)
+
+const (
+	defaultWebSocketPingInterval   = 30 * time.Second
+	defaultWebSocketMaxMessageSize = 64 * 1024
+
+	// webSocketWriteWait is the time allowed to write a message to the client.
+	webSocketWriteWait = 10 * time.Second
+
+	// webSocketOutgoingBufferSize is the number of responses that can be queued for writing to the client.
+	webSocketOutgoingBufferSize = 16
+
+	// pgRaiseExceptionCode is the SQLSTATE of raise exception without an explicit errcode.
+	pgRaiseExceptionCode = "P0001"
+)
+
+var allowedWebSocketOutArgs = []string{"response", "state"}
+
+// WebSocketHandler dispatches JSON messages received on a WebSocket to functions and sends PostgreSQL notifications
+// to the client.
+//
+// Each message must be a JSON object with a type field. The function for that type is called with the additional in
+// arguments message and state. message is the entire message. state is a jsonb value that is kept for the life of the
+// connection. It starts as an empty object. The function may return the out arguments response and state. A non-null
+// response is sent to the client. A non-null state replaces the connection state.
+//
+// Notifications on Channels or the channels returned by ChannelsFunc are sent to the client as
+// {"type": "notification", "channel": ..., "payload": ...}. If the payload is valid JSON it is included as JSON.
+// Otherwise it is included as a string.
+type WebSocketHandler struct {
+	Params         []*RequestParam
+	MessageFuncs   map[string]*webSocketMessageFunc
+	Channels       []string
+	ChannelsFunc   *sqlFuncCall
+	RequireSession bool
+	MaxConnections int
+	MaxMessageSize int64
+	PingInterval   time.Duration
+	ErrorResponses []*ErrorResponse
+	RequestHeaders []string
+	Host           *Host
+
+	upgrader        websocket.Upgrader
+	connectionCount int64
+}
+
+type webSocketMessageFunc struct {
+	SQL        string
+	FuncInArgs []string
+}
+
+func newWebSocketMessageFunc(name string, inArgMap map[string]struct{}, outArgMap map[string]struct{}) (*webSocketMessageFunc, error) {
+	if name == "" {
+		return nil, errors.New("name cannot be empty")
+	}
+
+	inArgs, err := orderInArgs(inArgMap, "message", "state")
+	if err != nil {
+		return nil, err
+	}
+
+	sb := &strings.Builder{}
+
+	sb.WriteString("select ")
+	for i, arg := range allowedWebSocketOutArgs {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		if _, ok := outArgMap[arg]; ok {
+			delete(outArgMap, arg)
+			sb.WriteString(arg)
+		} else {
+			fmt.Fprintf(sb, "null as %s", arg)
+		}
+	}
+
+	fmt.Fprintf(sb, " from %s(", name)
+	for i, arg := range inArgs {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		fmt.Fprintf(sb, "%s => $%d", pgx.Identifier{arg}.Sanitize(), i+1)
+	}
+	sb.WriteString(")")
+
+	for k := range outArgMap {
+		return nil, fmt.Errorf("unknown arg: %s", k)
+	}
+
+	mf := &webSocketMessageFunc{
+		SQL:        sb.String(),
+		FuncInArgs: inArgs,
+	}
+
+	return mf, nil
+}
+
+func newWebSocketHandlerFromAppConfig(ctx context.Context, dbconn db.DBConn, schema string, acws *appconf.WebSocket) (*WebSocketHandler, error) {
+	if acws.Channels != nil && acws.ChannelsFunc != "" {
+		return nil, errors.New("websocket cannot have both channels and channels-func")
+	}
+
+	h := &WebSocketHandler{
+		MessageFuncs:   make(map[string]*webSocketMessageFunc, len(acws.Messages)),
+		Channels:       acws.Channels,
+		RequireSession: acws.RequireSession,
+		MaxConnections: acws.MaxConnections,
+		MaxMessageSize: acws.MaxMessageSize,
+		PingInterval:   defaultWebSocketPingInterval,
+	}
+
+	if h.MaxMessageSize == 0 {
+		h.MaxMessageSize = defaultWebSocketMaxMessageSize
+	}
+
+	if acws.PingInterval != "" {
+		var err error
+		h.PingInterval, err = time.ParseDuration(acws.PingInterval)
+		if err != nil {
+			return nil, fmt.Errorf("bad websocket.ping-interval value: %v", err)
+		}
+		if h.PingInterval <= 0 {
+			return nil, fmt.Errorf("websocket.ping-interval must be positive: %s", acws.PingInterval)
+		}
+	}
+
+	for _, m := range acws.Messages {
+		if m.Type == "" {
+			return nil, errors.New("websocket message type cannot be empty")
+		}
+		if _, ok := h.MessageFuncs[m.Type]; ok {
+			return nil, fmt.Errorf("duplicate websocket message type: %s", m.Type)
+		}
+
+		callName, inArgs, outArgs, err := getSQLFuncArgs(ctx, dbconn, schema, m.Func)
+		if err != nil {
+			return nil, err
+		}
+
+		h.MessageFuncs[m.Type], err = newWebSocketMessageFunc(callName, inArgs, outArgs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build call for function %s: %v", m.Func, err)
+		}
+	}
+
+	if acws.ChannelsFunc != "" {
+		callName, inArgs, _, err := getSQLFuncArgs(ctx, dbconn, schema, acws.ChannelsFunc)
+		if err != nil {
+			return nil, err
+		}
+
+		h.ChannelsFunc, err = newSQLFuncCall(callName, inArgs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build call for function %s: %v", acws.ChannelsFunc, err)
+		}
+	}
+
+	return h, nil
+}
+
+func (h *WebSocketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	rawArgs, err := extractRawArgs(r, h.Params, h.Host.UploadPath)
+	if err != nil {
+		panic(err)
+	}
+
+	queryArgs := parseRequestParams(h.Params, rawArgs)
+	requestCookieSession, err := h.Host.readCookieSession(r)
+	if err != nil {
+		logQueryError(ctx, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if h.RequireSession && requestCookieSession == nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	sqlArgs := &httpSQLArgs{
+		queryArgs:      queryArgs,
+		rawArgs:        rawArgs,
+		cookieSession:  requestCookieSession,
+		request:        r,
+		requestHeaders: h.RequestHeaders,
+	}
+
+	channels := h.Channels
+	if h.ChannelsFunc != nil {
+		err := contextDBIdentity(ctx).run(ctx, sqlArgs, func(conn db.DBConn) error {
+			return conn.QueryRow(ctx, h.ChannelsFunc.SQL, buildHTTPSQLArgs(h.ChannelsFunc.FuncInArgs, sqlArgs)...).Scan(&channels)
+		})
+		if err != nil {
+			handleQueryError(w, r, h.ErrorResponses, err)
+			return
+		}
+		if len(channels) == 0 {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+	}
+
+	connectionCount := atomic.AddInt64(&h.connectionCount, 1)
+	defer atomic.AddInt64(&h.connectionCount, -1)
+	if h.MaxConnections > 0 && connectionCount > int64(h.MaxConnections) {
+		http.Error(w, "Too many connections", http.StatusServiceUnavailable)
+		return
+	}
+
+	// The connection may stay open indefinitely. It must not prevent the app from being reloaded or deployed.
+	releaseInstallLock(r)
+
+	var notifications <-chan *pgconn.Notification
+	if len(channels) > 0 {
+		listener := h.Host.getNotifyListener(ctx)
+		sub := listener.Subscribe(channels)
+		defer listener.Unsubscribe(sub)
+		notifications = sub.C
+
+		// Wait until notifications cannot be missed before accepting the connection.
+		select {
+		case <-sub.Listening:
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	// The upgrader rejects cross origin requests. This prevents other sites from using the session cookie.
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already responded to the client.
+		return
+	}
+	defer conn.Close()
+
+	h.Host.trackWebSocket(conn)
+	defer h.Host.untrackWebSocket(conn)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	outgoing := make(chan []byte, webSocketOutgoingBufferSize)
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		h.writeLoop(ctx, conn, outgoing, notifications)
+		// Closing the connection ends readLoop.
+		conn.Close()
+	}()
+
+	h.readLoop(ctx, conn, sqlArgs, outgoing)
+	cancel()
+	<-writerDone
+}
+
+// readLoop reads messages from conn and dispatches them until the connection fails or is closed.
+func (h *WebSocketHandler) readLoop(ctx context.Context, conn *websocket.Conn, sqlArgs *httpSQLArgs, outgoing chan<- []byte) {
+	pongWait := 2 * h.PingInterval
+
+	conn.SetReadLimit(h.MaxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	state := []byte("{}")
+
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				current.Logger(ctx).Debug().Err(err).Msg("websocket read failed")
+			}
+			return
+		}
+
+		response, err := h.handleMessage(ctx, message, sqlArgs, &state)
+		if err != nil {
+			logQueryError(ctx, err)
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInternalServerErr, ""), time.Now().Add(webSocketWriteWait))
+			return
+		}
+
+		if response != nil {
+			select {
+			case outgoing <- response:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// handleMessage calls the function for message and returns the response to send to the client. Database errors that
+// match ErrorResponses or are raised by the function with raise exception are returned as an error message response
+// with their code and message. Other database errors are logged and returned as a generic error message response.
+func (h *WebSocketHandler) handleMessage(ctx context.Context, message []byte, sqlArgs *httpSQLArgs, state *[]byte) ([]byte, error) {
+	var envelope struct {
+		Type string `json:"type"`
+	}
+	err := json.Unmarshal(message, &envelope)
+	if err != nil {
+		return webSocketErrorMessage("", "message must be a JSON object with a type"), nil
+	}
+
+	mf, ok := h.MessageFuncs[envelope.Type]
+	if !ok {
+		return webSocketErrorMessage("", fmt.Sprintf("unknown message type: %s", envelope.Type)), nil
+	}
+
+	sqlArgs.extra = map[string]interface{}{
+		"message": message,
+		"state":   *state,
+	}
+
+	var response, newState []byte
+	err = contextDBIdentity(ctx).run(ctx, sqlArgs, func(conn db.DBConn) error {
+		return conn.QueryRow(ctx, mf.SQL, buildHTTPSQLArgs(mf.FuncInArgs, sqlArgs)...).Scan(&response, &newState)
+	})
+	if err != nil {
+		if er, pgErr := findErrorResponse(h.ErrorResponses, err); er != nil {
+			current.Logger(ctx).Info().Str("pgCode", pgErr.Code).Str("pgMessage", pgErr.Message).Msg("mapped database error to websocket error message")
+			return webSocketErrorMessage(pgErr.Code, pgErr.Message), nil
+		}
+
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) {
+			// Errors raised by the function with a plain raise exception are meant for the client. Other errors may
+			// reveal details of the database.
+			if pgErr.Code == pgRaiseExceptionCode {
+				return webSocketErrorMessage(pgErr.Code, pgErr.Message), nil
+			}
+			logQueryError(ctx, err)
+			return webSocketErrorMessage("", "internal server error"), nil
+		}
+		return nil, err
+	}
+
+	if newState != nil {
+		*state = newState
+	}
+
+	return response, nil
+}
+
+// writeLoop writes responses and notifications to conn and pings the client until ctx is canceled, the notifications
+// channel is closed, or a write fails.
+func (h *WebSocketHandler) writeLoop(ctx context.Context, conn *websocket.Conn, outgoing <-chan []byte, notifications <-chan *pgconn.Notification) {
+	ping := time.NewTicker(h.PingInterval)
+	defer ping.Stop()
+
+	for {
+		var message []byte
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ping.C:
+			err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(webSocketWriteWait))
+			if err != nil {
+				return
+			}
+			continue
+		case message = <-outgoing:
+		case notification, ok := <-notifications:
+			if !ok {
+				conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(webSocketWriteWait))
+				return
+			}
+			message = webSocketNotificationMessage(notification)
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(webSocketWriteWait))
+		err := conn.WriteMessage(websocket.TextMessage, message)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func webSocketNotificationMessage(notification *pgconn.Notification) []byte {
+	var payload interface{} = notification.Payload
+	if json.Valid([]byte(notification.Payload)) {
+		payload = json.RawMessage(notification.Payload)
+	}
+
+	buf, err := json.Marshal(map[string]interface{}{
+		"type":    "notification",
+		"channel": notification.Channel,
+		"payload": payload,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	return buf
+}
+
+func webSocketErrorMessage(code string, message string) []byte {
+	data := map[string]interface{}{
+		"type":    "error",
+		"message": message,
+	}
+	if code != "" {
+		data["code"] = code
+	}
+
+	buf, err := json.Marshal(data)
+	if err != nil {
+		panic(err)
+	}
+
+	return buf
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/jackc/pgconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewWebSocketMessageFunc(t *testing.T) {
+	mf, err := newWebSocketMessageFunc(
+		"ws_echo",
+		map[string]struct{}{"message": {}, "state": {}, "cookie_session": {}},
+		map[string]struct{}{"response": {}, "state": {}},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, `select response, state from ws_echo("cookie_session" => $1, "message" => $2, "state" => $3)`, mf.SQL)
+	assert.Equal(t, []string{"cookie_session", "message", "state"}, mf.FuncInArgs)
+
+	mf, err = newWebSocketMessageFunc("ws_noop", map[string]struct{}{}, map[string]struct{}{})
+	require.NoError(t, err)
+	assert.Equal(t, "select null as response, null as state from ws_noop()", mf.SQL)
+
+	_, err = newWebSocketMessageFunc("ws_bad", map[string]struct{}{"payload": {}}, map[string]struct{}{})
+	assert.EqualError(t, err, "unknown arg: payload")
+
+	_, err = newWebSocketMessageFunc("ws_bad", map[string]struct{}{}, map[string]struct{}{"status": {}})
+	assert.EqualError(t, err, "unknown arg: status")
+}
+
+func TestWebSocketNotificationMessage(t *testing.T) {
+	for i, tt := range []struct {
+		payload  string
+		expected string
+	}{
+		{payload: `{"id":1}`, expected: `{"channel":"todos","payload":{"id":1},"type":"notification"}`},
+		{payload: `42`, expected: `{"channel":"todos","payload":42,"type":"notification"}`},
+		{payload: `hello`, expected: `{"channel":"todos","payload":"hello","type":"notification"}`},
+		{payload: ``, expected: `{"channel":"todos","payload":"","type":"notification"}`},
+	} {
+		message := webSocketNotificationMessage(&pgconn.Notification{Channel: "todos", Payload: tt.payload})
+		assert.Equalf(t, tt.expected, string(message), "%d", i)
+	}
+}
@@ -0,0 +1,30 @@
+do $$
+begin
+  if not exists (select 1 from pg_roles where rolname = 'hannibal_test_rls_user') then
+    create role hannibal_test_rls_user nologin;
+  end if;
+  if not exists (select 1 from pg_roles where rolname = 'hannibal_test_rls_admin') then
+    create role hannibal_test_rls_admin nologin;
+  end if;
+end
+$$;
+
+create table notes (
+  id int primary key generated by default as identity,
+  user_id int not null default current_setting('app.user_id')::int,
+  body text not null
+);
+
+alter table notes enable row level security;
+
+create policy notes_owner on notes to hannibal_test_rls_user
+  using (user_id = nullif(current_setting('app.user_id', true), '')::int);
+
+create policy notes_admin on notes to hannibal_test_rls_admin
+  using (true);
+
+grant select, insert on notes to hannibal_test_rls_user, hannibal_test_rls_admin;
+
+insert into notes (user_id, body) values
+  (1, 'Jack note'),
+  (2, 'John note');
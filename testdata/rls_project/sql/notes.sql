@@ -0,0 +1,71 @@
+-- The app schema is replaced on each deploy.
+do $$
+begin
+  execute format('grant usage on schema %I to hannibal_test_rls_user, hannibal_test_rls_admin', current_schema());
+end
+$$;
+
+create function identify_user(cookie_session jsonb) returns jsonb
+language sql as $$
+  select jsonb_build_object('settings', jsonb_build_object('app.user_id', cookie_session->>'user_id'))
+  where cookie_session ? 'user_id';
+$$;
+
+create function http_login(
+  args jsonb,
+  out cookie_session jsonb,
+  out status smallint
+)
+language plpgsql as $$
+begin
+  cookie_session := jsonb_build_object('user_id', args->'user_id');
+  status := 200;
+end;
+$$;
+
+create function http_whoami(
+  out resp_body jsonb
+)
+language plpgsql as $$
+begin
+  resp_body := jsonb_build_object(
+    'role', current_user,
+    'user_id', current_setting('app.user_id', true)
+  );
+end;
+$$;
+
+create function http_get_notes(
+  out resp_body jsonb
+)
+language plpgsql as $$
+begin
+  resp_body := coalesce((select jsonb_agg(body order by id) from notes), '[]');
+end;
+$$;
+
+create function http_create_note(
+  args jsonb,
+  out status smallint
+)
+language plpgsql as $$
+begin
+  insert into notes (body) values (args->>'body');
+  status := 201;
+end;
+$$;
+
+create function http_stream_notes(
+  args jsonb
+) returns table(body text)
+language sql as $$
+  select body from notes order by id;
+$$;
+
+create function ws_notes(
+  message jsonb,
+  out response jsonb
+)
+language sql as $$
+  select jsonb_build_object('type', 'notes', 'notes', coalesce((select jsonb_agg(body order by id) from notes), '[]'));
+$$;
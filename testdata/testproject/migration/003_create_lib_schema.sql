@@ -0,0 +1,9 @@
+create schema lib;
+
+create function lib.greeting(
+  args jsonb,
+  out resp_body jsonb
+)
+language sql as $$
+  select jsonb_build_object('greeting', 'Hello, ' || (args ->> 'name') || '!');
+$$;
@@ -0,0 +1,14 @@
+create function authenticate_token(token text) returns jsonb
+language sql as $$
+  select case when token = 'secret-token' then jsonb_build_object('user_id', 1, 'scheme', 'bearer') end;
+$$;
+
+create function authenticate_basic(username text, password text) returns jsonb
+language sql as $$
+  select case when username = 'jack' and password = 'secret' then jsonb_build_object('user_id', 2, 'scheme', 'basic') end;
+$$;
+
+create function http_whoami(principal jsonb, out resp_body jsonb)
+language sql as $$
+  select jsonb_build_object('principal', principal);
+$$;
@@ -0,0 +1,21 @@
+create function http_get_attachment(
+  out resp_bytes bytea,
+  out content_type text,
+  out filename text
+)
+language plpgsql as $$
+begin
+  resp_bytes := convert_to('0123456789', 'UTF8');
+  content_type := 'application/pdf';
+  filename := 'report.pdf';
+end;
+$$;
+
+create function http_get_text(
+  out resp_text text
+)
+language plpgsql as $$
+begin
+  resp_text := 'Hello, text!';
+end;
+$$;
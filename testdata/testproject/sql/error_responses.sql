@@ -0,0 +1,35 @@
+create function http_raise_unique_violation(
+  out resp_body jsonb
+)
+language plpgsql as $$
+begin
+  raise unique_violation using message = 'name already taken', constraint = 'todos_name_key';
+end;
+$$;
+
+create function http_raise_not_found(
+  out resp_body jsonb
+)
+language plpgsql as $$
+begin
+  raise exception 'todo not found' using hint = 'http:404';
+end;
+$$;
+
+create function http_raise_custom_code(
+  out resp_body jsonb
+)
+language plpgsql as $$
+begin
+  raise exception 'payment required' using errcode = 'HN402';
+end;
+$$;
+
+create function http_raise_unmapped(
+  out resp_body jsonb
+)
+language plpgsql as $$
+begin
+  raise exception 'unmapped failure';
+end;
+$$;
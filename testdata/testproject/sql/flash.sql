@@ -0,0 +1,15 @@
+create function http_flash_save(
+  args jsonb,
+  out redirect text,
+  out flash jsonb
+)
+language sql as $$
+  select args ->> 'redirect', jsonb_build_object('notice', 'Saved!');
+$$;
+
+create function http_flash_show(
+  out template text
+)
+language sql as $$
+  select 'flash.html';
+$$;
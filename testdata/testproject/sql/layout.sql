@@ -0,0 +1,14 @@
+create function http_layout(
+  args jsonb,
+  out template text,
+  out template_data jsonb,
+  out layout text,
+  out template_block text
+)
+language sql as $$
+  select
+    'layout_page.html',
+    jsonb_build_object('title', 'Items', 'items', array['a', 'b']),
+    case when args ->> 'layout' = 'none' then '' end,
+    args ->> 'block';
+$$;
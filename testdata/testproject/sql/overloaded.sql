@@ -0,0 +1,16 @@
+create function http_overloaded(
+  args jsonb,
+  out resp_body jsonb
+)
+language sql as $$
+  select jsonb_build_object('version', 1);
+$$;
+
+create function http_overloaded(
+  args jsonb,
+  cookie_session jsonb,
+  out resp_body jsonb
+)
+language sql as $$
+  select jsonb_build_object('version', 2);
+$$;
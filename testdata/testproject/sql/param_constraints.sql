@@ -0,0 +1,10 @@
+create function http_param_constraints(
+  args jsonb,
+  out resp_body jsonb
+)
+language sql as $$
+  select jsonb_build_object(
+    'errors', args -> '__errors__',
+    'errorCodes', args -> '__error_codes__'
+  );
+$$;
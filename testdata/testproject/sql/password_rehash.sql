@@ -0,0 +1,25 @@
+create function http_api_login_rehash(
+  args jsonb,
+  out status smallint,
+  out resp_body jsonb
+)
+language plpgsql as $$
+begin
+  if not (args ->> 'validPassword')::boolean then
+    status := 400;
+    return;
+  end if;
+
+  if args ->> 'rehashedDigest' is not null then
+    update users
+    set password_digest = args ->> 'rehashedDigest'
+    where username = args ->> 'username';
+  end if;
+
+  resp_body := jsonb_build_object(
+    'rehashed', args ->> 'rehashedDigest' is not null,
+    'algorithm', split_part(args ->> 'rehashedDigest', '$', 2)
+  );
+  status := 200;
+end;
+$$;
@@ -0,0 +1,18 @@
+create function http_request_arg(
+  request jsonb,
+  headers jsonb,
+  remote_ip inet,
+  out resp_body jsonb
+)
+language plpgsql as $$
+begin
+  resp_body := jsonb_build_object(
+    'method', request ->> 'method',
+    'path', request ->> 'path',
+    'hasRequestID', request ? 'requestID',
+    'userAgent', headers ->> 'user-agent',
+    'authorization', headers ->> 'authorization',
+    'remoteIP', host(remote_ip)
+  );
+end;
+$$;
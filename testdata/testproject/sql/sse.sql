@@ -0,0 +1,25 @@
+create function http_sse_notify(
+  args jsonb,
+  out status smallint
+)
+language plpgsql as $$
+begin
+  perform pg_notify(args ->> 'channel', args ->> 'payload');
+  status := 204;
+end;
+$$;
+
+create function http_sse_channels(
+  args jsonb
+) returns text[]
+language sql as $$
+  select case when args ->> 'room' = 'secret' then null else array['sse_room_' || (args ->> 'room')] end;
+$$;
+
+create function http_sse_filter(
+  channel text,
+  payload text
+) returns text
+language sql as $$
+  select case when payload = 'skip' then null else upper(payload) end;
+$$;
@@ -0,0 +1,17 @@
+create function http_stream_numbers(
+  args jsonb
+) returns table(n int, label text)
+language sql as $$
+  select g, 'number ' || g
+  from generate_series(1, coalesce((args ->> 'count')::int, 3)) g;
+$$;
+
+-- Stable so the function is inlined and the division by zero at fail_at is raised after the earlier rows have been
+-- sent.
+create function http_stream_numbers_failing(
+  args jsonb
+) returns table(n int, label text)
+language sql stable as $$
+  select g, 'number ' || g / (g <> (args ->> 'fail_at')::int)::int
+  from generate_series(1, (args ->> 'count')::int) g;
+$$;
@@ -0,0 +1,44 @@
+create sequence transaction_retry_seq;
+
+create function http_transaction_retry(
+  out resp_body jsonb
+)
+language plpgsql as $$
+declare
+  _attempt bigint;
+begin
+  -- Sequences are not transactional so this fails every other attempt.
+  _attempt := nextval('transaction_retry_seq');
+  if _attempt % 2 = 1 then
+    raise exception 'simulated serialization failure' using errcode = 'serialization_failure';
+  end if;
+
+  resp_body := jsonb_build_object(
+    'attempt', _attempt,
+    'isolation', current_setting('transaction_isolation')
+  );
+end;
+$$;
+
+create function http_transaction_read_only(
+  out resp_body jsonb
+)
+language plpgsql as $$
+begin
+  insert into todos (name) values ('read only');
+  resp_body := '{}';
+end;
+$$;
+
+create function http_transaction_settings(
+  out resp_body jsonb
+)
+language plpgsql as $$
+begin
+  resp_body := jsonb_build_object(
+    'timeZone', current_setting('TimeZone'),
+    'statementTimeout', current_setting('statement_timeout'),
+    'lockTimeout', current_setting('lock_timeout')
+  );
+end;
+$$;
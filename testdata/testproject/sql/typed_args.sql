@@ -0,0 +1,24 @@
+create function http_typed_args(
+  todo_id int,
+  title text,
+  due date,
+  tags text[],
+  out resp_body jsonb
+)
+language sql as $$
+  select jsonb_build_object(
+    'todo_id', todo_id,
+    'title', title,
+    'due', due,
+    'tags', tags
+  );
+$$;
+
+create function http_typed_args_with_args(
+  args jsonb,
+  todo_id int,
+  out resp_body jsonb
+)
+language sql as $$
+  select jsonb_build_object('todo_id', todo_id, 'errors', args -> '__errors__');
+$$;
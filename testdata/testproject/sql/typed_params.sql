@@ -0,0 +1,14 @@
+create function http_typed_params(
+  args jsonb,
+  out resp_body jsonb
+)
+language sql as $$
+  select jsonb_strip_nulls(jsonb_build_object(
+    'date', (args ->> 'date')::date,
+    'time', (args ->> 'time')::time,
+    'at', (args ->> 'at')::timestamptz at time zone 'UTC',
+    'ratio', (args ->> 'ratio')::float8,
+    'priority', args ->> 'priority',
+    'errors', args -> '__errors__'
+  ));
+$$;
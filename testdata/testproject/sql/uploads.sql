@@ -0,0 +1,21 @@
+create function http_uploads(
+  args jsonb,
+  out resp_body jsonb
+)
+language sql as $$
+  select jsonb_strip_nulls(jsonb_build_object(
+    'document', args -> 'document',
+    'document_body', convert_from(lo_get((args -> 'document' ->> 'oid')::oid), 'UTF8'),
+    'avatar', args -> 'avatar',
+    'errors', args -> '__error_codes__'
+  ));
+$$;
+
+create function http_typed_uploads(
+  document jsonb,
+  n int,
+  out resp_body jsonb
+)
+language sql as $$
+  select jsonb_build_object('document', document, 'n', n);
+$$;
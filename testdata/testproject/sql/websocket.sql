@@ -0,0 +1,36 @@
+create function ws_echo(
+  message jsonb,
+  inout state jsonb,
+  out response jsonb
+)
+language plpgsql as $$
+begin
+  state := jsonb_build_object('count', coalesce((state ->> 'count')::int, 0) + 1);
+  response := jsonb_build_object('type', 'echo', 'text', message -> 'text', 'count', state -> 'count');
+end;
+$$;
+
+create function ws_raise(
+  message jsonb
+) returns void
+language plpgsql as $$
+begin
+  raise exception 'boom';
+end;
+$$;
+
+create function ws_divide_by_zero(
+  message jsonb,
+  out response jsonb
+)
+language sql as $$
+  select jsonb_build_object('type', 'divide', 'result', 1 / (message ->> 'divisor')::int);
+$$;
+
+create function ws_whoami(
+  cookie_session jsonb,
+  out response jsonb
+)
+language sql as $$
+  select jsonb_build_object('type', 'whoami', 'session', cookie_session);
+$$;